@@ -0,0 +1,704 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/willywotz/fivem/releases"
+	"github.com/willywotz/fivem/remoteconfig"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+)
+
+// Exit codes of the commands.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	// status: the service is installed but not running.
+	exitNotRunning = 3
+	// status: the service is not installed.
+	exitNotInstalled = 4
+	// update --check: another version is available.
+	exitUpdateAvailable = 10
+)
+
+var errUsage = errors.New("usage")
+
+var (
+	kernel32          = syscall.NewLazyDLL("kernel32.dll")
+	procAttachConsole = kernel32.NewProc("AttachConsole")
+)
+
+// attachParentProcess is ATTACH_PARENT_PROCESS, (DWORD)-1.
+const attachParentProcess = ^uint32(0)
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(c *cli, args []string) int
+}
+
+var commands = []*command{
+	{"install", "install [--no-start] [--json]", "install and start the service", runInstall},
+	{"uninstall", "uninstall [--json]", "remove the service and everything installing added", runUninstall},
+	{"start", "start [--json]", "start the service", runStart},
+	{"stop", "stop [--json]", "stop the service", runStop},
+	{"status", "status [--json]", "show the service and agent status", runStatus},
+	{"update", "update [--check] [--retry] [--json]", "update the service, or this executable without one, to the version the server assigns", runUpdate},
+	{"config", "config show [--json]", "show the effective configuration", runConfig},
+	{"diagnose", "diagnose [--json]", "check the installation and the connection to the server", runDiagnose},
+	{"version", "version [--json]", "show the version", runVersion},
+}
+
+func init() {
+	// help looks up commands, so it cannot be part of their initializer.
+	commands = append(commands, &command{"help", "help [command]", "show help for a command", runHelp})
+}
+
+func findCommand(name string) (*command, bool) {
+	i := slices.IndexFunc(commands, func(c *command) bool { return c.name == name })
+	if i < 0 {
+		return nil, false
+	}
+	return commands[i], true
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [-key=value...]\n\nCommands:\n", svcName)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nConfiguration keys may be given as -key=value, e.g. -base_url=https://example.com.\n")
+	fmt.Fprintf(w, "Without a command the agent installs itself and starts the user interface.\n")
+	fmt.Fprintf(w, "\nExit codes: 0 success, 1 failure, 2 usage error, 3 service not running,\n")
+	fmt.Fprintf(w, "4 service not installed, 10 update available (update --check).\n")
+}
+
+// runCommand runs the command named by the first argument that is not a
+// flag. It reports false when there is none, leaving main to its default.
+func runCommand(args []string) (int, bool) {
+	i := slices.IndexFunc(args, func(arg string) bool { return !strings.HasPrefix(arg, "-") })
+	if i < 0 {
+		if slices.Contains(args, "-h") || slices.Contains(args, "--help") {
+			attachConsole()
+			printUsage(os.Stdout)
+			return exitOK, true
+		}
+		return 0, false
+	}
+
+	attachConsole()
+
+	c, ok := findCommand(args[i])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[i])
+		printUsage(os.Stderr)
+		return exitUsage, true
+	}
+
+	rest := make([]string, 0, len(args))
+	for j, arg := range args {
+		if j == i || config.SetFlag(arg) {
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return c.run(&cli{command: c}, rest), true
+}
+
+// attachConsole writes output to the console the command was run from. The
+// release is built as a GUI program, which has none of its own; redirected
+// output works as is.
+func attachConsole() {
+	if _, err := windows.GetFileType(windows.Handle(os.Stdout.Fd())); err == nil {
+		return
+	}
+	if r, _, _ := procAttachConsole.Call(uintptr(attachParentProcess)); r == 0 {
+		return
+	}
+	if f, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+		os.Stdout, os.Stderr = f, f
+	}
+}
+
+// cli holds the flags every command shares.
+type cli struct {
+	command *command
+	json    bool
+	// args are the arguments left after the flags.
+	args []string
+}
+
+// parse parses the flags of the command, which define its own on fs, for
+// commands without arguments.
+func (c *cli) parse(fs *flag.FlagSet, args []string) error {
+	if err := c.parseArgs(fs, args); err != nil {
+		return err
+	}
+	if len(c.args) > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", c.args[0])
+		c.help(os.Stderr, fs)
+		return errUsage
+	}
+	return nil
+}
+
+// parseArgs is parse for commands with arguments. Flags may follow
+// arguments, as in config show --json.
+func (c *cli) parseArgs(fs *flag.FlagSet, args []string) error {
+	fs.BoolVar(&c.json, "json", false, "print the result as JSON")
+	fs.SetOutput(io.Discard)
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				c.help(os.Stdout, fs)
+				return flag.ErrHelp
+			}
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			c.help(os.Stderr, fs)
+			return errUsage
+		}
+		if fs.NArg() == 0 {
+			return nil
+		}
+		c.args = append(c.args, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func (c *cli) help(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: %s %s\n\n%s.\n", svcName, c.command.usage, c.command.summary)
+	if fs != nil {
+		fmt.Fprintf(w, "\nFlags:\n")
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+		fs.SetOutput(io.Discard)
+	}
+}
+
+func (c *cli) flags() *flag.FlagSet {
+	return flag.NewFlagSet(c.command.name, flag.ContinueOnError)
+}
+
+// parseExitCode turns a parse error into the exit code of the command.
+func parseExitCode(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	return exitUsage
+}
+
+// print writes v as JSON, or text otherwise.
+func (c *cli) print(v any, text string) {
+	if c.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(v)
+		return
+	}
+	fmt.Print(text)
+}
+
+// fail reports err and returns exitFailure.
+func (c *cli) fail(err error) int {
+	if c.json {
+		c.print(map[string]string{"error": err.Error()}, "")
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", c.command.name, err)
+	}
+	return exitFailure
+}
+
+// cliStep is one step of a command, or one check of diagnose.
+type cliStep struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type cliSteps struct {
+	OK    bool       `json:"ok"`
+	Steps []*cliStep `json:"steps"`
+}
+
+func (s *cliSteps) add(name string, err error, detail string) {
+	step := &cliStep{Name: name, OK: err == nil, Detail: detail}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	s.Steps = append(s.Steps, step)
+}
+
+// finish prints the steps, failing if any of them failed.
+func (c *cli) finish(s *cliSteps) int {
+	s.OK = !slices.ContainsFunc(s.Steps, func(step *cliStep) bool { return !step.OK })
+
+	var b strings.Builder
+	for _, step := range s.Steps {
+		mark := "ok  "
+		if !step.OK {
+			mark = "FAIL"
+		}
+		fmt.Fprintf(&b, "[%s] %s", mark, step.Name)
+		if step.Detail != "" {
+			fmt.Fprintf(&b, ": %s", step.Detail)
+		}
+		if step.Error != "" {
+			fmt.Fprintf(&b, ": %s", step.Error)
+		}
+		b.WriteString("\n")
+	}
+	c.print(s, b.String())
+
+	if !s.OK {
+		return exitFailure
+	}
+	return exitOK
+}
+
+func requireAdmin() error {
+	if !isAdmin() {
+		return fmt.Errorf("must be run as administrator")
+	}
+	return nil
+}
+
+func runInstall(c *cli, args []string) int {
+	fs := c.flags()
+	noStart := fs.Bool("no-start", false, "do not start the service")
+	if err := c.parse(fs, args); err != nil {
+		return parseExitCode(err)
+	}
+	if err := requireAdmin(); err != nil {
+		return c.fail(err)
+	}
+
+	steps := &cliSteps{}
+	steps.add("defender exclusion", defenderExclude(svcName), "")
+
+	status, err := queryService(svcName)
+	if err != nil {
+		steps.add("install service", err, "")
+		return c.finish(steps)
+	}
+	if status.Installed {
+		steps.add("install service", nil, "already installed")
+	} else if err := installService(svcName, svcDisplayName); err != nil {
+		steps.add("install service", err, "")
+		return c.finish(steps)
+	} else {
+		steps.add("install service", nil, "")
+	}
+
+	steps.add("service path", verifyExecuteServicePath(svcName), "")
+	steps.add("recovery actions", verifyRecoveryService(svcName), "")
+	if !*noStart {
+		detail, err := ensureServiceRunning()
+		steps.add("start service", err, detail)
+	}
+	return c.finish(steps)
+}
+
+func runUninstall(c *cli, args []string) int {
+	if err := c.parse(c.flags(), args); err != nil {
+		return parseExitCode(err)
+	}
+	if err := requireAdmin(); err != nil {
+		return c.fail(err)
+	}
+	return c.finish(uninstallAgent(false))
+}
+
+// ensureServiceRunning starts the service unless it already runs.
+func ensureServiceRunning() (string, error) {
+	status, err := queryService(svcName)
+	if err != nil {
+		return "", err
+	}
+	if !status.Installed {
+		return "", fmt.Errorf("service %s is not installed", svcName)
+	}
+	if status.State == serviceStates[svc.Running] {
+		return "already running", nil
+	}
+	return "", startService(svcName)
+}
+
+func runStart(c *cli, args []string) int {
+	if err := c.parse(c.flags(), args); err != nil {
+		return parseExitCode(err)
+	}
+
+	steps := &cliSteps{}
+	detail, err := ensureServiceRunning()
+	steps.add("start service", err, detail)
+	return c.finish(steps)
+}
+
+func runStop(c *cli, args []string) int {
+	if err := c.parse(c.flags(), args); err != nil {
+		return parseExitCode(err)
+	}
+
+	steps := &cliSteps{}
+	status, err := queryService(svcName)
+	switch {
+	case err != nil:
+		steps.add("stop service", err, "")
+	case !status.Installed:
+		steps.add("stop service", fmt.Errorf("service %s is not installed", svcName), "")
+	case status.State == serviceStates[svc.Stopped]:
+		steps.add("stop service", nil, "already stopped")
+	default:
+		steps.add("stop service", controlService(svcName, svc.Stop, svc.Stopped), "")
+	}
+	return c.finish(steps)
+}
+
+type statusResult struct {
+	Version   string         `json:"version"`
+	MachineID string         `json:"machine_id"`
+	BaseURL   string         `json:"base_url"`
+	Channel   string         `json:"update_channel"`
+	Service   *serviceStatus `json:"service"`
+}
+
+func runStatus(c *cli, args []string) int {
+	if err := c.parse(c.flags(), args); err != nil {
+		return parseExitCode(err)
+	}
+
+	service, err := queryService(svcName)
+	if err != nil {
+		return c.fail(err)
+	}
+	machineID, _ := machineID()
+	result := &statusResult{
+		Version:   version,
+		MachineID: machineID,
+		BaseURL:   config.BaseURL(),
+		Channel:   config.String(ConfigUpdateChannel),
+		Service:   service,
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Version:    %s\nMachine ID: %s\nServer:     %s\nChannel:    %s\n", result.Version, result.MachineID, result.BaseURL, result.Channel)
+	if service.Installed {
+		fmt.Fprintf(&b, "Service:    %s (%s start)\nPath:       %s\n", service.State, service.StartType, service.Path)
+	} else {
+		fmt.Fprintf(&b, "Service:    not installed\n")
+	}
+	c.print(result, b.String())
+
+	switch {
+	case !service.Installed:
+		return exitNotInstalled
+	case service.State != serviceStates[svc.Running]:
+		return exitNotRunning
+	}
+	return exitOK
+}
+
+type updateResult struct {
+	Executable      string `json:"executable"`
+	Version         string `json:"version"`
+	Target          string `json:"target"`
+	Channel         string `json:"channel"`
+	UpdateAvailable bool   `json:"update_available"`
+	Updated         bool   `json:"updated"`
+	Restarted       bool   `json:"restarted"`
+}
+
+// runUpdate updates the executable of the service, which is restarted to
+// run it, or this executable when no service is installed. The pending
+// update goes to the state of the process running the executable, which
+// checks it after the restart, see rollback.go.
+func runUpdate(c *cli, args []string) int {
+	fs := c.flags()
+	check := fs.Bool("check", false, "only check whether another version is available")
+	retry := fs.Bool("retry", false, "install versions that were rolled back before again")
+	if err := c.parse(fs, args); err != nil {
+		return parseExitCode(err)
+	}
+
+	service, err := queryService(svcName)
+	if err != nil {
+		return c.fail(err)
+	}
+	exe, current, from := "", version, "client"
+	if service.Installed {
+		exe, from = strings.Trim(service.Path, `"`), "service"
+		if current, err = executableVersion(exe); err != nil {
+			// An executable of unknown version is updated to the target.
+			fmt.Fprintf(os.Stderr, "%s: %v\n", c.command.name, err)
+			current = "unknown"
+		}
+	} else if exe, err = os.Executable(); err != nil {
+		return c.fail(fmt.Errorf("failed to get executable path: %w", err))
+	}
+
+	target, err := fetchUpdateTarget("")
+	if err != nil {
+		return c.fail(err)
+	}
+	result := &updateResult{
+		Executable:      exe,
+		Version:         current,
+		Target:          target.Version,
+		Channel:         target.Channel,
+		UpdateAvailable: updateAvailable(target, current),
+	}
+
+	if !result.UpdateAvailable {
+		c.print(result, fmt.Sprintf("Version %s is up to date on channel %s\n", current, target.Channel))
+		return exitOK
+	}
+	if *check {
+		c.print(result, fmt.Sprintf("Version %s is available on channel %s, running %s\n", target.Version, target.Channel, current))
+		return exitUpdateAvailable
+	}
+	if *retry || target.Retry {
+		if err := clearFailedVersions(from); err != nil {
+			return c.fail(err)
+		}
+	}
+
+	if from != "service" {
+		if err := installUpdate(exe, current, target, from); err != nil {
+			return c.fail(err)
+		}
+		result.Updated = true
+		c.print(result, fmt.Sprintf("Updated %s to version %s, it runs from the next start\n", exe, target.Version))
+		return exitOK
+	}
+
+	if err := requireAdmin(); err != nil {
+		return c.fail(err)
+	}
+	// The service would otherwise keep running the old version and install
+	// the new one again.
+	running := service.State == serviceStates[svc.Running]
+	if running {
+		if err := controlService(svcName, svc.Stop, svc.Stopped); err != nil {
+			return c.fail(fmt.Errorf("failed to stop service: %w", err))
+		}
+	}
+	updateErr := installUpdate(exe, current, target, from)
+	if running {
+		if err := startService(svcName); err != nil {
+			return c.fail(errors.Join(updateErr, fmt.Errorf("failed to start service: %w", err)))
+		}
+		result.Restarted = true
+	}
+	if updateErr != nil {
+		return c.fail(updateErr)
+	}
+
+	result.Updated = true
+	text := fmt.Sprintf("Updated the service to version %s\n", target.Version)
+	if !running {
+		text = fmt.Sprintf("Updated the service to version %s, it runs from the next start\n", target.Version)
+	}
+	c.print(result, text)
+	return exitOK
+}
+
+// executableVersionTimeout bounds asking an executable for its version.
+const executableVersionTimeout = 10 * time.Second
+
+// executableVersion asks exe for its version with the --version flag, which
+// versions from before the version command know too. An executable that
+// does not answer in time is killed.
+func executableVersion(exe string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), executableVersionTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, exe, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get version of %s: %w", exe, err)
+	}
+	_, v, ok := strings.Cut(string(out), "Version: ")
+	if v = strings.TrimSpace(v); !ok || v == "" {
+		return "", fmt.Errorf("failed to get version of %s: %q", exe, out)
+	}
+	return strings.Fields(v)[0], nil
+}
+
+func runConfig(c *cli, args []string) int {
+	fs := c.flags()
+	if err := c.parseArgs(fs, args); err != nil {
+		return parseExitCode(err)
+	}
+	if len(c.args) != 1 || c.args[0] != "show" {
+		c.help(os.Stderr, fs)
+		return exitUsage
+	}
+
+	values := config.Effective()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s = %s\n", key, values[key])
+	}
+	c.print(values, b.String())
+	return exitOK
+}
+
+func runDiagnose(c *cli, args []string) int {
+	if err := c.parse(c.flags(), args); err != nil {
+		return parseExitCode(err)
+	}
+
+	steps := &cliSteps{}
+
+	if isAdmin() {
+		steps.add("administrator", nil, "running elevated")
+	} else {
+		steps.add("administrator", nil, "not running elevated, service checks may fail")
+	}
+
+	if service, err := queryService(svcName); err != nil {
+		steps.add("service", err, "")
+	} else if !service.Installed {
+		steps.add("service", fmt.Errorf("not installed"), "")
+	} else if service.State != serviceStates[svc.Running] {
+		steps.add("service", fmt.Errorf("%s", service.State), service.Path)
+	} else {
+		steps.add("service", nil, "running "+service.Path)
+	}
+
+	path, err := checkConfigFile()
+	steps.add("config file", err, path)
+
+	machineID, err := machineID()
+	steps.add("machine id", err, machineID)
+	if err == nil {
+		enrolled, err := hasAgentKey(machineID)
+		detail := "not enrolled yet"
+		if enrolled {
+			detail = "enrolled"
+		}
+		steps.add("agent key", err, detail)
+	}
+
+	if target, err := fetchUpdateTarget(""); err != nil {
+		steps.add("server", err, config.BaseURL())
+	} else {
+		steps.add("server", nil, fmt.Sprintf("%s assigns %s on channel %s", config.BaseURL(), cmp.Or(target.Version, "no version"), target.Channel))
+	}
+	detail, err := checkReleaseFeed()
+	steps.add("release feed", err, detail)
+
+	if _, err := releases.ParsePublicKey(releasePublicKey); err != nil {
+		steps.add("release key", fmt.Errorf("none built in, updates are disabled"), "")
+	} else {
+		steps.add("release key", nil, "built in")
+	}
+	if _, err := remoteconfig.ParsePublicKey(configPublicKey); err != nil {
+		steps.add("config key", nil, "none built in, remote config is ignored")
+	} else {
+		steps.add("config key", nil, "built in")
+	}
+
+	for _, from := range []string{"service", "client"} {
+		name := from + " update state"
+		if state, err := loadUpdateState(from); err != nil {
+			steps.add(name, err, "")
+		} else if state.Pending != nil {
+			steps.add(name, nil, fmt.Sprintf("%s pending since %s", state.Pending.Version, state.Pending.Installed.Format(time.RFC3339)))
+		} else if len(state.FailedVersions) > 0 {
+			steps.add(name, nil, "rolled back "+strings.Join(state.FailedVersions, ", "))
+		} else {
+			steps.add(name, nil, "")
+		}
+	}
+
+	return c.finish(steps)
+}
+
+// checkConfigFile reports the config file and whether it decodes.
+func checkConfigFile() (string, error) {
+	path, err := configFilePath()
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return path + " not present, using defaults", nil
+	}
+	if err != nil {
+		return path, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var values map[string]string
+	if err := json.Unmarshal(b, &values); err != nil {
+		return path, fmt.Errorf("failed to decode config file: %w", err)
+	}
+	return path, nil
+}
+
+func checkReleaseFeed() (string, error) {
+	u := config.BaseURL() + "/releases/manifest.json"
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		return u, fmt.Errorf("failed to fetch release manifest: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return u, fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+
+	var m releases.Manifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return u, fmt.Errorf("failed to decode release manifest: %w", err)
+	}
+	return fmt.Sprintf("%d releases", len(m.Releases)), nil
+}
+
+type versionResult struct {
+	Version string `json:"version"`
+	Go      string `json:"go"`
+	Arch    string `json:"arch"`
+}
+
+func runVersion(c *cli, args []string) int {
+	if err := c.parse(c.flags(), args); err != nil {
+		return parseExitCode(err)
+	}
+	c.print(&versionResult{Version: version, Go: runtime.Version(), Arch: runtime.GOARCH}, version+"\n")
+	return exitOK
+}
+
+func runHelp(c *cli, args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+	target, ok := findCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return exitUsage
+	}
+	return target.run(&cli{command: target}, []string{"-h"})
+}
@@ -4,15 +4,12 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"image"
-	"image/jpeg"
 	"log"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +19,8 @@ import (
 	"github.com/moutend/go-hook/pkg/keyboard"
 	"github.com/moutend/go-hook/pkg/mouse"
 	"github.com/moutend/go-hook/pkg/types"
+	"github.com/willywotz/fivem/imaging"
+	"github.com/willywotz/fivem/protocol"
 	"golang.org/x/sys/windows/svc"
 )
 
@@ -97,8 +96,7 @@ func UpdateClientStatus(cmd *UpdateClientStatusCommand) {
 		return
 	}
 
-	baseURL := GetTxt("base_url", "http://localhost:8080")
-	r, err := http.NewRequest(http.MethodPost, baseURL+"/status", body)
+	r, err := http.NewRequest(http.MethodPost, config.BaseURL()+"/status", body)
 	if err != nil {
 		failedf("failed to create request: %v", err)
 		return
@@ -130,83 +128,304 @@ func handleWebsocket(from string) {
 		handleWebsocket(from)
 	}()
 
-	u := url.URL{Scheme: "wss", Host: "fivem-tools.willywotz.com", Path: "/ws"}
-	log.Printf("connecting to %s", u.String())
+	wsURL := config.WebSocketURL()
+	log.Printf("connecting to %s", wsURL)
 
 	dialer := &websocket.Dialer{
 		Proxy:            http.ProxyFromEnvironment,
 		HandshakeTimeout: 45 * time.Second,
 	}
 
-	conn, _, err := dialer.Dial(u.String(), nil)
+	conn, _, err := dialer.Dial(wsURL, nil)
 	if err != nil {
 		failedf("failed to connect to WebSocket: %v", err)
+		deferRegistration()
 		return
 	}
 	defer func() { _ = conn.Close() }()
 
+	ws := &wsConn{Conn: conn}
+
 	conn.SetPingHandler(func(appData string) error {
-		return conn.WriteMessage(websocket.PongMessage, []byte(appData))
+		return ws.WriteMessage(websocket.PongMessage, []byte(appData))
 	})
 
 	localMachineID, _ := machineID()
 	localHostname, _ := os.Hostname()
 	localUsername, _ := os.LookupEnv("USERNAME")
 
-	_ = conn.WriteJSON(map[string]string{
-		"action":     "register",
-		"machine_id": localMachineID,
-		"hostname":   localHostname,
-		"username":   localUsername,
-		"from":       from,
-	})
+	env, err := readEnvelope(conn)
+	if err != nil {
+		failedf("failed to read registration challenge: %v", err)
+		deferRegistration()
+		return
+	}
+	var challenge protocol.Challenge
+	if env.Type != protocol.TypeChallenge || env.Decode(&challenge) != nil {
+		failedf("unexpected %s message instead of registration challenge", env.Type)
+		registrationFailed(fmt.Errorf("unexpected %s message instead of registration challenge", env.Type))
+		return
+	}
+
+	if challenge.Transparency.RequireConsent {
+		// The user may take a while to answer.
+		done := waitRegistration()
+		if err := ensureConsent(localMachineID); err != nil {
+			failedf("not registering without consent: %v", err)
+			time.Sleep(consentRetryDelay)
+			done()
+			return
+		}
+		done()
+	}
+
+	reg, register, err := newRegistration(wsURL, localMachineID, challenge.Nonce, challenge.ServerKey)
+	if err != nil {
+		failedf("failed to prepare registration: %v", err)
+		registrationFailed(err)
+		return
+	}
+	register.MachineID = localMachineID
+	register.Hostname = localHostname
+	register.Username = localUsername
+	register.From = from
+	register.Version = version
+	register.Capabilities = []string{protocol.CapabilityScreenshot, protocol.CapabilityUpload, protocol.CapabilityConfig, protocol.CapabilityUninstall, protocol.CapabilityUninstallExit}
+	register.FiveMIdentifiers = localFiveMIdentifiers()
+	if env, err = protocol.New(protocol.TypeRegister, register); err != nil {
+		failedf("failed to encode registration: %v", err)
+		return
+	}
+	if err := writeEnvelope(ws, env); err != nil {
+		failedf("failed to send registration: %v", err)
+		deferRegistration()
+		return
+	}
+
+	if env, err = readEnvelope(conn); err != nil {
+		failedf("failed to read registration response: %v", err)
+		deferRegistration()
+		return
+	}
+	var registered protocol.Registered
+	if env.Type != protocol.TypeRegistered || env.Decode(&registered) != nil {
+		failedf("registration rejected: %s", envelopeError(env))
+		registrationFailed(fmt.Errorf("registration rejected: %s", envelopeError(env)))
+		return
+	}
+	if err := reg.verify(localMachineID, registered.Signature); err != nil {
+		failedf("failed to verify server: %v", err)
+		registrationFailed(err)
+		return
+	}
 	log.Printf("Registered machine ID: %s, hostname: %s, username: %s", localMachineID, localHostname, localUsername)
+	confirmUpdateHealthy()
+
+	// Servers that accept uploads get screenshots in chunks, resumed across
+	// reconnects, instead of inline in the result.
+	useUploads := slices.Contains(challenge.Capabilities, protocol.CapabilityUpload)
+	acks := make(chan *protocol.Envelope, 16)
+	done := make(chan struct{})
+	defer close(done)
+	if useUploads {
+		go uploads.run(ws, acks, done)
+	}
 
-	for {
-		messageType, p, err := conn.ReadMessage()
+	router := protocol.NewRouter()
+
+	router.Handle(protocol.TypeScreenshotRequest, func(env *protocol.Envelope) error {
+		log.Println("Taking screenshot...")
+
+		result := &protocol.ScreenshotResult{
+			MachineID: localMachineID,
+			Hostname:  localHostname,
+			Username:  localUsername,
+		}
+
+		var req protocol.ScreenshotRequest
+		if len(env.Payload) > 0 {
+			if err := env.Decode(&req); err != nil {
+				return err
+			}
+		}
+
+		opts, err := imagingOptions(req.CaptureOptions).Normalize()
+		result.Options = req.CaptureOptions
+		result.Options.Format = string(opts.Format)
+		result.Options.Quality = opts.Quality
 		if err != nil {
-			failedf("failed to read message from WebSocket: %v", err)
-			break
+			result.Error = fmt.Sprintf("invalid capture options: %v", err)
+		} else if result.Items, err = CaptureScreenshot(req.CaptureOptions); err != nil {
+			result.Error = fmt.Sprintf("failed to capture screenshot: %v", err)
+			failedf("failed to capture screenshot: %v", err)
 		}
 
-		_ = messageType // Ignore message type for now
-		_ = p           // Ignore payload for now
+		entry := CaptureLogEntry{
+			Time:        time.Now(),
+			RequestID:   env.ID,
+			RequestedBy: req.RequestedBy,
+			Displays:    make([]int, 0, len(result.Items)),
+			Format:      result.Options.Format,
+			Error:       result.Error,
+		}
+		for _, item := range result.Items {
+			if item.Error == "" {
+				entry.Displays = append(entry.Displays, item.DisplayIndex)
+			}
+		}
+		if err := appendCaptureLog(entry); err != nil {
+			failedf("failed to log capture: %v", err)
+		}
+		if challenge.Transparency.Notify && len(entry.Displays) > 0 {
+			go notifyCapture(req.RequestedBy, len(entry.Displays))
+		}
 
-		if messageType == websocket.TextMessage && p != nil {
-			// log.Printf("Received message: %s", string(p))
+		if useUploads {
+			uploads.Add(newScreenshotUpload(env, result))
+			return nil
+		}
 
-			if string(p[:15]) == "take_screenshot" {
-				log.Println("Taking screenshot...")
+		reply, err := env.Reply(protocol.TypeScreenshotResult, result)
+		if err != nil {
+			return err
+		}
+		return writeEnvelope(ws, reply)
+	})
 
-				var data struct {
-					Action    string `json:"action"`
-					MachineID string `json:"machine_id"`
-					Hostname  string `json:"hostname"`
-					Username  string `json:"username"`
+	// Acknowledgements nobody waits for any more are dropped rather than
+	// allowed to stall the message loop.
+	deliverAck := func(env *protocol.Envelope) {
+		select {
+		case acks <- env:
+		default:
+			failedf("dropping %s message, upload queue is not reading", env.Type)
+		}
+	}
 
-					Data  []*CaptureScreenshotItem `json:"data"`
-					Error string                   `json:"error"`
-				}
+	router.Handle(protocol.TypeUploadAck, func(env *protocol.Envelope) error {
+		deliverAck(env)
+		return nil
+	})
 
-				data.Action = "screenshot"
-				data.MachineID = localMachineID
-				data.Hostname = localHostname
-				data.Username = localUsername
+	router.Handle(protocol.TypeConfig, func(env *protocol.Envelope) error {
+		var pushed protocol.Config
+		if err := env.Decode(&pushed); err != nil {
+			return fmt.Errorf("failed to decode config: %w", err)
+		}
 
-				var err error
-				if data.Data, err = CaptureScreenshot(); err != nil {
-					data.Error = fmt.Sprintf("failed to capture screenshot: %v", err)
-					failedf("failed to capture screenshot: %v", err)
-				}
+		rejected := config.SetPushed(pushed.Values)
+		for key, reason := range rejected {
+			failedf("rejected pushed config %s: %s", key, reason)
+		}
 
-				if err := conn.WriteJSON(data); err != nil {
-					failedf("failed to send screenshot results: %v", err)
-				}
+		ack, err := env.Reply(protocol.TypeConfigAck, &protocol.ConfigAck{Version: pushed.Version, Rejected: rejected})
+		if err != nil {
+			return err
+		}
+		return writeEnvelope(ws, ack)
+	})
+
+	// Uninstalling decommissions the machine, so the agent exits afterwards
+	// instead of reconnecting.
+	router.Handle(protocol.TypeUninstall, func(env *protocol.Envelope) error {
+		var req protocol.Uninstall
+		if err := env.Decode(&req); err != nil {
+			return fmt.Errorf("failed to decode uninstall: %w", err)
+		}
+		inService, _ := svc.IsWindowsService()
+		if req.ExitOnly {
+			failedf("Exiting, the other process uninstalls, requested by %s", req.RequestedBy)
+			_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "uninstalling"))
+			exitUninstalled(inService)
+		}
+		failedf("Uninstalling, requested by %s", req.RequestedBy)
 
-				continue
+		steps := uninstallAgent(inService)
+		for _, step := range steps.Steps {
+			if !step.OK {
+				failedf("failed to %s: %s", step.Name, step.Error)
 			}
 		}
+
+		reply, err := env.Reply(protocol.TypeUninstallResult, steps.uninstallResult(localMachineID))
+		if err == nil {
+			err = writeEnvelope(ws, reply)
+		}
+		if err != nil {
+			failedf("failed to report uninstall: %v", err)
+		}
+		_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "uninstalled"))
+		exitUninstalled(inService)
+		return nil
+	})
+
+	router.Handle(protocol.TypeError, func(env *protocol.Envelope) error {
+		failedf("server error: %s", envelopeError(env))
+		if useUploads && env.CorrelationID != "" {
+			deliverAck(env)
+		}
+		return nil
+	})
+
+	for {
+		env, err := readEnvelope(conn)
+		var versionErr *protocol.UnsupportedVersionError
+		if errors.As(err, &versionErr) {
+			failedf("ignoring message: %v", err)
+			continue
+		}
+		if err != nil {
+			failedf("failed to read message from WebSocket: %v", err)
+			break
+		}
+
+		if err := router.Dispatch(env); err != nil {
+			failedf("failed to handle %s message: %v", env.Type, err)
+		}
+	}
+}
+
+func readEnvelope(conn *websocket.Conn) (*protocol.Envelope, error) {
+	for {
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if messageType == websocket.TextMessage {
+			return protocol.Decode(p)
+		}
+	}
+}
+
+// wsConn serializes writes to a connection shared by the message loop and
+// the upload queue.
+type wsConn struct {
+	*websocket.Conn
+
+	mu sync.Mutex
+}
+
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+func writeEnvelope(conn *wsConn, env *protocol.Envelope) error {
+	b, err := env.Marshal()
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, b)
+}
+
+func envelopeError(env *protocol.Envelope) string {
+	var e protocol.Error
+	if env.Type != protocol.TypeError || env.Decode(&e) != nil {
+		return fmt.Sprintf("unexpected %s message", env.Type)
 	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
 }
 
 func handleUpdateClientStatus(from string) {
@@ -254,86 +473,38 @@ func handleUpdateClientStatus(from string) {
 		}
 	}()
 
-	for {
-		statusTickStr := GetTxt("status_tick", "300")
-		statusTickInt, _ := strconv.Atoi(statusTickStr)
-		statusTick := time.Duration(statusTickInt) * time.Second
-
-		if statusTick <= 0 {
-			statusTick = 300 * time.Second // Default to 5 minutes if invalid
-		}
-		UpdateClientStatus(&UpdateClientStatusCommand{
-			From:       from,
-			SinceInput: statusTick,
-		})
-
-		time.Sleep(statusTick)
-	}
-}
-
-var (
-	mapTxts     map[string]string
-	mapTxtsMu   sync.Mutex
-	mapTxtsTime time.Time
-)
-
-func GetTxt(name string, defaultValue ...string) string {
-	mapTxtsMu.Lock()
-	defer mapTxtsMu.Unlock()
-
-	ttl := time.Since(mapTxtsTime) < 5*time.Minute
-	if v, ok := mapTxts[name]; ok && ttl {
-		return v
-	}
+	// A pushed status_tick takes effect right away instead of after the
+	// current tick.
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
-	localMapTxts := make(map[string]string)
-	txts, err := net.LookupTXT("_fivem_tools.willywotz.com")
-	if err != nil {
-		failedf("failed to lookup TXT records: %v", err)
-		return getOrDefaultMap(localMapTxts, name, defaultValue...)
-	}
-
-	for _, txt := range txts {
-		for _, part := range strings.Split(txt, ";") {
-			kv := strings.SplitN(part, "=", 2)
-			if len(kv) != 2 {
-				continue
-			}
-			localMapTxts[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	var last time.Time
+	for {
+		select {
+		case <-timer.C:
+			last = time.Now()
+			UpdateClientStatus(&UpdateClientStatusCommand{
+				From:       from,
+				SinceInput: config.Seconds(ConfigStatusTick),
+			})
+		case <-config.Changed():
 		}
-	}
 
-	if len(localMapTxts) == 0 {
-		failedf("No valid TXT records found")
-		return getOrDefaultMap(localMapTxts, name, defaultValue...)
+		timer.Reset(max(0, time.Until(last.Add(config.Seconds(ConfigStatusTick)))))
 	}
-
-	mapTxts = localMapTxts
-	mapTxtsTime = time.Now()
-
-	return getOrDefaultMap(localMapTxts, name, defaultValue...)
 }
 
-func getOrDefaultMap[T any](m map[string]T, key string, defaultValue ...T) T {
-	if value, ok := m[key]; ok {
-		return value
+func imagingOptions(o protocol.CaptureOptions) imaging.Options {
+	return imaging.Options{
+		Format:    imaging.Format(o.Format),
+		Quality:   o.Quality,
+		MaxWidth:  o.MaxWidth,
+		MaxHeight: o.MaxHeight,
 	}
-	if len(defaultValue) > 0 {
-		return defaultValue[0]
-	}
-	var zeroValue T
-	return zeroValue
-}
-
-type CaptureScreenshotItem struct {
-	DisplayIndex  int             `json:"display_index"`
-	DisplayBounds image.Rectangle `json:"display_bounds"`
-	Image         string          `json:"image"`
-	Error         string          `json:"error"`
 }
 
-func CaptureScreenshot() (results []*CaptureScreenshotItem, err error) {
-	results = make([]*CaptureScreenshotItem, 0)
+func CaptureScreenshot(opts protocol.CaptureOptions) (results []*protocol.ScreenshotItem, err error) {
+	results = make([]*protocol.ScreenshotItem, 0)
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -343,8 +514,12 @@ func CaptureScreenshot() (results []*CaptureScreenshotItem, err error) {
 	}()
 
 	if inService, _ := svc.IsWindowsService(); inService {
+		b, err := json.Marshal(opts)
+		if err != nil {
+			return results, fmt.Errorf("failed to encode capture options: %v", err)
+		}
 		commandLine, _ := os.Executable()
-		commandLine = fmt.Sprintf("%s -screenshot", commandLine)
+		commandLine = fmt.Sprintf("%s -screenshot -screenshot-options=%s", commandLine, base64.RawURLEncoding.EncodeToString(b))
 
 		output, err := runInUserSession(commandLine)
 		if err != nil {
@@ -377,11 +552,21 @@ func CaptureScreenshot() (results []*CaptureScreenshotItem, err error) {
 
 	n := screenshot.NumActiveDisplays()
 
-	for i := 0; i < n; i++ {
-		r := &CaptureScreenshotItem{
-			DisplayIndex:  i,
-			DisplayBounds: screenshot.GetDisplayBounds(i),
+	displays := opts.Displays
+	if len(displays) == 0 {
+		for i := 0; i < n; i++ {
+			displays = append(displays, i)
+		}
+	}
+
+	for _, i := range displays {
+		r := &protocol.ScreenshotItem{DisplayIndex: i}
+		if i < 0 || i >= n {
+			r.Error = fmt.Sprintf("display %d does not exist, %d active", i, n)
+			results = append(results, r)
+			continue
 		}
+		r.DisplayBounds = screenshot.GetDisplayBounds(i)
 
 		img, err := screenshot.CaptureRect(r.DisplayBounds)
 		if err != nil {
@@ -392,18 +577,17 @@ func CaptureScreenshot() (results []*CaptureScreenshotItem, err error) {
 
 		var buf bytes.Buffer
 
-		// if err := png.Encode(&buf, img); err != nil {
-		// 	r.Error = fmt.Sprintf("failed to encode screenshot: %v", err)
-		// 	results = append(results, r)
-		// 	continue
-		// }
-
-		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		applied, err := imaging.Encode(&buf, img, imagingOptions(opts))
+		if err != nil {
 			r.Error = fmt.Sprintf("failed to encode screenshot: %v", err)
 			results = append(results, r)
 			continue
 		}
 
+		r.Format = string(applied.Format)
+		r.Quality = applied.Quality
+		r.Width = applied.Width
+		r.Height = applied.Height
 		r.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
 		results = append(results, r)
 	}
@@ -0,0 +1,70 @@
+// Command configsign creates the key pair for remote agent configuration and
+// signs configuration records with it.
+//
+//	configsign -genkey -key config.key
+//	configsign -key config.key -serial 8 base_url=https://fivem-tools.willywotz.com status_tick=300
+//
+// The printed record goes into the _fivem_tools TXT record or the server's
+// -remote-config file. Build agents with
+// -X main.configPublicKey=<public key> so they accept it.
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/willywotz/fivem/remoteconfig"
+)
+
+func main() {
+	keyPath := flag.String("key", "config.key", "path of the signing key seed")
+	genKey := flag.Bool("genkey", false, "create a new signing key and print its public key")
+	serial := flag.Uint64("serial", 0, "serial of the record, higher than any published before")
+	flag.Parse()
+
+	if *genKey {
+		if _, err := os.Stat(*keyPath); err == nil {
+			log.Fatalf("%s already exists", *keyPath)
+		}
+		_, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			log.Fatalf("failed to generate key: %v", err)
+		}
+		if err := os.WriteFile(*keyPath, key.Seed(), 0o600); err != nil {
+			log.Fatalf("failed to write key: %v", err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+		return
+	}
+
+	seed, err := os.ReadFile(*keyPath)
+	if err != nil {
+		log.Fatalf("failed to read key: %v", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		log.Fatalf("invalid key in %s", *keyPath)
+	}
+	if *serial == 0 {
+		log.Fatalf("-serial is required")
+	}
+
+	r := &remoteconfig.Record{Serial: *serial, Values: make(map[string]string)}
+	for _, arg := range flag.Args() {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			log.Fatalf("expected key=value, got %q", arg)
+		}
+		r.Values[key] = value
+	}
+
+	record, err := remoteconfig.Sign(r, ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		log.Fatalf("failed to sign config: %v", err)
+	}
+	fmt.Println(record)
+}
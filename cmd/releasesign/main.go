@@ -0,0 +1,72 @@
+// Command releasesign creates the key pair for release artifacts and signs
+// artifacts with it.
+//
+//	releasesign -genkey -key release.key
+//	releasesign -key release.key -version v1.4.0 fivem-windows-amd64.exe
+//
+// The signature is written next to the artifact as <artifact>.sig, which
+// the release feed mirrors from GitHub, or can be passed in the X-Signature
+// header when uploading to the feed. Build agents with
+// -X main.releasePublicKey=<public key> so they accept it.
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/willywotz/fivem/releases"
+)
+
+func main() {
+	keyPath := flag.String("key", "release.key", "path of the signing key seed")
+	genKey := flag.Bool("genkey", false, "create a new signing key and print its public key")
+	version := flag.String("version", "", "version the artifacts are released as, e.g. v1.4.0")
+	flag.Parse()
+
+	if *genKey {
+		if _, err := os.Stat(*keyPath); err == nil {
+			log.Fatalf("%s already exists", *keyPath)
+		}
+		_, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			log.Fatalf("failed to generate key: %v", err)
+		}
+		if err := os.WriteFile(*keyPath, key.Seed(), 0o600); err != nil {
+			log.Fatalf("failed to write key: %v", err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+		return
+	}
+
+	seed, err := os.ReadFile(*keyPath)
+	if err != nil {
+		log.Fatalf("failed to read key: %v", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		log.Fatalf("invalid key in %s", *keyPath)
+	}
+	if !releases.ValidVersion(*version) {
+		log.Fatalf("-version is required and must look like v1.2.3")
+	}
+	if flag.NArg() == 0 {
+		log.Fatalf("no artifacts to sign")
+	}
+
+	key := ed25519.NewKeyFromSeed(seed)
+	for _, path := range flag.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("failed to read artifact: %v", err)
+		}
+		sig := releases.Sign(key, *version, filepath.Base(path), data)
+		if err := os.WriteFile(path+".sig", []byte(sig+"\n"), 0o644); err != nil {
+			log.Fatalf("failed to write signature: %v", err)
+		}
+		fmt.Printf("%s.sig\n", path)
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+	"github.com/willywotz/fivem/remoteconfig"
+	"golang.org/x/sys/windows/svc"
+)
+
+// configPublicKey verifies remote config records, see cmd/configsign. It
+// is set at build time; without it remote config is ignored.
+var configPublicKey string = ""
+
+// Configuration keys. Each layer may set any of them; later layers win:
+// built-in defaults, the config file in %ProgramData%\FiveMTools, signed
+// remote config from DNS TXT or config_url, config pushed by the server over
+// the WebSocket and finally command-line flags.
+const (
+	// base_url is the server the agent reports to, e.g.
+	// https://staging.example.com for a self-hosted server.
+	ConfigBaseURL = "base_url"
+	// ws_url overrides the WebSocket URL derived from base_url.
+	ConfigWebSocketURL = "ws_url"
+	// txt_domain holds the TXT records of the DNS layer; "none" disables
+	// the layer, which a config file pointing at a staging server wants so
+	// production records do not override it.
+	ConfigTXTDomain = "txt_domain"
+	// config_url serves a signed config record over HTTP, in addition to
+	// the TXT records.
+	ConfigURL = "config_url"
+	// status_tick is the number of seconds between status reports.
+	ConfigStatusTick = "status_tick"
+	// update_channel is the release channel the agent asks the server for:
+	// stable, beta or canary.
+	ConfigUpdateChannel = "update_channel"
+	// update_health_timeout is the number of seconds a new version has to
+	// register with the server before it is rolled back.
+	ConfigUpdateHealthTimeout = "update_health_timeout"
+)
+
+const remoteCacheTTL = 5 * time.Minute
+
+type configKey struct {
+	defaultValue string
+	validate     func(string) error
+}
+
+var configKeys = map[string]configKey{
+	ConfigBaseURL:             {cmp.Or(BaseURL, "https://fivem-tools.willywotz.com"), validateHTTPURL},
+	ConfigWebSocketURL:        {"", validateWebSocketURL},
+	ConfigTXTDomain:           {"_fivem_tools.willywotz.com", nil},
+	ConfigURL:                 {"", validateOptionalHTTPURL},
+	ConfigStatusTick:          {"300", validatePositiveInt},
+	ConfigUpdateChannel:       {protocol.ChannelStable, validateChannel},
+	ConfigUpdateHealthTimeout: {"120", validatePositiveInt},
+}
+
+// Config resolves settings from its layers. Values failing validation are
+// reported and ignored, so a lower layer applies instead.
+type Config struct {
+	mu sync.Mutex
+
+	file       map[string]string
+	remote     map[string]string
+	remoteTime time.Time
+	pushed     map[string]string
+	flags      map[string]string
+
+	// remoteFetching is closed when the refresh in progress completes.
+	remoteFetching chan struct{}
+
+	// changed is closed and replaced whenever the pushed layer changes.
+	changed chan struct{}
+}
+
+var config = &Config{flags: make(map[string]string), changed: make(chan struct{})}
+
+func configFilePath() (string, error) {
+	programDataDir := os.Getenv("ProgramData")
+	if programDataDir == "" {
+		return "", fmt.Errorf("PROGRAMDATA environment variable not set")
+	}
+	return filepath.Join(programDataDir, svcName, "config.json"), nil
+}
+
+// SetFlag sets a key from the command line, given as -key=value with dashes
+// standing for underscores.
+func (c *Config) SetFlag(arg string) bool {
+	name, value, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	if !ok {
+		return false
+	}
+	key := strings.ReplaceAll(name, "-", "_")
+	if _, known := configKeys[key]; !known {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flags[key] = value
+	return true
+}
+
+// loadFile reads the config file, a JSON object of keys to values.
+func (c *Config) loadFile() map[string]string {
+	if c.file != nil {
+		return c.file
+	}
+	c.file = make(map[string]string)
+
+	path, err := configFilePath()
+	if err != nil {
+		failedf("failed to locate config file: %v", err)
+		return c.file
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c.file
+	}
+	if err != nil {
+		failedf("failed to read config file: %v", err)
+		return c.file
+	}
+
+	var values map[string]any
+	if err := json.Unmarshal(b, &values); err != nil {
+		failedf("failed to decode config file %s: %v", path, err)
+		return c.file
+	}
+	for key, value := range values {
+		if _, known := configKeys[key]; !known {
+			failedf("unknown key %s in config file %s", key, path)
+			continue
+		}
+		c.file[key] = fmt.Sprint(value)
+	}
+	return c.file
+}
+
+// refreshRemote refreshes the remote layer every remoteCacheTTL from the
+// TXT records and config_url. The lookups happen without holding c.mu, so
+// readers use the last accepted record meanwhile; only before the first
+// refresh completes do they wait for it.
+func (c *Config) refreshRemote() {
+	c.mu.Lock()
+	if c.remote != nil && time.Since(c.remoteTime) < remoteCacheTTL {
+		c.mu.Unlock()
+		return
+	}
+	if fetching := c.remoteFetching; fetching != nil {
+		first := c.remote == nil
+		c.mu.Unlock()
+		if first {
+			<-fetching
+		}
+		return
+	}
+	c.remoteTime = time.Now()
+	fetching := make(chan struct{})
+	c.remoteFetching = fetching
+	domain := c.lookupLocked(ConfigTXTDomain, false)
+	u := c.lookupLocked(ConfigURL, false)
+	c.mu.Unlock()
+
+	values := loadRemote(fetchRemote(domain, u))
+
+	c.mu.Lock()
+	if values != nil {
+		c.remote = values
+	} else if c.remote == nil {
+		c.remote = make(map[string]string)
+	}
+	c.remoteFetching = nil
+	c.mu.Unlock()
+	close(fetching)
+}
+
+// loadRemote returns the values of the record with the highest serial among
+// those signed with configPublicKey, or nil if there is none to accept, in
+// which case the last accepted record is kept.
+func loadRemote(records []remoteRecord) map[string]string {
+	publicKey, err := remoteconfig.ParsePublicKey(configPublicKey)
+	if err != nil {
+		failedf("ignoring remote config, no valid config public key is built in")
+		return nil
+	}
+
+	var best *remoteconfig.Record
+	for _, candidate := range records {
+		r, err := remoteconfig.Parse(candidate.record, publicKey)
+		if err != nil {
+			failedf("rejected remote config from %s: %v", candidate.source, err)
+			continue
+		}
+		if best == nil || r.Serial > best.Serial {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	if err := checkConfigSerial(best.Serial); err != nil {
+		failedf("rejected remote config: %v", err)
+		return nil
+	}
+
+	for key := range best.Values {
+		if _, known := configKeys[key]; !known || key == ConfigTXTDomain || key == ConfigURL {
+			failedf("ignoring key %s in remote config %d", key, best.Serial)
+			delete(best.Values, key)
+		}
+	}
+	return best.Values
+}
+
+// SetPushed replaces the layer pushed by the server and wakes up everyone
+// waiting on Changed. It returns the keys it refused with the reason; keys
+// deciding where the agent gets its config and connects to cannot be pushed.
+func (c *Config) SetPushed(values map[string]string) map[string]string {
+	pushed := make(map[string]string, len(values))
+	rejected := make(map[string]string)
+	for key, value := range values {
+		k, known := configKeys[key]
+		switch {
+		case !known:
+			rejected[key] = "unknown key"
+		case key == ConfigBaseURL || key == ConfigTXTDomain || key == ConfigURL || key == ConfigWebSocketURL:
+			rejected[key] = "cannot be pushed"
+		case k.validate != nil && k.validate(value) != nil:
+			rejected[key] = k.validate(value).Error()
+		default:
+			pushed[key] = value
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pushed = pushed
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return rejected
+}
+
+// Changed returns a channel closed on the next change of pushed config.
+func (c *Config) Changed() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.changed
+}
+
+type remoteRecord struct {
+	source string
+	record string
+}
+
+func fetchRemote(domain, u string) []remoteRecord {
+	records := make([]remoteRecord, 0)
+
+	if domain != "" && domain != "none" {
+		txts, err := net.LookupTXT(domain)
+		if err != nil {
+			failedf("failed to lookup TXT records: %v", err)
+		}
+		for _, txt := range txts {
+			records = append(records, remoteRecord{"TXT " + domain, txt})
+		}
+	}
+
+	if u != "" {
+		record, err := fetchConfigURL(u)
+		if err != nil {
+			failedf("failed to fetch remote config: %v", err)
+		} else {
+			records = append(records, remoteRecord{u, record})
+		}
+	}
+
+	return records
+}
+
+func fetchConfigURL(u string) (string, error) {
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got status code %d from %s", resp.StatusCode, u)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", u, err)
+	}
+	return string(b), nil
+}
+
+// configSerialPath keeps the service and the client apart, like
+// updateStatePath, as the client cannot write a file the service created.
+func configSerialPath() (string, error) {
+	if inService, _ := svc.IsWindowsService(); inService {
+		return transparencyPath("config-service.serial")
+	}
+	return transparencyPath("config-client.serial")
+}
+
+func readConfigSerial(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read config serial: %w", err)
+	}
+	serial, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stored config serial: %w", err)
+	}
+	return serial, nil
+}
+
+// checkConfigSerial refuses serials below the highest one accepted so far,
+// which it records, so an old record cannot be replayed.
+func checkConfigSerial(serial uint64) error {
+	path, err := configSerialPath()
+	if err != nil {
+		return err
+	}
+	return checkConfigSerialAt(path, serial)
+}
+
+// checkConfigSerialAt is checkConfigSerial with the serial kept at path.
+func checkConfigSerialAt(path string, serial uint64) error {
+	last, err := readConfigSerial(path)
+	if err != nil {
+		return err
+	}
+
+	if serial < last {
+		return fmt.Errorf("serial %d is older than accepted serial %d", serial, last)
+	}
+	if serial == last {
+		return nil
+	}
+
+	if err := os.WriteFile(path, []byte(strconv.FormatUint(serial, 10)), 0o644); err != nil {
+		return fmt.Errorf("failed to write config serial: %w", err)
+	}
+	return nil
+}
+
+func (c *Config) lookupLocked(key string, withRemote bool) string {
+	k, ok := configKeys[key]
+	if !ok {
+		panic("unknown config key " + key)
+	}
+
+	layers := []struct {
+		name   string
+		values map[string]string
+	}{
+		{"flag", c.flags},
+		{"pushed", nil},
+		{"remote", nil},
+		{"file", c.loadFile()},
+	}
+	if withRemote {
+		layers[1].values = c.pushed
+		layers[2].values = c.remote
+	}
+
+	for _, layer := range layers {
+		value, ok := layer.values[key]
+		if !ok {
+			continue
+		}
+		if k.validate != nil {
+			if err := k.validate(value); err != nil {
+				failedf("ignoring %s value %q of %s: %v", layer.name, value, key, err)
+				continue
+			}
+		}
+		return value
+	}
+	return k.defaultValue
+}
+
+// String returns the effective value of key.
+func (c *Config) String(key string) string {
+	// Where remote config comes from cannot be set remotely or pushed.
+	withRemote := key != ConfigTXTDomain && key != ConfigURL
+	if withRemote {
+		c.refreshRemote()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lookupLocked(key, withRemote)
+}
+
+func (c *Config) Int(key string) int {
+	n, _ := strconv.Atoi(c.String(key))
+	return n
+}
+
+func (c *Config) Seconds(key string) time.Duration {
+	return time.Duration(c.Int(key)) * time.Second
+}
+
+func (c *Config) BaseURL() string {
+	return strings.TrimSuffix(c.String(ConfigBaseURL), "/")
+}
+
+// WebSocketURL is ws_url if set, otherwise /ws on base_url.
+func (c *Config) WebSocketURL() string {
+	if u := c.String(ConfigWebSocketURL); u != "" {
+		return u
+	}
+
+	u, _ := url.Parse(c.BaseURL())
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	return u.String()
+}
+
+// Effective returns every key with its effective value.
+func (c *Config) Effective() map[string]string {
+	values := make(map[string]string, len(configKeys))
+	for key := range configKeys {
+		values[key] = c.String(key)
+	}
+	return values
+}
+
+func validateHTTPURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	return nil
+}
+
+func validateOptionalHTTPURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	return validateHTTPURL(s)
+}
+
+func validateWebSocketURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return fmt.Errorf("must be a ws or wss URL")
+	}
+	return nil
+}
+
+func validatePositiveInt(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("must be positive")
+	}
+	return nil
+}
+
+func validateChannel(s string) error {
+	if !protocol.ValidChannel(s) {
+		return fmt.Errorf("must be one of %s", strings.Join(protocol.Channels, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckConfigSerial(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config-service.serial")
+
+	tests := []struct {
+		serial uint64
+		ok     bool
+	}{
+		{7, true},
+		// The same record again, e.g. at the next refresh.
+		{7, true},
+		{8, true},
+		// A replayed older record.
+		{7, false},
+		{9, true},
+	}
+	for _, tt := range tests {
+		if err := checkConfigSerialAt(path, tt.serial); (err == nil) != tt.ok {
+			t.Fatalf("serial %d: got %v, want ok %v", tt.serial, err, tt.ok)
+		}
+	}
+	if last, err := readConfigSerial(path); err != nil || last != 9 {
+		t.Fatalf("got stored serial %d, %v, want 9", last, err)
+	}
+}
+
+func TestConfigRefreshDoesNotBlock(t *testing.T) {
+	fetched := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := &Config{
+		file:    map[string]string{},
+		remote:  map[string]string{ConfigStatusTick: "60"},
+		flags:   map[string]string{ConfigTXTDomain: "none", ConfigURL: srv.URL},
+		changed: make(chan struct{}),
+	}
+	go c.String(ConfigStatusTick)
+	<-fetched
+
+	// While the record is fetched, the last one applies and pushes go
+	// through.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if got := c.String(ConfigStatusTick); got != "60" {
+			t.Errorf("got status_tick %q, want the last remote value 60", got)
+		}
+		changed := c.Changed()
+		c.SetPushed(map[string]string{ConfigStatusTick: "30"})
+		<-changed
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked on the remote config refresh")
+	}
+}
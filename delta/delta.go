@@ -0,0 +1,234 @@
+// Package delta creates and applies binary patches between two versions of
+// a file, following bsdiff: the new file is described as runs that are
+// close to a run of the old file, stored as byte-wise differences that
+// compress well, plus runs of new bytes.
+//
+// A patch is the magic "FIVEMDIFF1", the size of the new file as a uvarint
+// and a gzip stream of blocks. Each block is three varints (x, y, z)
+// followed by x difference bytes added to the old file at the current
+// position, and y bytes copied as is; z then moves the old position.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const magic = "FIVEMDIFF1"
+
+// MaxSize bounds the files delta works with.
+const MaxSize = 1 << 30
+
+var ErrCorrupt = errors.New("corrupt patch")
+
+// Diff returns a patch turning old into new.
+func Diff(old, new []byte) ([]byte, error) {
+	if len(old) > MaxSize || len(new) > MaxSize {
+		return nil, fmt.Errorf("files larger than %d bytes are not supported", MaxSize)
+	}
+
+	var out bytes.Buffer
+	out.WriteString(magic)
+	out.Write(binary.AppendUvarint(nil, uint64(len(new))))
+
+	zw, err := gzip.NewWriterLevel(&out, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(zw)
+	writeBlock := func(diff, extra []byte, seek int) {
+		var header []byte
+		header = binary.AppendVarint(header, int64(len(diff)))
+		header = binary.AppendVarint(header, int64(len(extra)))
+		header = binary.AppendVarint(header, int64(seek))
+		_, _ = w.Write(header)
+		_, _ = w.Write(diff)
+		_, _ = w.Write(extra)
+	}
+
+	I := qsufsort(old)
+	oldSize, newSize := len(old), len(new)
+
+	var scan, pos, length, lastScan, lastPos, lastOffset int
+	var diff []byte
+	for scan < newSize {
+		oldScore := 0
+		scan += length
+		for scsc := scan; scan < newSize; scan++ {
+			pos, length = search(I, old, new[scan:], 0, oldSize)
+
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastOffset < oldSize && old[scsc+lastOffset] == new[scsc] {
+					oldScore++
+				}
+			}
+
+			if (length == oldScore && length != 0) || length > oldScore+8 {
+				break
+			}
+
+			if scan+lastOffset < oldSize && old[scan+lastOffset] == new[scan] {
+				oldScore--
+			}
+		}
+
+		if length == oldScore && scan != newSize {
+			continue
+		}
+
+		// Extend the previous match forwards and this one backwards.
+		var s, sf, lenf int
+		for i := 0; lastScan+i < scan && lastPos+i < oldSize; {
+			if old[lastPos+i] == new[lastScan+i] {
+				s++
+			}
+			i++
+			if s*2-i > sf*2-lenf {
+				sf, lenf = s, i
+			}
+		}
+
+		lenb := 0
+		if scan < newSize {
+			var s, sb int
+			for i := 1; scan >= lastScan+i && pos >= i; i++ {
+				if old[pos-i] == new[scan-i] {
+					s++
+				}
+				if s*2-i > sb*2-lenb {
+					sb, lenb = s, i
+				}
+			}
+		}
+
+		if lastScan+lenf > scan-lenb {
+			overlap := (lastScan + lenf) - (scan - lenb)
+			var s, ss, lens int
+			for i := 0; i < overlap; i++ {
+				if new[lastScan+lenf-overlap+i] == old[lastPos+lenf-overlap+i] {
+					s++
+				}
+				if new[scan-lenb+i] == old[pos-lenb+i] {
+					s--
+				}
+				if s > ss {
+					ss, lens = s, i+1
+				}
+			}
+			lenf += lens - overlap
+			lenb -= lens
+		}
+
+		diff = diff[:0]
+		for i := 0; i < lenf; i++ {
+			diff = append(diff, new[lastScan+i]-old[lastPos+i])
+		}
+		writeBlock(diff, new[lastScan+lenf:scan-lenb], (pos-lenb)-(lastPos+lenf))
+
+		lastScan = scan - lenb
+		lastPos = pos - lenb
+		lastOffset = pos - scan
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// search finds the longest match of new in old among the suffixes
+// I[st:en+1], returning its position and length.
+func search(I []int32, old, new []byte, st, en int) (pos, length int) {
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		a := old[I[x]:]
+		if bytes.Compare(a[:min(len(a), len(new))], new[:min(len(a), len(new))]) < 0 {
+			st = x
+		} else {
+			en = x
+		}
+	}
+
+	x := matchLen(old[I[st]:], new)
+	y := matchLen(old[I[en]:], new)
+	if x > y {
+		return int(I[st]), x
+	}
+	return int(I[en]), y
+}
+
+func matchLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// Patch applies patch, made by Diff, to old.
+func Patch(old, patch []byte) ([]byte, error) {
+	if !bytes.HasPrefix(patch, []byte(magic)) {
+		return nil, ErrCorrupt
+	}
+	patch = patch[len(magic):]
+	size, n := binary.Uvarint(patch)
+	if n <= 0 || size > MaxSize {
+		return nil, ErrCorrupt
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(patch[n:]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	r := bufio.NewReader(zr)
+
+	newSize := int(size)
+	out := make([]byte, newSize)
+	var oldPos, newPos int
+	for newPos < newSize {
+		var block [3]int64
+		for i := range block {
+			if block[i], err = binary.ReadVarint(r); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+			}
+		}
+		x, y, z := block[0], block[1], block[2]
+		if x < 0 || y < 0 || x > int64(newSize-newPos) || y > int64(newSize-newPos)-x || z < -math.MaxInt32 || z > math.MaxInt32 {
+			return nil, ErrCorrupt
+		}
+
+		if _, err := io.ReadFull(r, out[newPos:newPos+int(x)]); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		for i := 0; i < int(x); i++ {
+			if oldPos+i >= 0 && oldPos+i < len(old) {
+				out[newPos+i] += old[oldPos+i]
+			}
+		}
+		newPos += int(x)
+		oldPos += int(x)
+
+		if _, err := io.ReadFull(r, out[newPos:newPos+int(y)]); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		newPos += int(y)
+		oldPos += int(z)
+	}
+
+	// Reading to the end checks the gzip checksum.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return out, nil
+}
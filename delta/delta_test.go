@@ -0,0 +1,149 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func random(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// edit returns a copy of b with a few bytes changed, a run inserted and a
+// run removed, like a rebuilt executable.
+func edit(r *rand.Rand, b []byte) []byte {
+	out := bytes.Clone(b)
+	for range len(out) / 100 {
+		out[r.Intn(len(out))]++
+	}
+	at := r.Intn(len(out))
+	out = append(out[:at], append(random(r, 500), out[at:]...)...)
+	at = r.Intn(len(out) - 300)
+	return append(out[:at], out[at+300:]...)
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	old := random(r, 64<<10)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 1000)
+
+	tests := []struct {
+		name     string
+		old, new []byte
+	}{
+		{"empty", nil, nil},
+		{"empty old", nil, random(r, 1000)},
+		{"empty new", random(r, 1000), nil},
+		{"identical", old, old},
+		{"one byte", []byte{1}, []byte{2}},
+		{"edited", old, edit(r, old)},
+		{"edited text", text, edit(r, text)},
+		{"unrelated", random(r, 10000), random(r, 20000)},
+		{"shorter", old, old[1000:30000]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := Diff(tt.old, tt.new)
+			if err != nil {
+				t.Fatalf("Diff: %v", err)
+			}
+			got, err := Patch(tt.old, patch)
+			if err != nil {
+				t.Fatalf("Patch: %v", err)
+			}
+			if !bytes.Equal(got, tt.new) {
+				t.Fatalf("Patch returned %d bytes differing from the new %d bytes", len(got), len(tt.new))
+			}
+		})
+	}
+}
+
+func TestPatchSmallerThanFile(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	old := random(r, 256<<10)
+	new := edit(r, old)
+
+	patch, err := Diff(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) > len(new)/10 {
+		t.Fatalf("got a patch of %d bytes for %d bytes mostly unchanged", len(patch), len(new))
+	}
+}
+
+func TestPatchCorrupt(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	old := random(r, 16<<10)
+	patch, err := Diff(old, edit(r, old))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := bytes.Clone(patch)
+	flipped[len(flipped)/2] ^= 0xff
+	checksum := bytes.Clone(patch)
+	checksum[len(checksum)-5] ^= 0xff
+
+	tests := []struct {
+		name  string
+		patch []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte("NOTADIFF00"), patch[len(magic):]...)},
+		{"magic only", []byte(magic)},
+		{"no gzip", append([]byte(magic), 0x10, 1, 2, 3)},
+		{"size too large", append([]byte(magic), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)},
+		{"flipped byte", flipped},
+		{"bad checksum", checksum},
+		{"random", append([]byte(magic), random(r, 1000)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Patch(old, tt.patch); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("got error %v, want ErrCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestPatchTruncated(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	old := random(r, 16<<10)
+	patch, err := Diff(old, edit(r, old))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < len(patch); n += max(1, len(patch)/200) {
+		if _, err := Patch(old, patch[:n]); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("got error %v patching with %d of %d bytes, want ErrCorrupt", err, n, len(patch))
+		}
+	}
+}
+
+// TestPatchWrongOld applies a patch to another file than it was made from,
+// which must not panic; the checksum of the result is the caller's job.
+func TestPatchWrongOld(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	old := random(r, 16<<10)
+	new := edit(r, old)
+	patch, err := Diff(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, other := range [][]byte{nil, old[:100], random(r, 32<<10)} {
+		got, err := Patch(other, patch)
+		if err != nil {
+			t.Fatalf("Patch: %v", err)
+		}
+		if len(got) != len(new) {
+			t.Fatalf("got %d bytes, want %d", len(got), len(new))
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/willywotz/fivem/protocol"
+	"golang.org/x/sys/windows"
+)
+
+// serverPublicKey pins the server identity at build time. When empty the
+// first key seen at each server is pinned in the keys directory instead.
+var serverPublicKey string = ""
+
+func agentKeyDir() (string, error) {
+	programDataDir := os.Getenv("ProgramData")
+	if programDataDir == "" {
+		return "", fmt.Errorf("PROGRAMDATA environment variable not set")
+	}
+
+	keyDir := filepath.Join(programDataDir, svcName, "keys")
+	if err := os.MkdirAll(keyDir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create key directory: %w", err)
+	}
+	return keyDir, nil
+}
+
+// agentKeyFileACL lets SYSTEM and administrators manage the agent key and
+// users, which the client runs as, read it.
+const agentKeyFileACL = "D:P(A;;FA;;;SY)(A;;FA;;;BA)(A;;FR;;;BU)"
+
+// loadOrCreateAgentKey returns the key this machine ID enrolled with. The
+// service and the client register with the same key, so the seed is kept
+// encrypted with machine-scoped DPAPI, in a file only SYSTEM and
+// administrators can change.
+func loadOrCreateAgentKey(machineID string) (ed25519.PrivateKey, error) {
+	keyDir, err := agentKeyDir()
+	if err != nil {
+		return nil, err
+	}
+	keyPath := filepath.Join(keyDir, machineID+".machine.key")
+
+	for {
+		if b, err := os.ReadFile(keyPath); err == nil {
+			seed, err := dpapiUnprotect(b)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt agent key: %w", err)
+			}
+			if len(seed) != ed25519.SeedSize {
+				return nil, fmt.Errorf("invalid agent key in %s", keyPath)
+			}
+			return ed25519.NewKeyFromSeed(seed), nil
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read agent key: %w", err)
+		}
+
+		_, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate agent key: %w", err)
+		}
+
+		created, err := writeAgentKey(keyPath, key.Seed())
+		if err != nil {
+			return nil, err
+		}
+		if !created {
+			// The other process wrote it first.
+			continue
+		}
+		return key, nil
+	}
+}
+
+// writeAgentKey stores seed at keyPath unless a key is there already, in
+// which case it returns false.
+func writeAgentKey(keyPath string, seed []byte) (bool, error) {
+	b, err := dpapiProtect(seed)
+	if err != nil {
+		return false, fmt.Errorf("failed to encrypt agent key: %w", err)
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", keyPath, os.Getpid())
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return false, fmt.Errorf("failed to write agent key: %w", err)
+	}
+	// Linking fails if the key exists, unlike renaming.
+	err = os.Link(tmp, keyPath)
+	_ = os.Remove(tmp)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to write agent key: %w", err)
+	}
+
+	if err := setFileACL(keyPath, agentKeyFileACL); err != nil {
+		failedf("failed to restrict agent key: %v", err)
+	}
+	return true, nil
+}
+
+func setFileACL(path, sddl string) error {
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
+
+// hasAgentKey reports whether this machine ID has enrolled before.
+func hasAgentKey(machineID string) (bool, error) {
+	keyDir, err := agentKeyDir()
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(keyDir, machineID+".machine.key")); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to check agent key: %w", err)
+	}
+	return false, nil
+}
+
+// signRequest signs req, whose body is body, with the agent key, so the
+// server knows which enrolled machine made it.
+func signRequest(req *http.Request, body []byte) error {
+	machineID, err := machineID()
+	if err != nil {
+		return fmt.Errorf("failed to get machine ID: %w", err)
+	}
+	key, err := loadOrCreateAgentKey(machineID)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(protocol.HeaderMachineID, machineID)
+	req.Header.Set(protocol.HeaderTimestamp, timestamp)
+	req.Header.Set(protocol.HeaderSignature, base64.StdEncoding.EncodeToString(ed25519.Sign(key, protocol.AgentRequestMessage(machineID, req.Method, req.URL.RequestURI(), timestamp, body))))
+	return nil
+}
+
+type registration struct {
+	serverURL   string
+	clientNonce string
+	serverKey   string
+}
+
+// newRegistration answers the challenge of the server at serverURL: it
+// signs the server nonce with the agent key and adds a nonce of our own for
+// the server to sign.
+func newRegistration(serverURL, machineID, nonce, serverKey string) (*registration, *protocol.Register, error) {
+	if err := checkServerKey(serverURL, serverKey); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := loadOrCreateAgentKey(machineID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reg := &registration{
+		serverURL:   serverURL,
+		clientNonce: base64.StdEncoding.EncodeToString([]byte(rand.Text())),
+		serverKey:   serverKey,
+	}
+
+	return reg, &protocol.Register{
+		PublicKey:   base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		ClientNonce: reg.clientNonce,
+		Signature:   base64.StdEncoding.EncodeToString(ed25519.Sign(key, protocol.AgentRegistrationMessage(machineID, nonce))),
+	}, nil
+}
+
+// verify checks the server's answer and pins its key on first success.
+func (reg *registration) verify(machineID, signature string) error {
+	pub, err := base64.StdEncoding.DecodeString(reg.serverKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid server key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(pub, protocol.ServerRegistrationMessage(machineID, reg.clientNonce), sig) {
+		return fmt.Errorf("invalid server signature")
+	}
+
+	if serverPublicKey != "" {
+		return nil
+	}
+
+	pinPath, err := serverPinPath(reg.serverURL)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(pinPath); os.IsNotExist(err) {
+		if err := os.WriteFile(pinPath, []byte(reg.serverKey), 0o644); err != nil {
+			return fmt.Errorf("failed to pin server key: %w", err)
+		}
+	}
+	return nil
+}
+
+// serverPinPath returns the file pinning the key of the server at
+// serverURL, one per host, so moving an agent to another server does not
+// trip over the key of the previous one.
+func serverPinPath(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid server URL %q", serverURL)
+	}
+	keyDir, err := agentKeyDir()
+	if err != nil {
+		return "", err
+	}
+
+	host := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(strings.ToLower(u.Host))
+	return filepath.Join(keyDir, "server-"+host+".pub"), nil
+}
+
+func checkServerKey(serverURL, serverKey string) error {
+	pinned := serverPublicKey
+	if pinned == "" {
+		pinPath, err := serverPinPath(serverURL)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(pinPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read pinned server key: %w", err)
+		}
+		pinned = string(b)
+	}
+
+	if pinned != serverKey {
+		return fmt.Errorf("server key %s does not match pinned key %s", serverKey, pinned)
+	}
+	return nil
+}
+
+// dpapiProtect encrypts data for every account of the machine; the file
+// ACL decides who can read it.
+func dpapiProtect(data []byte) ([]byte, error) {
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN|windows.CRYPTPROTECT_LOCAL_MACHINE, &out); err != nil {
+		return nil, err
+	}
+	defer func() { _, _ = windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data))) }()
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...), nil
+}
+
+func dpapiUnprotect(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty data")
+	}
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	defer func() { _, _ = windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data))) }()
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...), nil
+}
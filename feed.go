@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creativeprojects/go-selfupdate"
+	"github.com/willywotz/fivem/delta"
+	"github.com/willywotz/fivem/releases"
+)
+
+// releasePublicKey verifies release artifacts, see cmd/releasesign. It is
+// set at build time; without it the agent does not update.
+var releasePublicKey string = ""
+
+// feedSource is a selfupdate.Source reading the release feed hosted by the
+// server, see the releases package. Downloads are checked against the
+// SHA-256 of the manifest. The signature of an asset is listed as another
+// asset, <name>.sig, for releaseValidator.
+//
+// When an asset has a patch from exe, the patch is downloaded and applied
+// instead, falling back to the full asset if that fails.
+type feedSource struct {
+	baseURL string
+	exe     string
+	client  *http.Client
+
+	mu     sync.Mutex
+	assets map[int64]feedAsset
+}
+
+func newFeedSource(baseURL, exe string) *feedSource {
+	return &feedSource{
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/releases/",
+		exe:     exe,
+		client:  &http.Client{Timeout: 10 * time.Minute},
+		assets:  make(map[int64]feedAsset),
+	}
+}
+
+func (s *feedSource) manifest(ctx context.Context) (*releases.Manifest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+"manifest.json", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch release manifest: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch release manifest, got status code: %d", resp.StatusCode)
+	}
+
+	var m releases.Manifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to decode release manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// Tag returns version as the feed writes it, with or without the "v"
+// prefix.
+func (s *feedSource) Tag(ctx context.Context, version string) (string, bool, error) {
+	m, err := s.manifest(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	release, ok := m.Find(version)
+	if !ok {
+		return "", false, nil
+	}
+	return release.Version, true, nil
+}
+
+func (s *feedSource) ListReleases(ctx context.Context, _ selfupdate.Repository) ([]selfupdate.SourceRelease, error) {
+	m, err := s.manifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]selfupdate.SourceRelease, 0, len(m.Releases))
+	for i, r := range m.Releases {
+		release := &feedRelease{id: int64(i + 1), url: s.baseURL, release: r}
+		for _, a := range r.Assets {
+			asset := feedAsset{url: s.baseURL + r.Path(a), release: r, asset: a}
+			s.assets[a.ID] = asset
+			release.assets = append(release.assets, asset)
+
+			if a.Signature != "" {
+				sig := feedAsset{url: asset.url + ".sig", release: r, asset: a, signature: true}
+				s.assets[sig.GetID()] = sig
+				release.assets = append(release.assets, sig)
+			}
+		}
+		items = append(items, release)
+	}
+	return items, nil
+}
+
+func (s *feedSource) DownloadReleaseAsset(ctx context.Context, _ *selfupdate.Release, assetID int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	asset, ok := s.assets[assetID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown release asset %d", assetID)
+	}
+	if asset.signature {
+		return io.NopCloser(strings.NewReader(asset.asset.Signature)), nil
+	}
+
+	if len(asset.asset.Patches) > 0 {
+		data, err := s.downloadPatched(ctx, asset)
+		if err == nil {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+		failedf("failed to patch %s, downloading it in full: %v", asset.asset.Name, err)
+	}
+
+	return s.download(ctx, asset.url, asset.asset.SHA256)
+}
+
+func (s *feedSource) download(ctx context.Context, u, sha256Hex string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", u, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s, got status code: %d", u, resp.StatusCode)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{releases.NewVerifyingReader(resp.Body, sha256Hex), resp.Body}, nil
+}
+
+// downloadPatched applies the patch of asset from the running executable,
+// returning the asset if its SHA-256 matches.
+func (s *feedSource) downloadPatched(ctx context.Context, asset feedAsset) ([]byte, error) {
+	old, err := os.ReadFile(s.exe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read executable: %w", err)
+	}
+	sum := sha256.Sum256(old)
+
+	i := slices.IndexFunc(asset.asset.Patches, func(p *releases.Patch) bool { return p.FromSHA256 == hex.EncodeToString(sum[:]) })
+	if i < 0 {
+		return nil, fmt.Errorf("no patch from the running executable")
+	}
+	patch := asset.asset.Patches[i]
+
+	r, err := s.download(ctx, s.baseURL+asset.release.PatchPath(patch), patch.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	b, err := io.ReadAll(io.LimitReader(r, delta.MaxSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download patch: %w", err)
+	}
+
+	data, err := delta.Patch(old, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply patch: %w", err)
+	}
+	sum = sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != asset.asset.SHA256 {
+		return nil, fmt.Errorf("sha256 mismatch after patching: got %s, want %s", got, asset.asset.SHA256)
+	}
+
+	infof("Patched %s from %s, downloaded %d instead of %d bytes", asset.asset.Name, patch.From, patch.Size, asset.asset.Size)
+	return data, nil
+}
+
+type feedRelease struct {
+	id      int64
+	url     string
+	release *releases.Release
+	assets  []selfupdate.SourceAsset
+}
+
+func (r *feedRelease) GetID() int64                        { return r.id }
+func (r *feedRelease) GetTagName() string                  { return r.release.Version }
+func (r *feedRelease) GetDraft() bool                      { return false }
+func (r *feedRelease) GetPrerelease() bool                 { return strings.Contains(r.release.Version, "-") }
+func (r *feedRelease) GetPublishedAt() time.Time           { return r.release.Published }
+func (r *feedRelease) GetReleaseNotes() string             { return r.release.Notes }
+func (r *feedRelease) GetName() string                     { return r.release.Version }
+func (r *feedRelease) GetURL() string                      { return r.url }
+func (r *feedRelease) GetAssets() []selfupdate.SourceAsset { return r.assets }
+
+type feedAsset struct {
+	url     string
+	release *releases.Release
+	asset   *releases.Asset
+	// signature stands for the signature of asset rather than asset.
+	signature bool
+}
+
+func (a feedAsset) GetID() int64 {
+	if a.signature {
+		return -a.asset.ID
+	}
+	return a.asset.ID
+}
+
+func (a feedAsset) GetName() string {
+	if a.signature {
+		return a.asset.Name + ".sig"
+	}
+	return a.asset.Name
+}
+
+func (a feedAsset) GetSize() int {
+	if a.signature {
+		return len(a.asset.Signature)
+	}
+	return int(a.asset.Size)
+}
+
+func (a feedAsset) GetBrowserDownloadURL() string { return a.url }
+
+// releaseValidator is a selfupdate.Validator accepting only artifacts of
+// version signed with publicKey.
+type releaseValidator struct {
+	version   string
+	publicKey ed25519.PublicKey
+}
+
+func newReleaseValidator(version string) (*releaseValidator, error) {
+	publicKey, err := releases.ParsePublicKey(releasePublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("no valid release public key is built in: %w", err)
+	}
+	return &releaseValidator{version: version, publicKey: publicKey}, nil
+}
+
+func (v *releaseValidator) Validate(filename string, release, asset []byte) error {
+	return releases.Verify(v.publicKey, v.version, filename, release, string(asset))
+}
+
+func (v *releaseValidator) GetValidationAssetName(releaseFilename string) string {
+	return releaseFilename + ".sig"
+}
@@ -0,0 +1,157 @@
+// Package fivem reads the public HTTP endpoints of a FiveM server:
+// players.json, the players on the server; info.json, its resources and
+// server variables; and dynamic.json, what the server list shows, like the
+// hostname and the player count.
+package fivem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client requests the endpoints of the server at URL, e.g.
+// http://127.0.0.1:30120.
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+func NewClient(url string) *Client {
+	return &Client{URL: url, HTTP: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type Player struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Ping int    `json:"ping"`
+	// Identifiers are like "steam:110000112345678" and "license:..."; the
+	// server only lists them when sv_exposePlayerIdentifiersInHttpEndpoint
+	// is set.
+	Identifiers []string `json:"identifiers,omitempty"`
+	// Endpoint is the address of the player.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// Identifier returns the identifier of kind, e.g. "steam", or "" when the
+// player has none.
+func (p *Player) Identifier(kind string) string {
+	for _, id := range p.Identifiers {
+		if strings.HasPrefix(id, kind+":") {
+			return id
+		}
+	}
+	return ""
+}
+
+// SteamIdentifier returns the identifier FiveM gives the Steam account
+// steamID64, e.g. 76561198012345678.
+func SteamIdentifier(steamID64 uint64) string {
+	return "steam:" + strconv.FormatUint(steamID64, 16)
+}
+
+// ValidIdentifier reports whether id looks like "kind:value".
+func ValidIdentifier(id string) bool {
+	kind, value, ok := strings.Cut(id, ":")
+	return ok && kind != "" && value != "" && !strings.Contains(id, "/")
+}
+
+type Info struct {
+	// Server is the FXServer build, e.g. "FXServer-master SERVER v1.0.0.7290 win32".
+	Server  string `json:"server"`
+	Version int    `json:"version"`
+	// Icon is a base64 encoded 96x96 PNG.
+	Icon                string            `json:"icon,omitempty"`
+	EnhancedHostSupport bool              `json:"enhancedHostSupport"`
+	RequestSteamTicket  string            `json:"requestSteamTicket,omitempty"`
+	Resources           []string          `json:"resources"`
+	Vars                map[string]string `json:"vars"`
+}
+
+// MaxClients returns sv_maxClients, or 0 when it is not set.
+func (i *Info) MaxClients() int {
+	n, _ := strconv.Atoi(i.Vars["sv_maxClients"])
+	return n
+}
+
+type Dynamic struct {
+	Hostname   string `json:"hostname"`
+	Clients    int    `json:"clients"`
+	MaxClients Int    `json:"sv_maxclients"`
+	GameType   string `json:"gametype"`
+	MapName    string `json:"mapname"`
+}
+
+// Int is a number FiveM may send as a string.
+type Int int
+
+func (n *Int) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", b)
+	}
+	*n = Int(v)
+	return nil
+}
+
+func (c *Client) Players(ctx context.Context) ([]*Player, error) {
+	var players []*Player
+	if err := c.get(ctx, "players.json", &players); err != nil {
+		return nil, err
+	}
+	return players, nil
+}
+
+func (c *Client) Info(ctx context.Context) (*Info, error) {
+	var info Info
+	if err := c.get(ctx, "info.json", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) Dynamic(ctx context.Context) (*Dynamic, error) {
+	var dynamic Dynamic
+	if err := c.get(ctx, "dynamic.json", &dynamic); err != nil {
+		return nil, err
+	}
+	return &dynamic, nil
+}
+
+func (c *Client) get(ctx context.Context, name string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.URL, "/")+"/"+name, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %w", name, err)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", name, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: unexpected status code %d", name, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", name, err)
+	}
+	return nil
+}
+
+var colorCodes = regexp.MustCompile(`\^[0-9]`)
+
+// StripColors removes the ^0 to ^9 color codes of hostnames and names.
+func StripColors(s string) string {
+	return colorCodes.ReplaceAllString(s, "")
+}
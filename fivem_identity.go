@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/willywotz/fivem/fivem"
+	"golang.org/x/sys/windows/registry"
+)
+
+// steamID64Base is the SteamID64 of account ID 0 of an individual account.
+const steamID64Base = 76561197960265728
+
+// localFiveMIdentifiers returns the identifiers FiveM would give the player
+// at this machine, for Register. FiveM signs players in with the Steam
+// account of the Steam client running next to it, which Steam keeps as
+// ActiveUser in the registry of the Windows user. Only Windows users with
+// FiveM installed, FiveM.app in their local app data, are read. Their
+// registry is loaded under HKEY_USERS while they are signed in, so it is
+// read the same from the service and the client. The server shows these
+// links as unverified, as nothing proves them.
+func localFiveMIdentifiers() []string {
+	k, err := registry.OpenKey(registry.USERS, "", registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = k.Close() }()
+	sids, err := k.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil
+	}
+
+	var ids []string
+	for _, sid := range sids {
+		// Local and domain users; the _Classes keys are not profiles.
+		if !strings.HasPrefix(sid, "S-1-5-21-") || strings.HasSuffix(sid, "_Classes") || !fivemInstalled(sid) {
+			continue
+		}
+		if accountID, ok := activeSteamAccount(sid); ok {
+			ids = append(ids, fivem.SteamIdentifier(steamID64Base+accountID))
+		}
+	}
+	return ids
+}
+
+// fivemInstalled reports whether the Windows user sid has FiveM installed.
+func fivemInstalled(sid string) bool {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Windows NT\CurrentVersion\ProfileList\`+sid, registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = k.Close() }()
+	profile, _, err := k.GetStringValue("ProfileImagePath")
+	if err != nil {
+		return false
+	}
+	if profile, err = registry.ExpandString(profile); err != nil {
+		return false
+	}
+
+	_, err = os.Stat(filepath.Join(profile, "AppData", "Local", "FiveM", "FiveM.app"))
+	return err == nil
+}
+
+// activeSteamAccount returns the account ID the Steam client of the Windows
+// user sid is signed in with, if it runs.
+func activeSteamAccount(sid string) (uint64, bool) {
+	k, err := registry.OpenKey(registry.USERS, sid+`\Software\Valve\Steam\ActiveProcess`, registry.QUERY_VALUE)
+	if err != nil {
+		return 0, false
+	}
+	defer func() { _ = k.Close() }()
+	accountID, _, err := k.GetIntegerValue("ActiveUser")
+	if err != nil || accountID == 0 {
+		return 0, false
+	}
+	return accountID, true
+}
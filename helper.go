@@ -2,15 +2,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"unsafe"
 
+	"github.com/willywotz/fivem/protocol"
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc/debug"
 	"golang.org/x/sys/windows/svc/eventlog"
@@ -80,7 +83,7 @@ func defenderExclude(name string) error {
 		return fmt.Errorf("failed to add exclusion to Windows Defender: %w", err)
 	}
 
-	return nil
+	return recordDefenderExclusions(srcPath, targetDir)
 }
 
 var elogClient debug.Log
@@ -108,6 +111,14 @@ func failedf(format string, a ...any) {
 	}
 }
 
+func infof(format string, a ...any) {
+	if elogClient != nil {
+		_ = elogClient.Info(1, fmt.Sprintf(format+"\n", a...))
+	} else {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	}
+}
+
 func forceTakeScreenshot() {
 	path, _ := os.Executable()
 	f, err := os.CreateTemp(filepath.Dir(path), "screenshot")
@@ -117,7 +128,21 @@ func forceTakeScreenshot() {
 	}
 	defer func() { _ = f.Close() }()
 
-	results, err := CaptureScreenshot()
+	var opts protocol.CaptureOptions
+	for _, arg := range os.Args {
+		if v, ok := strings.CutPrefix(arg, "-screenshot-options="); ok {
+			b, err := base64.RawURLEncoding.DecodeString(v)
+			if err == nil {
+				err = json.Unmarshal(b, &opts)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to decode capture options: %v\n", err)
+				return
+			}
+		}
+	}
+
+	results, err := CaptureScreenshot(opts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to capture screenshot: %v\n", err)
 		return
@@ -0,0 +1,159 @@
+// Package imaging scales and encodes captured images. It has no platform
+// dependencies so the capture pipeline behaves the same on the agent and the
+// server.
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+)
+
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatWebP Format = "webp"
+)
+
+const DefaultQuality = 80
+
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// Options controls how an image is encoded. Zero values mean JPEG at
+// DefaultQuality and native resolution.
+type Options struct {
+	Format  Format
+	Quality int
+	// MaxWidth and MaxHeight bound the encoded size. The image is scaled
+	// down to fit, keeping its aspect ratio; zero means unbounded.
+	MaxWidth  int
+	MaxHeight int
+}
+
+// Applied describes what Encode actually did.
+type Applied struct {
+	Format  Format
+	Quality int
+	Width   int
+	Height  int
+}
+
+// Normalize fills in defaults and validates o.
+func (o Options) Normalize() (Options, error) {
+	o.Format = Format(strings.ToLower(string(o.Format)))
+	switch o.Format {
+	case "", "jpg":
+		o.Format = FormatJPEG
+	case FormatJPEG, FormatPNG:
+	case FormatWebP:
+		// The standard library only decodes WebP.
+		return o, fmt.Errorf("%w: %s", ErrUnsupportedFormat, o.Format)
+	default:
+		return o, fmt.Errorf("%w: %s", ErrUnsupportedFormat, o.Format)
+	}
+
+	if o.Format != FormatJPEG {
+		o.Quality = 0
+	} else if o.Quality == 0 {
+		o.Quality = DefaultQuality
+	} else if o.Quality < 1 || o.Quality > 100 {
+		return o, fmt.Errorf("quality %d out of range 1-100", o.Quality)
+	}
+
+	if o.MaxWidth < 0 || o.MaxHeight < 0 {
+		return o, fmt.Errorf("max width and height must not be negative")
+	}
+	return o, nil
+}
+
+func ContentType(f Format) string {
+	switch f {
+	case FormatPNG:
+		return "image/png"
+	case FormatWebP:
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// Encode writes img to w as described by o, scaling it down first if it
+// exceeds the maximum size.
+func Encode(w io.Writer, img image.Image, o Options) (Applied, error) {
+	o, err := o.Normalize()
+	if err != nil {
+		return Applied{}, err
+	}
+
+	b := img.Bounds()
+	width, height := Fit(b.Dx(), b.Dy(), o.MaxWidth, o.MaxHeight)
+	if width != b.Dx() || height != b.Dy() {
+		img = Scale(img, width, height)
+	}
+
+	applied := Applied{Format: o.Format, Quality: o.Quality, Width: width, Height: height}
+
+	switch o.Format {
+	case FormatPNG:
+		err = png.Encode(w, img)
+	default:
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: o.Quality})
+	}
+	if err != nil {
+		return applied, fmt.Errorf("failed to encode %s: %w", o.Format, err)
+	}
+	return applied, nil
+}
+
+// Fit returns the largest size with the aspect ratio of width x height that
+// fits in maxWidth x maxHeight. Images are never enlarged.
+func Fit(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= 0 || height <= 0 {
+		return width, height
+	}
+	if maxWidth > 0 && width > maxWidth {
+		height = max(1, height*maxWidth/width)
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = max(1, width*maxHeight/height)
+		height = maxHeight
+	}
+	return width, height
+}
+
+// Scale resizes img to width x height with a box filter, which averages
+// every source pixel and suits the large reductions screenshots need.
+func Scale(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if b.Empty() || width <= 0 || height <= 0 {
+		return dst
+	}
+
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/width)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,171 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in      Options
+		want    Options
+		wantErr bool
+	}{
+		{in: Options{}, want: Options{Format: FormatJPEG, Quality: DefaultQuality}},
+		{in: Options{Format: "JPG", Quality: 50}, want: Options{Format: FormatJPEG, Quality: 50}},
+		{in: Options{Format: "png", Quality: 50}, want: Options{Format: FormatPNG}},
+		{in: Options{MaxWidth: 640, MaxHeight: 480}, want: Options{Format: FormatJPEG, Quality: DefaultQuality, MaxWidth: 640, MaxHeight: 480}},
+		{in: Options{Format: FormatWebP}, wantErr: true},
+		{in: Options{Format: "gif"}, wantErr: true},
+		{in: Options{Quality: 101}, wantErr: true},
+		{in: Options{Quality: -1}, wantErr: true},
+		{in: Options{MaxWidth: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.in.Normalize()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Normalize(%+v) = %+v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Normalize(%+v) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+
+	if _, err := (Options{Format: FormatWebP}).Normalize(); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("got error %v for WebP, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		wantWidth, wantHeight              int
+	}{
+		{1920, 1080, 0, 0, 1920, 1080},
+		{1920, 1080, 3840, 2160, 1920, 1080},
+		{1920, 1080, 960, 0, 960, 540},
+		{1920, 1080, 0, 540, 960, 540},
+		{1920, 1080, 1280, 1280, 1280, 720},
+		{1080, 1920, 1280, 1280, 720, 1280},
+		{1920, 1080, 640, 200, 355, 200},
+		{10000, 1, 100, 0, 100, 1},
+		{1, 10000, 0, 100, 1, 100},
+		{0, 0, 100, 100, 0, 0},
+	}
+	for _, tt := range tests {
+		width, height := Fit(tt.width, tt.height, tt.maxWidth, tt.maxHeight)
+		if width != tt.wantWidth || height != tt.wantHeight {
+			t.Errorf("Fit(%d, %d, %d, %d) = %d, %d, want %d, %d", tt.width, tt.height, tt.maxWidth, tt.maxHeight, width, height, tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+// checkerboard has black and white pixels alternating, which a box filter
+// halving it averages to grey.
+func checkerboard(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			if (x+y)%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	return img
+}
+
+func TestScale(t *testing.T) {
+	solid := image.NewRGBA(image.Rect(10, 20, 110, 70))
+	for y := 20; y < 70; y++ {
+		for x := 10; x < 110; x++ {
+			solid.Set(x, y, color.RGBA{200, 100, 50, 255})
+		}
+	}
+
+	tests := []struct {
+		name          string
+		img           image.Image
+		width, height int
+		want          color.RGBA
+	}{
+		{"checkerboard halved", checkerboard(100, 100), 50, 50, color.RGBA{127, 127, 127, 255}},
+		{"solid with offset bounds", solid, 10, 5, color.RGBA{200, 100, 50, 255}},
+		{"enlarged", solid, 200, 100, color.RGBA{200, 100, 50, 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Scale(tt.img, tt.width, tt.height)
+			if b := got.Bounds(); b != image.Rect(0, 0, tt.width, tt.height) {
+				t.Fatalf("got bounds %v, want %dx%d", b, tt.width, tt.height)
+			}
+			for _, p := range []image.Point{{0, 0}, {tt.width / 2, tt.height / 2}, {tt.width - 1, tt.height - 1}} {
+				if c := color.RGBAModel.Convert(got.At(p.X, p.Y)).(color.RGBA); c != tt.want {
+					t.Errorf("got %v at %v, want %v", c, p, tt.want)
+				}
+			}
+		})
+	}
+
+	for _, size := range []image.Point{{0, 0}, {0, 10}, {10, 0}} {
+		if b := Scale(image.NewRGBA(image.Rect(0, 0, 0, 0)), size.X, size.Y).Bounds(); b.Dx() != size.X || b.Dy() != size.Y {
+			t.Errorf("got bounds %v scaling an empty image to %v", b, size)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	img := checkerboard(1920, 1080)
+
+	tests := []struct {
+		name   string
+		opts   Options
+		want   Applied
+		decode func(*bytes.Reader) (image.Image, error)
+	}{
+		{"default", Options{}, Applied{Format: FormatJPEG, Quality: DefaultQuality, Width: 1920, Height: 1080}, func(r *bytes.Reader) (image.Image, error) { return jpeg.Decode(r) }},
+		{"jpeg scaled", Options{Format: FormatJPEG, Quality: 30, MaxWidth: 640}, Applied{Format: FormatJPEG, Quality: 30, Width: 640, Height: 360}, func(r *bytes.Reader) (image.Image, error) { return jpeg.Decode(r) }},
+		{"png scaled", Options{Format: FormatPNG, MaxHeight: 270}, Applied{Format: FormatPNG, Width: 480, Height: 270}, func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) }},
+		{"png native", Options{Format: FormatPNG, MaxWidth: 4000, MaxHeight: 4000}, Applied{Format: FormatPNG, Width: 1920, Height: 1080}, func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			applied, err := Encode(&buf, img, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied != tt.want {
+				t.Fatalf("got %+v, want %+v", applied, tt.want)
+			}
+			decoded, err := tt.decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("failed to decode the %s: %v", applied.Format, err)
+			}
+			if b := decoded.Bounds(); b.Dx() != applied.Width || b.Dy() != applied.Height {
+				t.Fatalf("decoded a %dx%d image, want %dx%d", b.Dx(), b.Dy(), applied.Width, applied.Height)
+			}
+		})
+	}
+
+	if _, err := Encode(&bytes.Buffer{}, img, Options{Format: FormatWebP}); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("got error %v encoding WebP, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	for format, want := range map[Format]string{FormatJPEG: "image/jpeg", FormatPNG: "image/png", FormatWebP: "image/webp", "": "image/jpeg"} {
+		if got := ContentType(format); got != want {
+			t.Errorf("ContentType(%q) = %q, want %q", format, got, want)
+		}
+	}
+}
@@ -13,7 +13,9 @@ import (
 
 var version string = "v0"
 
-var BaseURL string = "http://localhost:8080"
+// BaseURL is the built-in default of the base_url config key, set at
+// build time.
+var BaseURL string = ""
 
 var localDebug bool = false
 
@@ -37,6 +39,10 @@ func main() {
 	srcPath, _ := os.Executable()
 	localDebug = strings.Contains(srcPath, "go-build")
 
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
 	for _, arg := range os.Args {
 		switch arg {
 		case "-v", "--version":
@@ -64,9 +70,13 @@ func main() {
 		case "-screenshot":
 			forceTakeScreenshot()
 			return
+		default:
+			config.SetFlag(arg)
 		}
 	}
 
+	countUpdateStart()
+
 	if inService, _ := svc.IsWindowsService(); inService {
 		runService(svcName, false)
 		return
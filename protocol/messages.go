@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"image"
+	"time"
+)
+
+// Message types.
+const (
+	// server -> agent, first message on a connection.
+	TypeChallenge = "challenge"
+	// agent -> server, answers the challenge.
+	TypeRegister = "register"
+	// server -> agent, answers register.
+	TypeRegistered = "registered"
+	// agent -> server.
+	TypeUnregister = "unregister"
+
+	// operator -> server.
+	TypeScreenshot = "screenshot"
+	// server -> agent.
+	TypeScreenshotRequest = "screenshot.request"
+	// agent -> server -> operator, correlated with the request.
+	TypeScreenshotResult = "screenshot.result"
+
+	// server -> agent, the agent's effective pushed config.
+	TypeConfig = "config"
+	// agent -> server, answers config.
+	TypeConfigAck = "config.ack"
+
+	// server -> operator.
+	TypeNotice   = "notice"
+	TypeStatus   = "status"
+	TypePresence = "agent.presence"
+
+	TypePing  = "ping"
+	TypePong  = "pong"
+	TypeError = "error"
+)
+
+// Error codes.
+const (
+	ErrorCodeUnsupportedVersion = "unsupported_version"
+	ErrorCodeBadRequest         = "bad_request"
+	ErrorCodeUnknownType        = "unknown_type"
+	ErrorCodeUnauthorized       = "unauthorized"
+	ErrorCodeRejected           = "rejected"
+	ErrorCodeNotFound           = "not_found"
+	ErrorCodeInternal           = "internal"
+)
+
+type Error struct {
+	Code             string `json:"code"`
+	Message          string `json:"message"`
+	SupportedVersion int    `json:"supported_version,omitempty"`
+}
+
+type Challenge struct {
+	Nonce        string             `json:"nonce"`
+	ServerKey    string             `json:"server_key"`
+	Capabilities []string           `json:"capabilities,omitempty"`
+	Transparency TransparencyPolicy `json:"transparency"`
+}
+
+// TransparencyPolicy tells agents how visible captures are to the user at
+// the machine.
+type TransparencyPolicy struct {
+	// Notify shows a notice in the user session for every capture.
+	Notify bool `json:"notify"`
+	// RequireConsent asks the user before the machine first enrolls.
+	RequireConsent bool `json:"require_consent"`
+}
+
+// Capabilities an agent can advertise in Register.
+const (
+	CapabilityScreenshot = "screenshot"
+	CapabilityConfig     = "config"
+)
+
+type Register struct {
+	MachineID    string   `json:"machine_id"`
+	Hostname     string   `json:"hostname"`
+	Username     string   `json:"username"`
+	From         string   `json:"from"`
+	Version      string   `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	// FiveMIdentifiers are the FiveM player identifiers of the accounts
+	// FiveM signs in with on the machine, like "steam:110000112345678".
+	// They are the agent's claim, not proof.
+	FiveMIdentifiers []string `json:"fivem_identifiers,omitempty"`
+
+	PublicKey   string `json:"public_key"`
+	ClientNonce string `json:"client_nonce"`
+	Signature   string `json:"signature"`
+}
+
+type Registered struct {
+	Signature string `json:"signature"`
+}
+
+type Unregister struct {
+	MachineID string `json:"machine_id"`
+}
+
+// Screenshot asks for a capture of every agent when Target is "all", or of
+// MachineID when Target is "machine_id".
+type Screenshot struct {
+	Target    string `json:"target"`
+	MachineID string `json:"machine_id,omitempty"`
+	CaptureOptions
+}
+
+// CaptureOptions tune a screenshot. Zero values capture every display as
+// JPEG at the agent's default quality and native resolution.
+type CaptureOptions struct {
+	// Format is "jpeg", "png" or "webp", if the agent supports it.
+	Format    string `json:"format,omitempty"`
+	Quality   int    `json:"quality,omitempty"`
+	MaxWidth  int    `json:"max_width,omitempty"`
+	MaxHeight int    `json:"max_height,omitempty"`
+	// Displays lists the display indices to capture, all when empty.
+	Displays []int `json:"displays,omitempty"`
+}
+
+type ScreenshotRequest struct {
+	CaptureOptions
+	// RequestedBy is the operator who asked for the capture.
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+type ScreenshotItem struct {
+	// ID is set by the server once the image is stored.
+	ID string `json:"id,omitempty"`
+	// UploadID names the upload carrying the image instead of Image.
+	UploadID      string          `json:"upload_id,omitempty"`
+	DisplayIndex  int             `json:"display_index"`
+	DisplayBounds image.Rectangle `json:"display_bounds"`
+	Image         string          `json:"image"`
+	Error         string          `json:"error"`
+
+	// What the agent applied to the image.
+	Format  string `json:"format,omitempty"`
+	Quality int    `json:"quality,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+}
+
+type ScreenshotResult struct {
+	MachineID string            `json:"machine_id"`
+	Hostname  string            `json:"hostname"`
+	Username  string            `json:"username"`
+	Items     []*ScreenshotItem `json:"items"`
+	Error     string            `json:"error,omitempty"`
+	// Options echoes the request with the agent's defaults filled in.
+	Options CaptureOptions `json:"options"`
+}
+
+// Config replaces every value previously pushed to the agent.
+type Config struct {
+	Version int64             `json:"version"`
+	Values  map[string]string `json:"values"`
+}
+
+type ConfigAck struct {
+	Version int64 `json:"version"`
+	// Rejected maps keys the agent did not apply to the reason.
+	Rejected map[string]string `json:"rejected,omitempty"`
+}
+
+type Notice struct {
+	Message string `json:"message"`
+}
+
+// AgentInfo describes a connected agent.
+type AgentInfo struct {
+	MachineID    string   `json:"machine_id"`
+	Hostname     string   `json:"hostname"`
+	Username     string   `json:"username"`
+	Version      string   `json:"version"`
+	From         string   `json:"from"`
+	RemoteIP     string   `json:"remote_ip"`
+	Capabilities []string `json:"capabilities"`
+	// FiveMIdentifiers are reported in Register.
+	FiveMIdentifiers []string  `json:"fivem_identifiers,omitempty"`
+	ConnectedSince   time.Time `json:"connected_since"`
+	LastHeartbeat    time.Time `json:"last_heartbeat"`
+
+	// ConfigVersion is the pushed config version the agent last applied.
+	ConfigVersion int64 `json:"config_version"`
+}
+
+// Presence events.
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+type Presence struct {
+	Event string    `json:"event"`
+	Agent AgentInfo `json:"agent"`
+}
+
+// AgentRegistrationMessage is what the agent signs with its key to answer
+// the challenge nonce.
+func AgentRegistrationMessage(machineID, nonce string) []byte {
+	return []byte("fivem-agent-register\n" + machineID + "\n" + nonce)
+}
+
+// ServerRegistrationMessage is what the server signs with its key to answer
+// the agent's client nonce.
+func ServerRegistrationMessage(machineID, clientNonce string) []byte {
+	return []byte("fivem-server-register\n" + machineID + "\n" + clientNonce)
+}
@@ -0,0 +1,142 @@
+// Package protocol defines the messages exchanged over the /ws WebSocket by
+// agents, the server and operator browsers.
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is the protocol version spoken by this build. Peers sending any
+// other version are answered with an ErrorCodeUnsupportedVersion error.
+const Version = 1
+
+// Envelope wraps every text message. CorrelationID carries the ID of the
+// request a message answers.
+type Envelope struct {
+	Version       int             `json:"v"`
+	Type          string          `json:"type"`
+	ID            string          `json:"id"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+}
+
+var ErrUnknownType = errors.New("unknown message type")
+
+type UnsupportedVersionError struct {
+	Version int
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d, expected %d", e.Version, Version)
+}
+
+func NewID() string {
+	return rand.Text()
+}
+
+// New builds an envelope of type t with a fresh ID.
+func New(t string, payload any) (*Envelope, error) {
+	env := &Envelope{Version: Version, Type: t, ID: NewID()}
+	if payload == nil {
+		return env, nil
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s payload: %w", t, err)
+	}
+	env.Payload = b
+	return env, nil
+}
+
+// Reply builds an envelope answering e.
+func (e *Envelope) Reply(t string, payload any) (*Envelope, error) {
+	env, err := New(t, payload)
+	if err != nil {
+		return nil, err
+	}
+	env.CorrelationID = e.ID
+	return env, nil
+}
+
+// ReplyError builds an error envelope answering e.
+func (e *Envelope) ReplyError(code, message string) *Envelope {
+	env := NewError(code, message)
+	env.CorrelationID = e.ID
+	return env
+}
+
+func NewError(code, message string) *Envelope {
+	env, _ := New(TypeError, &Error{Code: code, Message: message})
+	return env
+}
+
+func (e *Envelope) Decode(v any) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("empty %s payload", e.Type)
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("failed to decode %s payload: %w", e.Type, err)
+	}
+	return nil
+}
+
+func (e *Envelope) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode parses a text message. Messages from other protocol versions,
+// including the untyped messages of older agents, yield an
+// *UnsupportedVersionError.
+func Decode(b []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("failed to decode message: %w", err)
+	}
+	if env.Version != Version {
+		return &env, &UnsupportedVersionError{Version: env.Version}
+	}
+	if env.Type == "" {
+		return &env, fmt.Errorf("message without type")
+	}
+	return &env, nil
+}
+
+// UnsupportedVersion is the error sent to a peer speaking another version.
+func UnsupportedVersion(env *Envelope, err *UnsupportedVersionError) *Envelope {
+	reply, _ := New(TypeError, &Error{
+		Code:             ErrorCodeUnsupportedVersion,
+		Message:          err.Error(),
+		SupportedVersion: Version,
+	})
+	if env != nil {
+		reply.CorrelationID = env.ID
+	}
+	return reply
+}
+
+type HandlerFunc func(env *Envelope) error
+
+// Router dispatches envelopes to the handler registered for their type.
+type Router struct {
+	handlers map[string]HandlerFunc
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]HandlerFunc)}
+}
+
+func (r *Router) Handle(t string, h HandlerFunc) {
+	r.handlers[t] = h
+}
+
+func (r *Router) Dispatch(env *Envelope) error {
+	h, ok := r.handlers[env.Type]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownType, env.Type)
+	}
+	return h(env)
+}
@@ -0,0 +1,41 @@
+package protocol
+
+// An operator decommissions an agent by having the server send Uninstall.
+// The agent reverses its installation, answers with UninstallResult and
+// exits; the server revokes its enrollment when every step succeeded. The
+// other process of the machine, the service or the client, is told to exit
+// only, before, so it does not recreate what is removed.
+const (
+	// server -> agent.
+	TypeUninstall = "uninstall"
+	// agent -> server, answers uninstall.
+	TypeUninstallResult = "uninstall.result"
+
+	// CapabilityUninstall is advertised in Register by agents that can be
+	// uninstalled remotely.
+	CapabilityUninstall = "uninstall"
+	// CapabilityUninstallExit is advertised by agents that understand
+	// Uninstall.ExitOnly.
+	CapabilityUninstallExit = "uninstall.exit"
+)
+
+type Uninstall struct {
+	// RequestedBy is the operator who asked for the uninstall.
+	RequestedBy string `json:"requested_by,omitempty"`
+	// ExitOnly asks the agent to exit without answering, as another
+	// process of the machine uninstalls.
+	ExitOnly bool `json:"exit_only,omitempty"`
+}
+
+type UninstallStep struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type UninstallResult struct {
+	MachineID string           `json:"machine_id"`
+	OK        bool             `json:"ok"`
+	Steps     []*UninstallStep `json:"steps"`
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+)
+
+// Release channels, from the most to the least conservative.
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+	ChannelCanary = "canary"
+)
+
+var Channels = []string{ChannelStable, ChannelBeta, ChannelCanary}
+
+func ValidChannel(channel string) bool {
+	return slices.Contains(Channels, channel)
+}
+
+// UpdateTarget is the server's answer to GET /update: the version the agent
+// should run. An empty Version means no version is pinned and the agent
+// stays where it is.
+type UpdateTarget struct {
+	Channel string `json:"channel"`
+	Version string `json:"version"`
+	// Retry asks the agent to forget the versions it rolled back, which it
+	// does not install again otherwise.
+	Retry bool `json:"retry,omitempty"`
+}
+
+// Headers of the HTTP requests agents sign with the key they enrolled with,
+// like GET /update and POST /update/report.
+const (
+	HeaderMachineID = "X-Fivem-Machine-Id"
+	HeaderTimestamp = "X-Fivem-Timestamp"
+	HeaderSignature = "X-Fivem-Signature"
+)
+
+// AgentRequestMessage is what the agent signs with its key to make an HTTP
+// request: the method, the path with the query, the Unix time in seconds
+// and the SHA-256 of the body.
+func AgentRequestMessage(machineID, method, uri, timestamp string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte("fivem-agent-request\n" + machineID + "\n" + method + "\n" + uri + "\n" + timestamp + "\n" + hex.EncodeToString(sum[:]))
+}
+
+// UpdateReport is posted by agents to /update/report when they rolled back
+// a version that failed its health check.
+type UpdateReport struct {
+	MachineID string `json:"machine_id"`
+	// Version is the version that failed.
+	Version string `json:"version"`
+	// RunningVersion is the version the agent rolled back to.
+	RunningVersion string `json:"running_version"`
+	Reason         string `json:"reason"`
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Large payloads like screenshots are sent as uploads: the agent announces
+// the file with UploadBegin, the server acknowledges with the chunk it
+// expects next, and the agent sends that chunk as a binary frame. Each chunk
+// is acknowledged the same way, so an agent that reconnects resumes by
+// sending UploadBegin again. After the last chunk the server checks the
+// SHA-256 and answers with Complete or Error.
+const (
+	// agent -> server.
+	TypeUploadBegin = "upload.begin"
+	// server -> agent, answers upload.begin and every chunk.
+	TypeUploadAck = "upload.ack"
+
+	// CapabilityUpload is advertised in Challenge by servers accepting
+	// uploads and in Register by agents sending them.
+	CapabilityUpload = "upload"
+
+	ChunkSize    = 256 << 10
+	MaxChunkSize = 1 << 20
+)
+
+type UploadBegin struct {
+	UploadID  string `json:"upload_id"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	ChunkSize int    `json:"chunk_size"`
+}
+
+// Chunks is the number of chunks the upload is split into.
+func (b *UploadBegin) Chunks() int {
+	return int((b.Size + int64(b.ChunkSize) - 1) / int64(b.ChunkSize))
+}
+
+type UploadAck struct {
+	UploadID  string `json:"upload_id"`
+	NextChunk int    `json:"next_chunk"`
+	Complete  bool   `json:"complete,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Binary frames start with MessagePrefix and a method, both little endian
+// uint16s.
+const MessagePrefix uint16 = 24531
+
+const (
+	MethodUploadChunk uint16 = iota + 1
+)
+
+var errShortFrame = errors.New("binary frame too short")
+
+func MatchMessagePrefix(b []byte) bool {
+	return len(b) >= 4 && binary.LittleEndian.Uint16(b) == MessagePrefix
+}
+
+func MatchMessageMethod(b []byte, method uint16) bool {
+	return len(b) >= 4 && binary.LittleEndian.Uint16(b[2:]) == method
+}
+
+// Chunk is one piece of an upload. On the wire it follows the frame header
+// as a length-prefixed upload ID, the uint32 chunk index and the data.
+type Chunk struct {
+	UploadID string
+	Index    int
+	Data     []byte
+}
+
+func (c *Chunk) Marshal() ([]byte, error) {
+	if len(c.UploadID) > 255 {
+		return nil, fmt.Errorf("upload ID too long")
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(4 + 1 + len(c.UploadID) + 4 + len(c.Data))
+	_ = binary.Write(&buf, binary.LittleEndian, MessagePrefix)
+	_ = binary.Write(&buf, binary.LittleEndian, MethodUploadChunk)
+	buf.WriteByte(byte(len(c.UploadID)))
+	buf.WriteString(c.UploadID)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(c.Index))
+	buf.Write(c.Data)
+	return buf.Bytes(), nil
+}
+
+func DecodeChunk(b []byte) (*Chunk, error) {
+	if !MatchMessagePrefix(b) || !MatchMessageMethod(b, MethodUploadChunk) {
+		return nil, fmt.Errorf("not an upload chunk")
+	}
+	b = b[4:]
+
+	if len(b) < 1 || len(b) < 1+int(b[0])+4 {
+		return nil, errShortFrame
+	}
+	n := int(b[0])
+	c := &Chunk{UploadID: string(b[1 : 1+n])}
+	c.Index = int(binary.LittleEndian.Uint32(b[1+n:]))
+	c.Data = b[1+n+4:]
+	return c, nil
+}
@@ -0,0 +1,183 @@
+// Package releases describes the release feed the server hosts for agent
+// self-updates.
+//
+// The feed is a manifest listing every release with its artifacts, served
+// at /releases/manifest.json; artifacts are served at
+// /releases/<version>/<name>?sha256=<hex>. An asset may list patches from
+// the same asset of the previous release, see the delta package, served next
+// to it.
+package releases
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version and asset names become paths on the server.
+var (
+	versionPattern = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+([-+][0-9A-Za-z.-]+)?$`)
+	namePattern    = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._-]*$`)
+)
+
+type Manifest struct {
+	Releases []*Release `json:"releases"`
+	// NextID numbers assets, which the updater refers to by ID.
+	NextID int64 `json:"next_id"`
+}
+
+type Release struct {
+	Version   string    `json:"version"`
+	Published time.Time `json:"published"`
+	Notes     string    `json:"notes,omitempty"`
+	Assets    []*Asset  `json:"assets"`
+}
+
+type Asset struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Signature is the base64 Ed25519 signature of the artifact, if signed.
+	Signature string   `json:"signature,omitempty"`
+	Patches   []*Patch `json:"patches,omitempty"`
+}
+
+// Patch turns the asset of release From, known by its SHA-256, into the
+// asset. Updaters check the result against the asset's SHA-256.
+type Patch struct {
+	From       string `json:"from"`
+	FromSHA256 string `json:"from_sha256"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+}
+
+// PatchName names the patch of asset name from version from.
+func PatchName(name, from string) string {
+	return name + ".from-" + from + ".patch"
+}
+
+// Find returns the release of version, with or without the "v" prefix.
+func (m *Manifest) Find(version string) (*Release, bool) {
+	for _, r := range m.Releases {
+		if SameVersion(r.Version, version) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// Path is where the asset is served, relative to the feed. The SHA-256 in
+// the query tells apart the contents of an asset that was uploaded again,
+// so each URL can be cached for good.
+func (r *Release) Path(a *Asset) string {
+	return r.Version + "/" + a.Name + "?sha256=" + a.SHA256
+}
+
+// PatchPath is where patch p is served, relative to the feed, see Path.
+func (r *Release) PatchPath(p *Patch) string {
+	return r.Version + "/" + p.Name + "?sha256=" + p.SHA256
+}
+
+// SameVersion reports whether a and b name the same version, tags being
+// written with or without the "v" prefix.
+func SameVersion(a, b string) bool {
+	return strings.TrimPrefix(a, "v") == strings.TrimPrefix(b, "v")
+}
+
+func ValidVersion(version string) bool {
+	return versionPattern.MatchString(version)
+}
+
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// Compare orders versions by their major, minor and patch numbers, a
+// pre-release sorting before its release. Invalid versions sort first.
+func Compare(a, b string) int {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	if !okA || !okB {
+		return boolCompare(okA, okB)
+	}
+	for i := range 3 {
+		if pa.numbers[i] != pb.numbers[i] {
+			if pa.numbers[i] < pb.numbers[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	if pa.pre == pb.pre {
+		return 0
+	}
+	if pa.pre == "" || pb.pre == "" {
+		// A release sorts after its pre-releases.
+		return boolCompare(pa.pre == "", pb.pre == "")
+	}
+	return strings.Compare(pa.pre, pb.pre)
+}
+
+type version struct {
+	numbers [3]int
+	pre     string
+}
+
+func parseVersion(s string) (version, bool) {
+	var v version
+	if !ValidVersion(s) {
+		return v, false
+	}
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, v.pre, _ = strings.Cut(s, "-")
+	for i, part := range strings.SplitN(s, ".", 3) {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return v, false
+		}
+		v.numbers[i] = n
+	}
+	return v, true
+}
+
+func boolCompare(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+// VerifyingReader checks the SHA-256 of everything read from it once the
+// underlying reader is exhausted, failing the last read on a mismatch.
+type VerifyingReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	sha256 string
+}
+
+func NewVerifyingReader(r io.Reader, sha256Hex string) *VerifyingReader {
+	return &VerifyingReader{r: r, hash: sha256.New(), sha256: sha256Hex}
+}
+
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != v.sha256 {
+			return n, fmt.Errorf("sha256 mismatch: got %s, want %s", sum, v.sha256)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,94 @@
+package releases
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	data := bytes.Repeat([]byte("fivem tools executable\n"), 1000)
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name string
+		r    io.Reader
+		ok   bool
+	}{
+		{"complete", bytes.NewReader(data), true},
+		{"one byte at a time", iotest.OneByteReader(bytes.NewReader(data)), true},
+		{"truncated", bytes.NewReader(data[:len(data)-1]), false},
+		{"empty", bytes.NewReader(nil), false},
+		{"extended", io.MultiReader(bytes.NewReader(data), bytes.NewReader([]byte("x"))), false},
+		{"tampered", bytes.NewReader(append([]byte("F"), data[1:]...)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(NewVerifyingReader(tt.r, digest))
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !bytes.Equal(got, data) {
+				t.Fatal("read other data")
+			}
+		})
+	}
+
+	// A stream that breaks off fails with its own error, not a mismatch.
+	r := NewVerifyingReader(io.MultiReader(bytes.NewReader(data[:100]), iotest.ErrReader(io.ErrUnexpectedEOF)), digest)
+	if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, v := range []string{"v1.2.3", "1.2.3", "v1.2.3-beta.1", "v1.2.3+build"} {
+		if !ValidVersion(v) {
+			t.Errorf("version %q is not valid", v)
+		}
+	}
+	for _, v := range []string{"", "v1.2", "latest", "v1.2.3/../x", "v1.2.3\nfivem.exe", "../v1.2.3"} {
+		if ValidVersion(v) {
+			t.Errorf("version %q is valid", v)
+		}
+	}
+	for _, name := range []string{"fivem-windows-amd64.exe", "fivem.exe.sig"} {
+		if !ValidName(name) {
+			t.Errorf("name %q is not valid", name)
+		}
+	}
+	for _, name := range []string{"", ".hidden", "../fivem.exe", "a/b", "a\nb"} {
+		if ValidName(name) {
+			t.Errorf("name %q is valid", name)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "1.2.3", 0},
+		{"v1.2.3", "v1.2.4", -1},
+		{"v1.10.0", "v1.9.0", 1},
+		{"v2.0.0", "v1.99.99", 1},
+		{"v1.2.3-beta", "v1.2.3", -1},
+		{"v1.2.3-alpha", "v1.2.3-beta", -1},
+		{"v1.2.3+build", "v1.2.3", 0},
+		{"invalid", "v0.0.1", -1},
+		{"invalid", "other", 0},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := Compare(tt.b, tt.a); got != -tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
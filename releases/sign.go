@@ -0,0 +1,57 @@
+package releases
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrUnsigned     = errors.New("release artifact is not signed")
+	ErrBadSignature = errors.New("release artifact signature is invalid")
+)
+
+// SignaturePayload is what a release signature covers. Binding the version
+// and name keeps a signed artifact from being served as another release,
+// e.g. an old vulnerable build as the newest one.
+func SignaturePayload(version, name, sha256Hex string) []byte {
+	return []byte("fivem-release\n" + version + "\n" + name + "\n" + sha256Hex)
+}
+
+// Sign returns the base64 Ed25519 signature of artifact name of version.
+func Sign(key ed25519.PrivateKey, version, name string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignaturePayload(version, name, hex.EncodeToString(sum[:]))))
+}
+
+// Verify checks signature of artifact name of version against publicKey.
+func Verify(publicKey ed25519.PublicKey, version, name string, data []byte, signature string) error {
+	sum := sha256.Sum256(data)
+	return VerifyDigest(publicKey, version, name, hex.EncodeToString(sum[:]), signature)
+}
+
+// VerifyDigest is Verify for an artifact known by its SHA-256.
+func VerifyDigest(publicKey ed25519.PublicKey, version, name, sha256Hex, signature string) error {
+	signature = strings.TrimSpace(signature)
+	if signature == "" {
+		return ErrUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, SignaturePayload(version, name, sha256Hex), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid release public key")
+	}
+	return b, nil
+}
@@ -0,0 +1,77 @@
+package releases
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerify(t *testing.T) {
+	key, other := newKey(t), newKey(t)
+	publicKey := key.Public().(ed25519.PublicKey)
+	data := []byte("fivem tools executable")
+	sig := Sign(key, "v1.2.0", "fivem-windows-amd64.exe", data)
+
+	tests := []struct {
+		name      string
+		key       ed25519.PublicKey
+		version   string
+		assetName string
+		data      []byte
+		signature string
+		err       error
+	}{
+		{"valid", publicKey, "v1.2.0", "fivem-windows-amd64.exe", data, sig, nil},
+		{"surrounding space", publicKey, "v1.2.0", "fivem-windows-amd64.exe", data, " " + sig + "\n", nil},
+		{"wrong key", other.Public().(ed25519.PublicKey), "v1.2.0", "fivem-windows-amd64.exe", data, sig, ErrBadSignature},
+		{"no key", nil, "v1.2.0", "fivem-windows-amd64.exe", data, sig, ErrBadSignature},
+		{"signed by another key", publicKey, "v1.2.0", "fivem-windows-amd64.exe", data, Sign(other, "v1.2.0", "fivem-windows-amd64.exe", data), ErrBadSignature},
+		{"served as another version", publicKey, "v1.3.0", "fivem-windows-amd64.exe", data, sig, ErrBadSignature},
+		{"served without the v", publicKey, "1.2.0", "fivem-windows-amd64.exe", data, sig, ErrBadSignature},
+		{"served as another name", publicKey, "v1.2.0", "fivem-windows-arm64.exe", data, sig, ErrBadSignature},
+		{"tampered", publicKey, "v1.2.0", "fivem-windows-amd64.exe", append([]byte("x"), data[1:]...), sig, ErrBadSignature},
+		{"truncated", publicKey, "v1.2.0", "fivem-windows-amd64.exe", data[:len(data)-1], sig, ErrBadSignature},
+		{"unsigned", publicKey, "v1.2.0", "fivem-windows-amd64.exe", data, "", ErrUnsigned},
+		{"blank signature", publicKey, "v1.2.0", "fivem-windows-amd64.exe", data, " \n", ErrUnsigned},
+		{"signature not base64", publicKey, "v1.2.0", "fivem-windows-amd64.exe", data, "!" + sig[1:], ErrBadSignature},
+		{"truncated signature", publicKey, "v1.2.0", "fivem-windows-amd64.exe", data, sig[:len(sig)-4], ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.key, tt.version, tt.assetName, tt.data, tt.signature); !errors.Is(err, tt.err) {
+				t.Fatalf("Verify: got %v, want %v", err, tt.err)
+			}
+			sum := sha256.Sum256(tt.data)
+			if err := VerifyDigest(tt.key, tt.version, tt.assetName, hex.EncodeToString(sum[:]), tt.signature); !errors.Is(err, tt.err) {
+				t.Fatalf("VerifyDigest: got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key := newKey(t)
+	encoded := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	if publicKey, err := ParsePublicKey(encoded); err != nil || !publicKey.Equal(key.Public()) {
+		t.Fatalf("got %v, %v", publicKey, err)
+	}
+	for _, s := range []string{"", "not base64", encoded[:len(encoded)-4]} {
+		if _, err := ParsePublicKey(s); err == nil {
+			t.Errorf("parsed public key %q", s)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package remoteconfig signs and verifies the configuration records agents
+// fetch from DNS TXT or over HTTP.
+//
+// A record is a single line of key=value pairs separated by semicolons,
+// starting with the serial and ending with an Ed25519 signature over
+// everything before it:
+//
+//	serial=7;base_url=https://fivem-tools.example.com;status_tick=300;sig=...
+//
+// Serials only ever grow, so agents can refuse a replayed older record.
+package remoteconfig
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsigned     = errors.New("config record is not signed")
+	ErrBadSignature = errors.New("config record signature is invalid")
+)
+
+const sigSeparator = ";sig="
+
+type Record struct {
+	Serial uint64
+	Values map[string]string
+}
+
+// Payload is the signed part of the record, with keys sorted.
+func (r *Record) Payload() (string, error) {
+	parts := []string{"serial=" + strconv.FormatUint(r.Serial, 10)}
+	for _, key := range slices.Sorted(maps.Keys(r.Values)) {
+		value := r.Values[key]
+		if key == "" || key == "serial" || key == "sig" || strings.ContainsAny(key, ";= ") {
+			return "", fmt.Errorf("invalid key %q", key)
+		}
+		if strings.Contains(value, ";") {
+			return "", fmt.Errorf("value of %s contains ';'", key)
+		}
+		parts = append(parts, key+"="+value)
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// Sign returns the record as text signed with key.
+func Sign(r *Record, key ed25519.PrivateKey) (string, error) {
+	payload, err := r.Payload()
+	if err != nil {
+		return "", err
+	}
+	return payload + sigSeparator + base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(payload))), nil
+}
+
+// Parse verifies s against publicKey and decodes it.
+func Parse(s string, publicKey ed25519.PublicKey) (*Record, error) {
+	s = strings.TrimSpace(s)
+
+	i := strings.LastIndex(s, sigSeparator)
+	if i < 0 {
+		return nil, ErrUnsigned
+	}
+	payload, encodedSig := s[:i], s[i+len(sigSeparator):]
+
+	sig, err := base64.StdEncoding.DecodeString(encodedSig)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, []byte(payload), sig) {
+		return nil, ErrBadSignature
+	}
+
+	r := &Record{Values: make(map[string]string)}
+	hasSerial := false
+	for _, part := range strings.Split(payload, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed config entry %q", part)
+		}
+		if key == "serial" {
+			if r.Serial, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid serial %q", value)
+			}
+			hasSerial = true
+			continue
+		}
+		r.Values[key] = value
+	}
+	if !hasSerial {
+		return nil, fmt.Errorf("config record has no serial")
+	}
+	return r, nil
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid config public key")
+	}
+	return b, nil
+}
@@ -0,0 +1,115 @@
+package remoteconfig
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSignParse(t *testing.T) {
+	key, other := newKey(t), newKey(t)
+	publicKey := key.Public().(ed25519.PublicKey)
+
+	signed, err := Sign(&Record{Serial: 7, Values: map[string]string{"status_tick": "300", "base_url": "https://fivem-tools.example.com"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "serial=7;base_url=https://fivem-tools.example.com;status_tick=300;sig="; !strings.HasPrefix(signed, want) {
+		t.Fatalf("got %q, want it to start with %q", signed, want)
+	}
+	payload, sig, _ := strings.Cut(signed, sigSeparator)
+	otherSigned, _ := Sign(&Record{Serial: 7, Values: map[string]string{"status_tick": "300", "base_url": "https://fivem-tools.example.com"}}, other)
+
+	tests := []struct {
+		name   string
+		record string
+		key    ed25519.PublicKey
+		err    error
+	}{
+		{"valid", signed, publicKey, nil},
+		{"surrounding space", " " + signed + "\n", publicKey, nil},
+		{"wrong key", otherSigned, publicKey, ErrBadSignature},
+		{"no key", signed, nil, ErrBadSignature},
+		{"unsigned", payload, publicKey, ErrUnsigned},
+		{"rolled back serial", strings.Replace(signed, "serial=7", "serial=6", 1), publicKey, ErrBadSignature},
+		{"raised serial", strings.Replace(signed, "serial=7", "serial=8", 1), publicKey, ErrBadSignature},
+		{"changed value", strings.Replace(signed, "status_tick=300", "status_tick=1", 1), publicKey, ErrBadSignature},
+		{"added value", "update_channel=canary;" + signed, publicKey, ErrBadSignature},
+		{"truncated signature", signed[:len(signed)-4], publicKey, ErrBadSignature},
+		{"signature not base64", payload + sigSeparator + "!" + sig[1:], publicKey, ErrBadSignature},
+		{"other signature", payload + sigSeparator + strings.SplitN(otherSigned, sigSeparator, 2)[1], publicKey, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Parse(tt.record, tt.key)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if r.Serial != 7 || len(r.Values) != 2 || r.Values["status_tick"] != "300" || r.Values["base_url"] != "https://fivem-tools.example.com" {
+				t.Fatalf("got record %+v", r)
+			}
+		})
+	}
+}
+
+func TestParseSignedMalformed(t *testing.T) {
+	key := newKey(t)
+	sign := func(payload string) string {
+		return payload + sigSeparator + base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(payload)))
+	}
+
+	for name, payload := range map[string]string{
+		"no serial":      "base_url=https://fivem-tools.example.com",
+		"invalid serial": "serial=-1;base_url=https://fivem-tools.example.com",
+		"no value":       "serial=7;base_url",
+	} {
+		if _, err := Parse(sign(payload), key.Public().(ed25519.PublicKey)); err == nil {
+			t.Errorf("parsed a record with %s", name)
+		}
+	}
+}
+
+func TestPayloadInvalid(t *testing.T) {
+	for name, values := range map[string]map[string]string{
+		"empty key":       {"": "x"},
+		"serial key":      {"serial": "8"},
+		"sig key":         {"sig": "x"},
+		"key with =":      {"a=b": "x"},
+		"key with ;":      {"a;b": "x"},
+		"value with ;":    {"base_url": "x;serial=9"},
+		"key with spaces": {"a b": "x"},
+	} {
+		if _, err := Sign(&Record{Serial: 1, Values: values}, newKey(t)); err == nil {
+			t.Errorf("signed a record with %s", name)
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key := newKey(t)
+	encoded := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	if publicKey, err := ParsePublicKey(encoded); err != nil || !publicKey.Equal(key.Public()) {
+		t.Fatalf("got %v, %v", publicKey, err)
+	}
+	for _, s := range []string{"", "not base64", encoded[:len(encoded)-4]} {
+		if _, err := ParsePublicKey(s); err == nil {
+			t.Errorf("parsed public key %q", s)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+	"github.com/willywotz/fivem/releases"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+)
+
+// maxUnhealthyStarts is how often a new version may start without becoming
+// healthy, e.g. crash before registering, before it is rolled back.
+const maxUnhealthyStarts = 3
+
+// maxFailedRegistrations is how often a new version may reach the server and
+// fail to register before it is rolled back.
+const maxFailedRegistrations = 3
+
+// updateState survives restarts between installing a version and
+// confirming it healthy, which is a verified registration on /ws.
+type updateState struct {
+	Pending *pendingUpdate `json:"pending,omitempty"`
+	// FailedVersions are never installed again.
+	FailedVersions []string `json:"failed_versions,omitempty"`
+	// Unreported holds rollbacks the server has not been told about yet.
+	Unreported []protocol.UpdateReport `json:"unreported,omitempty"`
+}
+
+type pendingUpdate struct {
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previous_version"`
+	PreviousPath    string    `json:"previous_path"`
+	Installed       time.Time `json:"installed"`
+	Starts          int       `json:"starts"`
+}
+
+var (
+	updateStateMu  sync.Mutex
+	updateHealthy  = make(chan struct{})
+	confirmHealthy sync.Once
+
+	// updateChecking is set while the running version is pending.
+	updateChecking atomic.Bool
+	// registrationFailures counts registrations the server was reached
+	// for, but that failed.
+	registrationFailures atomic.Int32
+	// registrationDeferred is set when registering waited on something the
+	// version cannot help, like an unreachable server or the user's
+	// consent.
+	registrationDeferred atomic.Bool
+	// registrationWaits counts such waits still going on, see
+	// waitRegistration.
+	registrationWaits atomic.Int32
+)
+
+// processFrom is "service" or "client", like the From of registrations.
+func processFrom() string {
+	if inService, _ := svc.IsWindowsService(); inService {
+		return "service"
+	}
+	return "client"
+}
+
+// updateStatePath keeps the service and the client apart, they update
+// different copies of the executable. from is the process whose executable
+// is updated, see processFrom.
+func updateStatePath(from string) (string, error) {
+	return transparencyPath("update-" + from + ".json")
+}
+
+func loadUpdateState(from string) (*updateState, error) {
+	path, err := updateStatePath(from)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &updateState{}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read update state: %w", err)
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("failed to decode update state: %w", err)
+	}
+	return state, nil
+}
+
+func saveUpdateState(from string, state *updateState) error {
+	path, err := updateStatePath(from)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode update state: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write update state: %w", err)
+	}
+	return nil
+}
+
+// previousExecutablePath is where the updater moves the running executable.
+func previousExecutablePath(exe string) string {
+	return exe + ".previous"
+}
+
+// versionFailed reports whether the from process rolled v back before.
+func versionFailed(from, v string) bool {
+	updateStateMu.Lock()
+	defer updateStateMu.Unlock()
+
+	state, err := loadUpdateState(from)
+	if err != nil {
+		failedf("failed to load update state: %v", err)
+		return false
+	}
+	return slices.ContainsFunc(state.FailedVersions, func(failed string) bool { return releases.SameVersion(failed, v) })
+}
+
+// markUpdatePending records a version installed for the from process,
+// replacing previousVersion, that still has to prove healthy after the
+// restart.
+func markUpdatePending(from, newVersion, previousVersion, previousPath string) error {
+	updateStateMu.Lock()
+	defer updateStateMu.Unlock()
+
+	state, err := loadUpdateState(from)
+	if err != nil {
+		return err
+	}
+	state.Pending = &pendingUpdate{
+		Version:         newVersion,
+		PreviousVersion: previousVersion,
+		PreviousPath:    previousPath,
+		Installed:       time.Now(),
+	}
+	return saveUpdateState(from, state)
+}
+
+// updateInstalled reports whether v was installed over the running
+// executable, by the update command, and only waits for a restart.
+// Installing it again would replace the previous executable kept for the
+// rollback.
+func updateInstalled(v string) bool {
+	updateStateMu.Lock()
+	defer updateStateMu.Unlock()
+
+	state, err := loadUpdateState(processFrom())
+	if err != nil {
+		failedf("failed to load update state: %v", err)
+		return false
+	}
+	return state.Pending != nil && releases.SameVersion(state.Pending.Version, v) && !releases.SameVersion(version, v)
+}
+
+// countUpdateStart runs first thing at start, so crashes anywhere while
+// starting count, and rolls a pending version back that keeps crashing. A
+// process about to run itself again elevated, see becomeAdmin, does not
+// count.
+func countUpdateStart() {
+	if inService, _ := svc.IsWindowsService(); !inService && !isAdmin() && !noBecomeAdmin && !localDebug {
+		return
+	}
+
+	updateStateMu.Lock()
+	state, err := loadUpdateState(processFrom())
+	if err != nil {
+		updateStateMu.Unlock()
+		failedf("failed to load update state: %v", err)
+		return
+	}
+
+	pending := state.Pending
+	if pending != nil && !releases.SameVersion(pending.Version, version) {
+		// Not running the version that was installed, nothing to check.
+		state.Pending = nil
+		pending = nil
+	}
+	if pending != nil {
+		pending.Starts++
+	}
+	if err := saveUpdateState(processFrom(), state); err != nil {
+		failedf("failed to save update state: %v", err)
+	}
+	updateStateMu.Unlock()
+
+	if pending != nil && pending.Starts > maxUnhealthyStarts {
+		rollbackUpdate(fmt.Sprintf("started %d times without becoming healthy", pending.Starts-1))
+	}
+}
+
+// checkPendingUpdate runs once starting is done. A pending version has to
+// register: it is rolled back when it fails to maxFailedRegistrations times
+// with the server reached, see registrationFailed, or does not try within
+// the update_health_timeout. An unreachable server only makes it wait.
+// Rollbacks the server missed are reported again.
+func checkPendingUpdate() {
+	updateStateMu.Lock()
+	state, err := loadUpdateState(processFrom())
+	updateStateMu.Unlock()
+	if err != nil {
+		failedf("failed to load update state: %v", err)
+		return
+	}
+
+	go reportRollbacks()
+
+	if state.Pending == nil || !releases.SameVersion(state.Pending.Version, version) {
+		return
+	}
+	updateChecking.Store(true)
+
+	timeout := config.Seconds(ConfigUpdateHealthTimeout)
+	go func() {
+		for {
+			select {
+			case <-updateHealthy:
+				return
+			case <-time.After(timeout):
+			}
+			reason, deferred := registrationVerdict(timeout)
+			if reason != "" {
+				rollbackUpdate(reason)
+				return
+			}
+			if deferred {
+				failedf("Version %s is not confirmed healthy after %s, waiting for the server", version, timeout)
+			}
+		}
+	}()
+}
+
+// registrationVerdict decides, every update_health_timeout, whether the
+// pending version is rolled back and why. deferred reports whether
+// registering waited on something else than the version since the last
+// verdict.
+func registrationVerdict(timeout time.Duration) (reason string, deferred bool) {
+	n := registrationFailures.Load()
+	if n >= maxFailedRegistrations {
+		return fmt.Sprintf("failed to register %d times", n), false
+	}
+	deferred = registrationDeferred.Swap(false) || registrationWaits.Load() > 0
+	if n == 0 && !deferred {
+		return fmt.Sprintf("did not try to register within %s", timeout), false
+	}
+	return "", deferred
+}
+
+// deferRegistration tells the health check of a pending version that
+// registering waits on something else than the version.
+func deferRegistration() {
+	registrationDeferred.Store(true)
+}
+
+// waitRegistration is deferRegistration for waits that can outlast the
+// update_health_timeout, like the user's consent. The health check keeps
+// waiting until done is called.
+func waitRegistration() (done func()) {
+	registrationWaits.Add(1)
+	return func() {
+		registrationDeferred.Store(true)
+		registrationWaits.Add(-1)
+	}
+}
+
+// registrationFailed tells the health check of a pending version that the
+// server was reached but registering failed with err.
+func registrationFailed(err error) {
+	if registrationFailures.Add(1) == maxFailedRegistrations && updateChecking.Load() {
+		rollbackUpdate(fmt.Sprintf("failed to register %d times, last: %v", maxFailedRegistrations, err))
+	}
+}
+
+// clearFailedVersions lets the from process install the versions it rolled
+// back again.
+func clearFailedVersions(from string) error {
+	updateStateMu.Lock()
+	defer updateStateMu.Unlock()
+
+	state, err := loadUpdateState(from)
+	if err != nil {
+		return err
+	}
+	if len(state.FailedVersions) == 0 {
+		return nil
+	}
+	failedf("Clearing failed versions %s", strings.Join(state.FailedVersions, ", "))
+	state.FailedVersions = nil
+	return saveUpdateState(from, state)
+}
+
+// confirmUpdateHealthy ends the pending state of the running version.
+func confirmUpdateHealthy() {
+	confirmHealthy.Do(func() {
+		close(updateHealthy)
+		updateChecking.Store(false)
+
+		updateStateMu.Lock()
+		defer updateStateMu.Unlock()
+
+		state, err := loadUpdateState(processFrom())
+		if err != nil {
+			failedf("failed to load update state: %v", err)
+			return
+		}
+		if state.Pending == nil || !releases.SameVersion(state.Pending.Version, version) {
+			return
+		}
+		failedf("Version %s is healthy", version)
+		state.Pending = nil
+		if err := saveUpdateState(processFrom(), state); err != nil {
+			failedf("failed to save update state: %v", err)
+		}
+	})
+}
+
+// rollbackUpdate puts the previous executable back and restarts it.
+func rollbackUpdate(reason string) {
+	updateStateMu.Lock()
+	state, err := loadUpdateState(processFrom())
+	if err != nil || state.Pending == nil {
+		updateStateMu.Unlock()
+		failedf("cannot roll back, no pending update: %v", err)
+		return
+	}
+	pending := state.Pending
+
+	failedf("Rolling back version %s to %s: %s", version, pending.PreviousVersion, reason)
+
+	exe, err := os.Executable()
+	if err == nil {
+		err = restoreExecutable(exe, pending.PreviousPath)
+	}
+	if err != nil {
+		updateStateMu.Unlock()
+		failedf("failed to roll back: %v", err)
+		return
+	}
+
+	state.Pending = nil
+	// The pending version is the tag of the feed, which the server and
+	// versionFailed go by.
+	if !slices.ContainsFunc(state.FailedVersions, func(failed string) bool { return releases.SameVersion(failed, pending.Version) }) {
+		state.FailedVersions = append(state.FailedVersions, pending.Version)
+	}
+	machineID, _ := machineID()
+	state.Unreported = append(state.Unreported, protocol.UpdateReport{
+		MachineID:      machineID,
+		Version:        pending.Version,
+		RunningVersion: pending.PreviousVersion,
+		Reason:         reason,
+	})
+	if err := saveUpdateState(processFrom(), state); err != nil {
+		failedf("failed to save update state: %v", err)
+	}
+	updateStateMu.Unlock()
+
+	reportRollbacks()
+
+	if err := restartSelf(exe); err != nil {
+		failedf("failed to restart after rollback: %v", err)
+	}
+}
+
+// restoreExecutable swaps exe with previous. Running executables can be
+// renamed but not overwritten on Windows.
+func restoreExecutable(exe, previous string) error {
+	if _, err := os.Stat(previous); err != nil {
+		return fmt.Errorf("previous executable is missing: %w", err)
+	}
+
+	failed := exe + ".failed"
+	_ = os.Remove(failed)
+	if err := os.Rename(exe, failed); err != nil {
+		return fmt.Errorf("failed to move failed executable: %w", err)
+	}
+	if err := os.Rename(previous, exe); err != nil {
+		_ = os.Rename(failed, exe)
+		return fmt.Errorf("failed to restore previous executable: %w", err)
+	}
+	return nil
+}
+
+// reportRollbacks tells the server about rollbacks, keeping the ones it
+// could not be reached for.
+func reportRollbacks() {
+	updateStateMu.Lock()
+	defer updateStateMu.Unlock()
+
+	state, err := loadUpdateState(processFrom())
+	if err != nil || len(state.Unreported) == 0 {
+		return
+	}
+
+	remaining := make([]protocol.UpdateReport, 0)
+	for _, report := range state.Unreported {
+		if err := postUpdateReport(&report); err != nil {
+			failedf("failed to report rollback of %s: %v", report.Version, err)
+			remaining = append(remaining, report)
+		}
+	}
+	state.Unreported = remaining
+	if err := saveUpdateState(processFrom(), state); err != nil {
+		failedf("failed to save update state: %v", err)
+	}
+}
+
+func postUpdateReport(report *protocol.UpdateReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.BaseURL()+"/update/report", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signRequest(req, body); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// restartSelf exits so the service manager restarts the service, or starts
+// exe again outside of it.
+func restartSelf(exe string) error {
+	if inService, _ := svc.IsWindowsService(); inService {
+		os.Exit(1)
+	}
+
+	if _, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys: &syscall.SysProcAttr{
+			CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to restart: %w", err)
+	}
+
+	os.Exit(0)
+	return nil
+}
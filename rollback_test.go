@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func resetRegistrationHealth() {
+	registrationFailures.Store(0)
+	registrationDeferred.Store(false)
+	registrationWaits.Store(0)
+}
+
+func TestRegistrationVerdictConsentOutlastsTimeout(t *testing.T) {
+	resetRegistrationHealth()
+	t.Cleanup(resetRegistrationHealth)
+	const timeout = 2 * time.Minute
+
+	// The consent prompt and the retry after it span several timeouts.
+	done := waitRegistration()
+	for i := 0; i < 3; i++ {
+		if reason, deferred := registrationVerdict(timeout); reason != "" || !deferred {
+			t.Fatalf("timeout %d while waiting for consent: got %q, deferred %v, want to keep waiting", i, reason, deferred)
+		}
+	}
+	done()
+
+	// The timeout the wait ended in still waits, the next one does not.
+	if reason, deferred := registrationVerdict(timeout); reason != "" || !deferred {
+		t.Fatalf("timeout after consent: got %q, deferred %v, want to keep waiting", reason, deferred)
+	}
+	if reason, _ := registrationVerdict(timeout); reason == "" {
+		t.Fatal("got no rollback after a timeout without trying to register")
+	}
+}
+
+func TestRegistrationVerdict(t *testing.T) {
+	resetRegistrationHealth()
+	t.Cleanup(resetRegistrationHealth)
+	const timeout = 2 * time.Minute
+
+	if reason, _ := registrationVerdict(timeout); reason == "" {
+		t.Fatal("got no rollback without trying to register")
+	}
+
+	// An unreachable server defers one timeout.
+	deferRegistration()
+	if reason, deferred := registrationVerdict(timeout); reason != "" || !deferred {
+		t.Fatalf("got %q, deferred %v, want to keep waiting", reason, deferred)
+	}
+	if reason, _ := registrationVerdict(timeout); reason == "" {
+		t.Fatal("got no rollback after the deferred timeout")
+	}
+
+	// Failures the server saw roll back at maxFailedRegistrations, even while
+	// waiting.
+	done := waitRegistration()
+	defer done()
+	registrationFailures.Store(maxFailedRegistrations - 1)
+	if reason, _ := registrationVerdict(timeout); reason != "" {
+		t.Fatalf("got rollback %q before %d failures", reason, maxFailedRegistrations)
+	}
+	registrationFailures.Store(maxFailedRegistrations)
+	if reason, _ := registrationVerdict(timeout); reason == "" {
+		t.Fatalf("got no rollback after %d failures", maxFailedRegistrations)
+	}
+}
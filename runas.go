@@ -15,6 +15,17 @@ var (
 	procShellExecuteW = shell32.NewProc("ShellExecuteW")
 )
 
+// isAdmin reports whether the process runs elevated, which opening the
+// physical drive requires.
+func isAdmin() bool {
+	f, err := os.Open("\\\\.\\PHYSICALDRIVE0")
+	if err != nil {
+		return false
+	}
+	_ = f.Close()
+	return true
+}
+
 func becomeAdmin() error {
 	if localDebug || noBecomeAdmin {
 		return nil
@@ -24,9 +35,8 @@ func becomeAdmin() error {
 		return nil
 	}
 
-	_, err := os.Open("\\\\.\\PHYSICALDRIVE0")
-	if err == nil {
-		return nil // Already running as admin
+	if isAdmin() {
+		return nil
 	}
 
 	exe, err := os.Executable()
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/willywotz/fivem/protocol"
+)
+
+var errConfigScopeNotFound = errors.New("config scope not found")
+
+// AgentConfig is the configuration pushed to agents. Values of a machine
+// override those of its group, which override the global ones.
+type AgentConfig struct {
+	// Version grows with every change and is acknowledged by agents.
+	Version  int64                        `json:"version"`
+	Global   map[string]string            `json:"global"`
+	Groups   map[string]map[string]string `json:"groups"`
+	Machines map[string]map[string]string `json:"machines"`
+	// MachineGroups assigns machines to a group.
+	MachineGroups map[string]string `json:"machine_groups"`
+}
+
+type AgentConfigStore struct {
+	mu     sync.Mutex
+	path   string
+	config AgentConfig
+}
+
+func OpenAgentConfigStore(path string) (*AgentConfigStore, error) {
+	s := &AgentConfigStore{path: path}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read agent config: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.config); err != nil {
+			return nil, fmt.Errorf("failed to decode agent config: %w", err)
+		}
+	}
+
+	if s.config.Global == nil {
+		s.config.Global = make(map[string]string)
+	}
+	if s.config.Groups == nil {
+		s.config.Groups = make(map[string]map[string]string)
+	}
+	if s.config.Machines == nil {
+		s.config.Machines = make(map[string]map[string]string)
+	}
+	if s.config.MachineGroups == nil {
+		s.config.MachineGroups = make(map[string]string)
+	}
+
+	return s, nil
+}
+
+// Effective returns the config to push to machineID.
+func (s *AgentConfigStore) Effective(machineID string) *protocol.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make(map[string]string)
+	maps.Copy(values, s.config.Global)
+	if group, ok := s.config.MachineGroups[machineID]; ok {
+		maps.Copy(values, s.config.Groups[group])
+	}
+	maps.Copy(values, s.config.Machines[machineID])
+
+	return &protocol.Config{Version: s.config.Version, Values: values}
+}
+
+func (s *AgentConfigStore) Get() AgentConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, _ := json.Marshal(s.config)
+	var config AgentConfig
+	_ = json.Unmarshal(b, &config)
+	return config
+}
+
+// Update applies fn to the config, bumps the version and saves it.
+func (s *AgentConfigStore) Update(fn func(c *AgentConfig) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := fn(&s.config); err != nil {
+		return err
+	}
+	s.config.Version++
+
+	b, err := json.MarshalIndent(s.config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode agent config: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("failed to write agent config: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace agent config: %w", err)
+	}
+	return nil
+}
+
+// Push sends the effective config to the connections of machineID, the
+// service and the client, that understand pushed config.
+func (s *AgentConfigStore) Push(machineID string) {
+	for _, a := range agents.All(machineID) {
+		s.PushAgent(&a)
+	}
+}
+
+// PushAgent sends the effective config to the connection of a.
+func (s *AgentConfigStore) PushAgent(a *Agent) {
+	if !slices.Contains(a.Capabilities, protocol.CapabilityConfig) {
+		return
+	}
+
+	env, err := protocol.New(protocol.TypeConfig, s.Effective(a.MachineID))
+	if err != nil {
+		log.Printf("failed to encode config for %s: %v", a.MachineID, err)
+		return
+	}
+	a.client.Send(env)
+}
+
+func (s *AgentConfigStore) PushAll() {
+	for machineID := range agents.Clients() {
+		s.Push(machineID)
+	}
+}
+
+func (s *AgentConfigStore) GetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(s.Get()); err != nil {
+		log.Printf("failed to encode agent config: %v\n", err)
+	}
+}
+
+// ScopeHandler serves PUT and DELETE of the values of one scope: "global",
+// a group or a machine, named by the {name} path value. Affected agents get
+// the new config right away.
+func (s *AgentConfigStore) ScopeHandler(scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		var values map[string]string
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+				http.Error(w, "invalid config values", http.StatusBadRequest)
+				return
+			}
+			for key := range values {
+				if key == "" {
+					http.Error(w, "empty config key", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		err := s.Update(func(c *AgentConfig) error {
+			var scopes map[string]map[string]string
+			switch scope {
+			case "global":
+				if values == nil {
+					values = make(map[string]string)
+				}
+				c.Global = values
+				return nil
+			case "group":
+				scopes = c.Groups
+			case "machine":
+				scopes = c.Machines
+			}
+			if values == nil {
+				if _, ok := scopes[name]; !ok {
+					return errConfigScopeNotFound
+				}
+				delete(scopes, name)
+				return nil
+			}
+			scopes[name] = values
+			return nil
+		})
+		if errors.Is(err, errConfigScopeNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("failed to update agent config: %v", err)
+			http.Error(w, "failed to update agent config", http.StatusInternalServerError)
+			return
+		}
+
+		if op := auth.Operator(r); op != nil {
+			auth.Audit(op, r, fmt.Sprintf("%s config %s %s %v", r.Method, scope, name, values))
+		}
+
+		switch scope {
+		case "global":
+			s.PushAll()
+		case "group":
+			for machineID := range agents.Clients() {
+				if s.groupOf(machineID) == name {
+					s.Push(machineID)
+				}
+			}
+		case "machine":
+			s.Push(name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GroupHandler assigns the {name} machine to the group in the body, or
+// removes it from its group when the group is empty.
+func (s *AgentConfigStore) GroupHandler(w http.ResponseWriter, r *http.Request) {
+	machineID := r.PathValue("name")
+
+	var body struct {
+		Group string `json:"group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid group", http.StatusBadRequest)
+		return
+	}
+
+	err := s.Update(func(c *AgentConfig) error {
+		if body.Group == "" {
+			delete(c.MachineGroups, machineID)
+		} else {
+			c.MachineGroups[machineID] = body.Group
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to update agent config: %v", err)
+		http.Error(w, "failed to update agent config", http.StatusInternalServerError)
+		return
+	}
+
+	if op := auth.Operator(r); op != nil {
+		auth.Audit(op, r, fmt.Sprintf("set group of %s to %q", machineID, body.Group))
+	}
+	s.Push(machineID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AgentConfigStore) groupOf(machineID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.config.MachineGroups[machineID]
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Types of alert rules.
+const (
+	// AlertDown fires when a server failed every poll for For.
+	AlertDown = "down"
+	// AlertDrop fires when the player count fell by Percent from the most
+	// players seen within Window.
+	AlertDrop = "drop"
+)
+
+const (
+	defaultDropWindow = 10 * time.Minute
+
+	alertColorFiring   = 0xe74c3c
+	alertColorResolved = 0x2ecc71
+)
+
+// AlertRule watches the FiveM servers for outages and player drops.
+type AlertRule struct {
+	Name string `json:"name"`
+	// Server is the FiveM server watched, every server when empty.
+	Server string `json:"server,omitempty"`
+	Type   string `json:"type"`
+	// For is how long a server must be down, e.g. "5m", for down rules.
+	For string `json:"for,omitempty"`
+	// Percent, Window and MinPlayers are for drop rules: a drop is measured
+	// from the most players within Window, "10m" when empty, if at least
+	// MinPlayers were online.
+	Percent    int    `json:"percent,omitempty"`
+	Window     string `json:"window,omitempty"`
+	MinPlayers int    `json:"min_players,omitempty"`
+	// Webhooks names the webhooks notified, every webhook when empty.
+	Webhooks []string `json:"webhooks,omitempty"`
+
+	forDuration time.Duration
+	window      time.Duration
+}
+
+// Webhook receives alerts as Discord webhook messages, which other
+// receivers can read as plain JSON.
+type Webhook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type AlertsConfig struct {
+	Webhooks []*Webhook   `json:"webhooks"`
+	Rules    []*AlertRule `json:"rules"`
+}
+
+// LoadAlerts reads the alerts file; without one nothing is alerted.
+func LoadAlerts(path string, servers []*FiveMServer) (*AlertsConfig, error) {
+	config := &AlertsConfig{Webhooks: make([]*Webhook, 0), Rules: make([]*AlertRule, 0)}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alerts: %w", err)
+	}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("failed to decode alerts: %w", err)
+	}
+
+	webhooks := make(map[string]bool)
+	for _, w := range config.Webhooks {
+		if w.Name == "" || webhooks[w.Name] {
+			return nil, fmt.Errorf("webhook names must be unique and not empty, got %q", w.Name)
+		}
+		webhooks[w.Name] = true
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL of webhook %s", w.Name)
+		}
+	}
+
+	rules := make(map[string]bool)
+	for _, rule := range config.Rules {
+		if rule.Name == "" || rules[rule.Name] {
+			return nil, fmt.Errorf("alert rule names must be unique and not empty, got %q", rule.Name)
+		}
+		rules[rule.Name] = true
+		if rule.Server != "" && !slices.ContainsFunc(servers, func(s *FiveMServer) bool { return s.Name == rule.Server }) {
+			return nil, fmt.Errorf("alert rule %s watches unknown FiveM server %s", rule.Name, rule.Server)
+		}
+		for _, name := range rule.Webhooks {
+			if !webhooks[name] {
+				return nil, fmt.Errorf("alert rule %s notifies unknown webhook %s", rule.Name, name)
+			}
+		}
+
+		switch rule.Type {
+		case AlertDown:
+			if rule.forDuration, err = time.ParseDuration(rule.For); err != nil || rule.forDuration < 0 {
+				return nil, fmt.Errorf("invalid for %q of alert rule %s", rule.For, rule.Name)
+			}
+		case AlertDrop:
+			if rule.Percent < 1 || rule.Percent > 100 {
+				return nil, fmt.Errorf("percent of alert rule %s must be between 1 and 100", rule.Name)
+			}
+			rule.window = defaultDropWindow
+			if rule.Window != "" {
+				if rule.window, err = time.ParseDuration(rule.Window); err != nil || rule.window <= 0 {
+					return nil, fmt.Errorf("invalid window %q of alert rule %s", rule.Window, rule.Name)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("alert rule %s has unknown type %q, expected down or drop", rule.Name, rule.Type)
+		}
+	}
+
+	return config, nil
+}
+
+// Alert is a rule firing for a server. It is sent once, and once more when
+// it resolves.
+type Alert struct {
+	Rule    string    `json:"rule"`
+	Server  string    `json:"server"`
+	Message string    `json:"message"`
+	FiredAt time.Time `json:"fired_at"`
+	// Since is when the server went down, for down alerts.
+	Since time.Time `json:"since,omitzero"`
+	// Baseline is the player count a drop was measured from.
+	Baseline int `json:"baseline,omitempty"`
+}
+
+type countSample struct {
+	at     time.Time
+	online int
+}
+
+type serverHealth struct {
+	downSince time.Time
+	samples   []countSample
+}
+
+// Alerter evaluates the rules on every poll and notifies the webhooks, in
+// order, from Run. Firing alerts are kept in a state file, so a restart
+// neither repeats nor forgets them.
+type Alerter struct {
+	config    *AlertsConfig
+	statePath string
+	client    *http.Client
+	queue     chan *alertNotification
+
+	mu      sync.Mutex
+	servers map[string]*serverHealth
+	firing  map[string]*Alert
+}
+
+type alertNotification struct {
+	rule     *AlertRule
+	alert    *Alert
+	resolved bool
+	message  string
+	at       time.Time
+}
+
+func NewAlerter(config *AlertsConfig, statePath string) (*Alerter, error) {
+	a := &Alerter{
+		config:    config,
+		statePath: statePath,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		queue:     make(chan *alertNotification, 100),
+		servers:   make(map[string]*serverHealth),
+		firing:    make(map[string]*Alert),
+	}
+
+	b, err := os.ReadFile(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read alert state: %w", err)
+	}
+	if err == nil {
+		var firing []*Alert
+		if err := json.Unmarshal(b, &firing); err != nil {
+			return nil, fmt.Errorf("failed to decode alert state: %w", err)
+		}
+		for _, alert := range firing {
+			if rule := a.rule(alert.Rule); rule != nil && rule.watches(alert.Server) {
+				a.firing[alertKey(rule, alert.Server)] = alert
+			}
+		}
+	}
+
+	return a, nil
+}
+
+func alertKey(rule *AlertRule, server string) string {
+	return rule.Name + "\x00" + server
+}
+
+func (a *Alerter) rule(name string) *AlertRule {
+	for _, rule := range a.config.Rules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *AlertRule) watches(server string) bool {
+	return r.Server == "" || r.Server == server
+}
+
+// Observe evaluates the rules of server after a poll at which online
+// players were listed, or which failed with failure.
+func (a *Alerter) Observe(server string, online int, failure string, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	h := a.servers[server]
+	if h == nil {
+		h = &serverHealth{}
+		a.servers[server] = h
+	}
+	if failure == "" {
+		h.downSince = time.Time{}
+		h.samples = append(h.samples, countSample{at: at, online: online})
+		h.samples = slices.DeleteFunc(h.samples, func(s countSample) bool { return at.Sub(s.at) > a.maxWindow() })
+	} else if h.downSince.IsZero() {
+		// Nobody is counted while the server is down, so a server coming
+		// back empty is not a drop from before the outage.
+		h.downSince = at
+		h.samples = nil
+	}
+
+	changed := false
+	for _, rule := range a.config.Rules {
+		if !rule.watches(server) {
+			continue
+		}
+		key := alertKey(rule, server)
+		alert := a.firing[key]
+
+		switch rule.Type {
+		case AlertDown:
+			if alert == nil && failure != "" && at.Sub(h.downSince) >= rule.forDuration {
+				alert = &Alert{Rule: rule.Name, Server: server, FiredAt: at, Since: h.downSince}
+				alert.Message = fmt.Sprintf("FiveM server %s is down since %s: %s", server, h.downSince.Format(time.RFC3339), failure)
+				a.fire(rule, alert)
+				changed = true
+			} else if alert != nil && failure == "" {
+				a.resolve(rule, alert, fmt.Sprintf("FiveM server %s is back up after %s with %d players", server, at.Sub(alert.Since).Round(time.Second), online), at)
+				changed = true
+			}
+
+		case AlertDrop:
+			if failure != "" {
+				continue
+			}
+			if alert == nil {
+				baseline := 0
+				for _, s := range h.samples {
+					if at.Sub(s.at) <= rule.window {
+						baseline = max(baseline, s.online)
+					}
+				}
+				if baseline == 0 || baseline < rule.MinPlayers || online*100 > baseline*(100-rule.Percent) {
+					continue
+				}
+				alert = &Alert{Rule: rule.Name, Server: server, FiredAt: at, Baseline: baseline}
+				alert.Message = fmt.Sprintf("Players on FiveM server %s dropped %d%% from %d to %d within %s", server, 100-online*100/baseline, baseline, online, rule.window)
+				a.fire(rule, alert)
+				changed = true
+			} else if online*200 >= alert.Baseline*(200-rule.Percent) {
+				// Resolving halfway back keeps a count around the threshold
+				// from alerting on every poll.
+				a.resolve(rule, alert, fmt.Sprintf("Players on FiveM server %s recovered to %d of %d", server, online, alert.Baseline), at)
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		if err := a.save(); err != nil {
+			log.Printf("failed to save alert state: %v", err)
+		}
+	}
+}
+
+func (a *Alerter) maxWindow() time.Duration {
+	window := time.Duration(0)
+	for _, rule := range a.config.Rules {
+		window = max(window, rule.window)
+	}
+	return window
+}
+
+func (a *Alerter) fire(rule *AlertRule, alert *Alert) {
+	a.firing[alertKey(rule, alert.Server)] = alert
+	log.Printf("Alert %s: %s", rule.Name, alert.Message)
+	a.enqueue(&alertNotification{rule: rule, alert: alert, message: alert.Message, at: alert.FiredAt})
+}
+
+func (a *Alerter) resolve(rule *AlertRule, alert *Alert, message string, at time.Time) {
+	delete(a.firing, alertKey(rule, alert.Server))
+	log.Printf("Alert %s resolved: %s", rule.Name, message)
+	a.enqueue(&alertNotification{rule: rule, alert: alert, resolved: true, message: message, at: at})
+}
+
+func (a *Alerter) enqueue(n *alertNotification) {
+	select {
+	case a.queue <- n:
+	default:
+		log.Printf("Dropping notification of alert %s, too many pending", n.rule.Name)
+	}
+}
+
+func (a *Alerter) save() error {
+	firing := make([]*Alert, 0, len(a.firing))
+	for _, alert := range a.firing {
+		firing = append(firing, alert)
+	}
+	slices.SortFunc(firing, func(x, y *Alert) int { return x.FiredAt.Compare(y.FiredAt) })
+
+	b, err := json.MarshalIndent(firing, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode alert state: %w", err)
+	}
+	tmp := a.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("failed to write alert state: %w", err)
+	}
+	if err := os.Rename(tmp, a.statePath); err != nil {
+		return fmt.Errorf("failed to replace alert state: %w", err)
+	}
+	return nil
+}
+
+// Run delivers notifications until the process exits.
+func (a *Alerter) Run() {
+	for n := range a.queue {
+		for _, w := range a.webhooks(n.rule) {
+			if err := a.deliver(w, n.payload()); err != nil {
+				log.Printf("failed to notify webhook %s of alert %s: %v", w.Name, n.rule.Name, err)
+			}
+		}
+	}
+}
+
+func (a *Alerter) webhooks(rule *AlertRule) []*Webhook {
+	if len(rule.Webhooks) == 0 {
+		return a.config.Webhooks
+	}
+	webhooks := make([]*Webhook, 0, len(rule.Webhooks))
+	for _, w := range a.config.Webhooks {
+		if slices.Contains(rule.Webhooks, w.Name) {
+			webhooks = append(webhooks, w)
+		}
+	}
+	return webhooks
+}
+
+// webhookPayload is a Discord webhook message.
+type webhookPayload struct {
+	Username string         `json:"username"`
+	Content  string         `json:"content"`
+	Embeds   []webhookEmbed `json:"embeds"`
+}
+
+type webhookEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Color       int            `json:"color"`
+	Timestamp   time.Time      `json:"timestamp"`
+	Fields      []webhookField `json:"fields"`
+}
+
+type webhookField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+func (n *alertNotification) payload() *webhookPayload {
+	title, color, status := "Alert: "+n.rule.Name, alertColorFiring, "firing"
+	if n.resolved {
+		title, color, status = "Resolved: "+n.rule.Name, alertColorResolved, "resolved"
+	}
+	return &webhookPayload{
+		Username: "FiveM Tools",
+		Content:  title,
+		Embeds: []webhookEmbed{{
+			Title:       title,
+			Description: n.message,
+			Color:       color,
+			Timestamp:   n.at,
+			Fields: []webhookField{
+				{Name: "Server", Value: n.alert.Server, Inline: true},
+				{Name: "Rule", Value: n.rule.Name, Inline: true},
+				{Name: "Status", Value: status, Inline: true},
+			},
+		}},
+	}
+}
+
+// deliver posts payload, retrying failures and rate limits a few times.
+func (a *Alerter) deliver(w *Webhook, payload *webhookPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	const attempts = 3
+	for attempt := 1; ; attempt++ {
+		retryAfter := time.Duration(attempt) * 2 * time.Second
+		resp, err := a.client.Post(w.URL, "application/json", bytes.NewReader(b))
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				if s, parseErr := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); parseErr == nil {
+					retryAfter = min(time.Duration(s*float64(time.Second)), 30*time.Second)
+				}
+			} else if resp.StatusCode < 500 {
+				return err
+			}
+		}
+		if attempt == attempts {
+			return err
+		}
+		time.Sleep(retryAfter)
+	}
+}
+
+// Firing returns the firing alerts, oldest first.
+func (a *Alerter) Firing() []Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	firing := make([]Alert, 0, len(a.firing))
+	for _, alert := range a.firing {
+		firing = append(firing, *alert)
+	}
+	slices.SortFunc(firing, func(x, y Alert) int { return x.FiredAt.Compare(y.FiredAt) })
+	return firing
+}
+
+// ListHandler returns the rules and the firing alerts. Webhook URLs are
+// secrets and left out.
+func (a *Alerter) ListHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks := make([]string, 0, len(a.config.Webhooks))
+	for _, webhook := range a.config.Webhooks {
+		webhooks = append(webhooks, webhook.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(map[string]any{"webhooks": webhooks, "rules": a.config.Rules, "firing": a.Firing()}); err != nil {
+		log.Printf("failed to encode alerts: %v\n", err)
+	}
+}
+
+// TestHandler sends a test message to every webhook, or to ?webhook=.
+func (a *Alerter) TestHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("webhook")
+	op := auth.Operator(r)
+
+	results := make(map[string]string)
+	for _, webhook := range a.config.Webhooks {
+		if name != "" && webhook.Name != name {
+			continue
+		}
+		message := "Test message from FiveM Tools"
+		if op != nil {
+			message += ", sent by " + op.Username
+		}
+		results[webhook.Name] = "ok"
+		if err := a.deliver(webhook, &webhookPayload{Username: "FiveM Tools", Content: message, Embeds: make([]webhookEmbed, 0)}); err != nil {
+			results[webhook.Name] = err.Error()
+		}
+	}
+	if len(results) == 0 {
+		http.Error(w, "no such webhook", http.StatusNotFound)
+		return
+	}
+	if op != nil {
+		command := "test alert webhooks"
+		if name != "" {
+			command += " " + name
+		}
+		auth.Audit(op, r, command)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("failed to encode webhook results: %v\n", err)
+	}
+}
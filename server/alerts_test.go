@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFiveM serves players.json, info.json and dynamic.json of a FiveM
+// server with online players, or fails while it is down.
+type fakeFiveM struct {
+	mu     sync.Mutex
+	online int
+	down   bool
+}
+
+func (f *fakeFiveM) set(online int, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.online, f.down = online, down
+}
+
+func (f *fakeFiveM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	online, down := f.online, f.down
+	f.mu.Unlock()
+
+	if down {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.URL.Path {
+	case "/players.json":
+		players := make([]map[string]any, 0, online)
+		for i := range online {
+			players = append(players, map[string]any{"id": i + 1, "name": "player", "identifiers": []string{"license:" + strings.Repeat("a", i+1)}})
+		}
+		_ = json.NewEncoder(w).Encode(players)
+	case "/info.json":
+		_ = json.NewEncoder(w).Encode(map[string]any{"server": "FXServer", "vars": map[string]string{"sv_maxClients": "48"}})
+	case "/dynamic.json":
+		_ = json.NewEncoder(w).Encode(map[string]any{"hostname": "Test", "clients": online, "sv_maxclients": "48"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// webhookReceiver records the Discord payloads posted to it, answering
+// with the statuses in order and 204 after them.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	attempts int
+	payloads chan webhookPayload
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	rec.attempts++
+	status := http.StatusNoContent
+	if len(rec.statuses) > 0 {
+		status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+	}
+	rec.mu.Unlock()
+
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "0.01")
+	}
+	if status >= 300 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	var payload webhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec.payloads <- payload
+	w.WriteHeader(status)
+}
+
+type alertsTest struct {
+	t       *testing.T
+	dir     string
+	fivem   *fakeFiveM
+	hook    *webhookReceiver
+	server  *trackedServer
+	alerter *Alerter
+}
+
+func newAlertsTest(t *testing.T, rules string, statuses ...int) *alertsTest {
+	t.Helper()
+
+	at := &alertsTest{
+		t:     t,
+		dir:   t.TempDir(),
+		fivem: &fakeFiveM{},
+		hook:  &webhookReceiver{statuses: statuses, payloads: make(chan webhookPayload, 10)},
+	}
+	fivemServer := httptest.NewServer(at.fivem)
+	t.Cleanup(fivemServer.Close)
+	hookServer := httptest.NewServer(at.hook)
+	t.Cleanup(hookServer.Close)
+
+	servers := []*FiveMServer{{Name: "a", URL: fivemServer.URL, Interval: "1s"}}
+	config := `{"webhooks": [{"name": "discord", "url": "` + hookServer.URL + `"}], "rules": ` + rules + `}`
+	if err := os.WriteFile(filepath.Join(at.dir, "alerts.json"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := OpenSessionStore(filepath.Join(at.dir, "sessions.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sessions.Close() })
+
+	at.start()
+	at.server = NewPlayerTracker(servers, sessions, at.alerter).servers[0]
+	return at
+}
+
+// start opens the alerter on the state file, as a server restart does.
+func (at *alertsTest) start() {
+	at.t.Helper()
+
+	config, err := LoadAlerts(filepath.Join(at.dir, "alerts.json"), []*FiveMServer{{Name: "a"}})
+	if err != nil {
+		at.t.Fatal(err)
+	}
+	at.alerter, err = NewAlerter(config, filepath.Join(at.dir, "alert-state.json"))
+	if err != nil {
+		at.t.Fatal(err)
+	}
+	alerter := at.alerter
+	go alerter.Run()
+	at.t.Cleanup(func() { close(alerter.queue) })
+	if at.server != nil {
+		at.server.alerts = at.alerter
+	}
+}
+
+func (at *alertsTest) poll(online int, down bool) {
+	at.fivem.set(online, down)
+	at.server.poll()
+}
+
+func (at *alertsTest) expect(content, description string) {
+	at.t.Helper()
+
+	select {
+	case payload := <-at.hook.payloads:
+		if payload.Content != content {
+			at.t.Fatalf("got webhook message %q, want %q", payload.Content, content)
+		}
+		if len(payload.Embeds) != 1 || !strings.Contains(payload.Embeds[0].Description, description) {
+			at.t.Fatalf("got webhook embeds %+v, want a description with %q", payload.Embeds, description)
+		}
+	case <-time.After(5 * time.Second):
+		at.t.Fatalf("no webhook message, want %q", content)
+	}
+}
+
+func (at *alertsTest) expectNothing() {
+	at.t.Helper()
+
+	select {
+	case payload := <-at.hook.payloads:
+		at.t.Fatalf("got webhook message %q, want none", payload.Content)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAlertDownAndRecovery(t *testing.T) {
+	at := newAlertsTest(t, `[{"name": "outage", "type": "down", "for": "0s"}]`)
+
+	at.poll(5, false)
+	at.expectNothing()
+
+	at.poll(0, true)
+	at.expect("Alert: outage", "FiveM server a is down since")
+	at.poll(0, true)
+	at.expectNothing()
+
+	at.poll(5, false)
+	at.expect("Resolved: outage", "is back up after")
+	if firing := at.alerter.Firing(); len(firing) != 0 {
+		t.Fatalf("got firing alerts %+v after recovery, want none", firing)
+	}
+}
+
+func TestAlertDownNotRepeatedAfterRestart(t *testing.T) {
+	at := newAlertsTest(t, `[{"name": "outage", "type": "down", "for": "0s"}]`)
+
+	at.poll(0, true)
+	at.expect("Alert: outage", "is down")
+
+	at.start()
+	if firing := at.alerter.Firing(); len(firing) != 1 || firing[0].Rule != "outage" {
+		t.Fatalf("got firing alerts %+v after restart, want outage", firing)
+	}
+	at.poll(0, true)
+	at.expectNothing()
+
+	at.poll(3, false)
+	at.expect("Resolved: outage", "with 3 players")
+}
+
+func TestAlertDrop(t *testing.T) {
+	at := newAlertsTest(t, `[{"name": "drop", "type": "drop", "percent": 50, "min_players": 4}]`)
+
+	at.poll(10, false)
+	at.poll(6, false)
+	at.expectNothing()
+
+	at.poll(4, false)
+	at.expect("Alert: drop", "dropped 60% from 10 to 4")
+	at.poll(2, false)
+	at.expectNothing()
+
+	// Resolves halfway back, at 75% of the baseline.
+	at.poll(7, false)
+	at.expectNothing()
+	at.poll(8, false)
+	at.expect("Resolved: drop", "recovered to 8 of 10")
+}
+
+func TestAlertDropNotFiredAfterOutage(t *testing.T) {
+	at := newAlertsTest(t, `[{"name": "drop", "type": "drop", "percent": 50}]`)
+
+	at.poll(10, false)
+	at.poll(0, true)
+	at.poll(0, false)
+	at.expectNothing()
+
+	at.poll(10, false)
+	at.poll(1, false)
+	at.expect("Alert: drop", "from 10 to 1")
+}
+
+func TestAlertWebhookRetries(t *testing.T) {
+	at := newAlertsTest(t, `[{"name": "outage", "type": "down", "for": "0s"}]`, http.StatusBadGateway, http.StatusTooManyRequests)
+
+	at.poll(0, true)
+	at.expect("Alert: outage", "is down")
+
+	at.hook.mu.Lock()
+	defer at.hook.mu.Unlock()
+	if at.hook.attempts != 3 {
+		t.Fatalf("got %d webhook attempts, want 3", at.hook.attempts)
+	}
+}
+
+func TestAlertWebhookClientError(t *testing.T) {
+	at := newAlertsTest(t, `[]`, http.StatusNotFound)
+
+	webhook := at.alerter.config.Webhooks[0]
+	if err := at.alerter.deliver(webhook, &webhookPayload{Content: "test"}); err == nil {
+		t.Fatal("got no error delivering to a missing webhook")
+	}
+
+	at.hook.mu.Lock()
+	defer at.hook.mu.Unlock()
+	if at.hook.attempts != 1 {
+		t.Fatalf("got %d webhook attempts, want 1", at.hook.attempts)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName = "fivem_session"
+	sessionTTL        = 12 * time.Hour
+
+	// An address failing to log in loginMaxFailures times within
+	// loginFailureWindow has to wait for the window to pass.
+	loginMaxFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+
+	passwordHashScheme     = "pbkdf2-sha256"
+	passwordHashIterations = 600000
+)
+
+// Operator is a person allowed to watch the broadcast stream and send
+// commands to agents. Credentials are stored hashed, see hashPassword and
+// hashToken.
+type Operator struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash,omitempty"`
+	TokenHashes  []string `json:"token_hashes,omitempty"`
+}
+
+type session struct {
+	operator *Operator
+	expires  time.Time
+}
+
+type loginFailures struct {
+	count int
+	since time.Time
+}
+
+type Auth struct {
+	operators []*Operator
+
+	sessions   map[string]*session
+	sessionsMu sync.Mutex
+
+	failures   map[string]*loginFailures
+	failuresMu sync.Mutex
+
+	audit   *os.File
+	auditMu sync.Mutex
+}
+
+func LoadAuth(operatorsPath, auditPath string) (*Auth, error) {
+	a := &Auth{sessions: make(map[string]*session), failures: make(map[string]*loginFailures)}
+
+	b, err := os.ReadFile(operatorsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read operators file: %w", err)
+	}
+
+	var config struct {
+		Operators []*Operator `json:"operators"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("failed to decode operators file: %w", err)
+	}
+
+	for _, op := range config.Operators {
+		if op.Username == "" {
+			return nil, fmt.Errorf("operator without username in %s", operatorsPath)
+		}
+		if op.PasswordHash == "" && len(op.TokenHashes) == 0 {
+			return nil, fmt.Errorf("operator %s has no password or token", op.Username)
+		}
+	}
+	a.operators = config.Operators
+
+	if a.audit, err = os.OpenFile(auditPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			a.sessionsMu.Lock()
+			for id, s := range a.sessions {
+				if time.Now().After(s.expires) {
+					delete(a.sessions, id)
+				}
+			}
+			a.sessionsMu.Unlock()
+
+			a.failuresMu.Lock()
+			for ip, f := range a.failures {
+				if time.Since(f.since) > loginFailureWindow {
+					delete(a.failures, ip)
+				}
+			}
+			a.failuresMu.Unlock()
+		}
+	}()
+
+	return a, nil
+}
+
+func (a *Auth) Close() error {
+	return a.audit.Close()
+}
+
+// Operator returns the operator authenticated by the request's bearer token
+// or session cookie, or nil. Tokens are not taken from the query, where they
+// would end up in logs and Referer headers.
+func (a *Auth) Operator(r *http.Request) *Operator {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		hash := hashToken(token)
+		for _, op := range a.operators {
+			for _, h := range op.TokenHashes {
+				if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+					return op
+				}
+			}
+		}
+		return nil
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+
+	s, ok := a.sessions[cookie.Value]
+	if !ok || time.Now().After(s.expires) {
+		return nil
+	}
+	return s.operator
+}
+
+func (a *Auth) login(username, password string) *Operator {
+	for _, op := range a.operators {
+		if op.Username == username && op.PasswordHash != "" {
+			if verifyPassword(op.PasswordHash, password) {
+				return op
+			}
+			return nil
+		}
+	}
+	// Burn the same time as a real check so usernames can't be probed.
+	_ = verifyPassword(passwordHashScheme+"$"+strconv.Itoa(passwordHashIterations)+"$AAAA$AAAA", password)
+	return nil
+}
+
+// RequireOperator rejects unauthenticated requests. Browsers asking for a
+// page are sent to the login form, everything else gets a 401.
+func (a *Auth) RequireOperator(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Operator(r) != nil {
+			next(w, r)
+			return
+		}
+
+		if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fivem-tools"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+func (a *Auth) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/chat"
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+		htmlContent, err := staticFS.ReadFile("static/login.html")
+		if err != nil {
+			http.Error(w, "failed to load login.html", http.StatusInternalServerError)
+			return
+		}
+
+		_, _ = w.Write(htmlContent)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := remoteIP(r)
+	if retryAfter := a.loginBlocked(ip); retryAfter > 0 {
+		log.Printf("refused login for %q from %s after too many failures", r.PostFormValue("username"), ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	op := a.login(r.PostFormValue("username"), r.PostFormValue("password"))
+	if op == nil {
+		log.Printf("failed login for %q from %s", r.PostFormValue("username"), ip)
+		a.loginFailed(ip)
+		time.Sleep(time.Second)
+		http.Redirect(w, r, "/login?error=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+	a.loginSucceeded(ip)
+
+	id := rand.Text()
+	a.sessionsMu.Lock()
+	a.sessions[id] = &session{operator: op, expires: time.Now().Add(sessionTTL)}
+	a.sessionsMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || (viaTrustedProxy(r) && r.Header.Get("X-Forwarded-Proto") == "https"),
+		SameSite: http.SameSiteStrictMode,
+	})
+	a.Audit(op, r, "login")
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// loginBlocked returns how long ip has to wait before trying to log in
+// again, or 0.
+func (a *Auth) loginBlocked(ip string) time.Duration {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	f, ok := a.failures[ip]
+	if !ok || f.count < loginMaxFailures {
+		return 0
+	}
+	return max(0, loginFailureWindow-time.Since(f.since))
+}
+
+func (a *Auth) loginFailed(ip string) {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	f, ok := a.failures[ip]
+	if !ok || time.Since(f.since) > loginFailureWindow {
+		f = &loginFailures{since: time.Now()}
+		a.failures[ip] = f
+	}
+	f.count++
+}
+
+func (a *Auth) loginSucceeded(ip string) {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	delete(a.failures, ip)
+}
+
+func (a *Auth) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		a.sessionsMu.Lock()
+		delete(a.sessions, cookie.Value)
+		a.sessionsMu.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// Audit records that op did something, both in the server log and in the
+// JSON lines audit log.
+func (a *Auth) Audit(op *Operator, r *http.Request, command string) {
+	entry := struct {
+		Time     time.Time `json:"time"`
+		Operator string    `json:"operator"`
+		IP       string    `json:"ip"`
+		Command  string    `json:"command"`
+	}{time.Now(), op.Username, remoteIP(r), command}
+
+	log.Printf("[audit] %s (%s): %s", entry.Operator, entry.IP, entry.Command)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("failed to encode audit entry: %v", err)
+		return
+	}
+
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+
+	if _, err := a.audit.Write(append(b, '\n')); err != nil {
+		log.Printf("failed to write audit entry: %v", err)
+	}
+}
+
+// checkOrigin lets agents (which send no Origin) through and otherwise only
+// accepts browsers on the same host.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// trustedProxies are the reverse proxies whose Cf-Connecting-Ip and
+// X-Real-Ip headers name the client, see ParseTrustedProxies.
+var trustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or addresses.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", v, err)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+// remoteIP returns the address of the client, as told by a trusted proxy
+// when the request came through one.
+func remoteIP(r *http.Request) string {
+	if viaTrustedProxy(r) {
+		for _, header := range []string{"Cf-Connecting-Ip", "X-Real-Ip"} {
+			if ip := net.ParseIP(strings.TrimSpace(r.Header.Get(header))); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// viaTrustedProxy reports whether r came from one of the trustedProxies,
+// whose headers can be believed.
+func viaTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, _ = rand.Read(salt)
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, 32)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		passwordHashScheme,
+		strconv.Itoa(passwordHashIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+func verifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// runHashPassword reads a password from stdin and prints its hash for use in
+// the operators file.
+func runHashPassword() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("failed to read password: %v", err)
+	}
+
+	hash, err := hashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		log.Fatalf("failed to hash password: %v", err)
+	}
+	fmt.Println(hash)
+}
+
+// runNewToken prints a fresh API token and the hash to put in the operators
+// file.
+func runNewToken() {
+	token := rand.Text()
+	fmt.Printf("token: %s\ntoken_hash: %s\n", token, hashToken(token))
+}
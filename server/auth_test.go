@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prev []*net.IPNet) { trustedProxies = prev }(trustedProxies)
+	trustedProxies = proxies
+
+	tests := []struct {
+		remoteAddr string
+		header     string
+		value      string
+		want       string
+	}{
+		{"203.0.113.7:1234", "", "", "203.0.113.7"},
+		{"203.0.113.7:1234", "Cf-Connecting-Ip", "198.51.100.1", "203.0.113.7"},
+		{"203.0.113.7:1234", "X-Real-Ip", "198.51.100.1", "203.0.113.7"},
+		{"10.1.2.3:1234", "Cf-Connecting-Ip", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:1234", "X-Real-Ip", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:1234", "X-Real-Ip", "not an address", "10.1.2.3"},
+		{"[::1]:1234", "Cf-Connecting-Ip", "2001:db8::1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := remoteIP(r); got != tt.want {
+			t.Errorf("remoteIP from %s with %s %q = %q, want %q", tt.remoteAddr, tt.header, tt.value, got, tt.want)
+		}
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parsed an invalid CIDR")
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	login := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"nobody"}, "password": {password}}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.0.2.99:1234"
+		w := httptest.NewRecorder()
+		auth.LoginHandler(w, r)
+		return w
+	}
+
+	for i := range loginMaxFailures {
+		if w := login("wrong"); w.Code != http.StatusSeeOther {
+			t.Fatalf("failed login %d got status %d, want %d", i+1, w.Code, http.StatusSeeOther)
+		}
+	}
+	w := login("wrong")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("got status %d with Retry-After %q, want %d", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	auth.loginSucceeded("192.0.2.99")
+	if w := login("wrong"); w.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d after the failures were cleared, want %d", w.Code, http.StatusSeeOther)
+	}
+}
+
+func TestOperatorToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/agents", nil)
+	r.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	if op := auth.Operator(r); op == nil || op.Username != "tester" {
+		t.Fatalf("got operator %+v for the bearer token, want tester", op)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/agents?token="+url.QueryEscape(testOperatorToken), nil)
+	if op := auth.Operator(r); op != nil {
+		t.Fatalf("got operator %s for a token in the query", op.Username)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+)
+
+var (
+	errAgentRevoked       = errors.New("machine has been revoked")
+	errAgentKeyMismatch   = errors.New("machine is enrolled with a different key")
+	errAgentBadSignature  = errors.New("invalid registration signature")
+	errAgentBadPublicKey  = errors.New("invalid public key")
+	errEnrollmentNotFound = errors.New("machine is not enrolled")
+	errAgentUnsigned      = errors.New("request is not signed")
+	errAgentRequestStale  = errors.New("request timestamp is too far off")
+	errAgentBadMachineID  = errors.New("invalid machine ID")
+	errEnrollmentLimit    = errors.New("too many new machines, try again later")
+
+	machineIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+)
+
+// agentRequestMaxSkew is how far the timestamp of a signed agent request
+// may be off, bounding how long it can be replayed.
+const agentRequestMaxSkew = 5 * time.Minute
+
+const (
+	// Machines enrolled per window at most, as anyone who connects can
+	// enroll a machine ID.
+	maxNewEnrollments   = 20
+	newEnrollmentWindow = time.Minute
+
+	// How often changes of known machines, like when they were last seen,
+	// are saved. New enrollments are saved right away.
+	enrollmentSaveInterval = time.Minute
+)
+
+// Enrollment binds a machine ID to the public key its agent generated on
+// first registration.
+type Enrollment struct {
+	MachineID  string     `json:"machine_id"`
+	PublicKey  string     `json:"public_key"`
+	Hostname   string     `json:"hostname"`
+	Username   string     `json:"username"`
+	EnrolledAt time.Time  `json:"enrolled_at"`
+	LastSeen   time.Time  `json:"last_seen"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type EnrollmentStore struct {
+	mu          sync.Mutex
+	path        string
+	enrollments map[string]*Enrollment
+	// dirty is set when enrollments changed since the last save.
+	dirty bool
+
+	newSince time.Time
+	newCount int
+
+	key ed25519.PrivateKey
+}
+
+func OpenEnrollmentStore(path, keyPath string) (*EnrollmentStore, error) {
+	s := &EnrollmentStore{path: path, enrollments: make(map[string]*Enrollment)}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read enrollments: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.enrollments); err != nil {
+			return nil, fmt.Errorf("failed to decode enrollments: %w", err)
+		}
+	}
+
+	if s.key, err = loadOrCreateServerKey(keyPath); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func loadOrCreateServerKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(path)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid server key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read server key: %w", err)
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate server key: %w", err)
+	}
+	if err := os.WriteFile(path, key.Seed(), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write server key: %w", err)
+	}
+	log.Printf("Generated server key %s", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	return key, nil
+}
+
+// PublicKey is the key agents pin to recognise this server.
+func (s *EnrollmentStore) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+func (s *EnrollmentStore) NewChallenge() string {
+	return base64.StdEncoding.EncodeToString([]byte(rand.Text()))
+}
+
+// SignRegistration proves to the agent that it reached the server holding
+// the pinned key.
+func (s *EnrollmentStore) SignRegistration(machineID, clientNonce string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, protocol.ServerRegistrationMessage(machineID, clientNonce)))
+}
+
+// Verify checks a registration against the challenge sent on this connection.
+// Unknown machines are enrolled with the presented key.
+func (s *EnrollmentStore) Verify(machineID, hostname, username, publicKey, nonce, signature string) error {
+	if !machineIDPattern.MatchString(machineID) {
+		return errAgentBadMachineID
+	}
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errAgentBadPublicKey
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(pub, protocol.AgentRegistrationMessage(machineID, nonce), sig) {
+		return errAgentBadSignature
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrollments[machineID]
+	if ok && e.RevokedAt != nil {
+		return errAgentRevoked
+	}
+	if ok && e.PublicKey != publicKey {
+		return errAgentKeyMismatch
+	}
+	if ok {
+		e.Hostname = hostname
+		e.Username = username
+		e.LastSeen = time.Now()
+		s.dirty = true
+		return nil
+	}
+
+	if time.Since(s.newSince) > newEnrollmentWindow {
+		s.newSince = time.Now()
+		s.newCount = 0
+	}
+	if s.newCount >= maxNewEnrollments {
+		return errEnrollmentLimit
+	}
+	now := time.Now()
+	s.enrollments[machineID] = &Enrollment{MachineID: machineID, PublicKey: publicKey, Hostname: hostname, Username: username, EnrolledAt: now, LastSeen: now}
+	if err := s.save(); err != nil {
+		delete(s.enrollments, machineID)
+		return err
+	}
+	s.newCount++
+	log.Printf("Enrolled machine ID: %s", machineID)
+	return nil
+}
+
+// VerifyRequest checks that r, whose body is body, was signed with the key
+// of an enrolled machine and returns its machine ID.
+func (s *EnrollmentStore) VerifyRequest(r *http.Request, body []byte) (string, error) {
+	machineID := r.Header.Get(protocol.HeaderMachineID)
+	timestamp := r.Header.Get(protocol.HeaderTimestamp)
+	signature := r.Header.Get(protocol.HeaderSignature)
+	if machineID == "" || timestamp == "" || signature == "" {
+		return "", errAgentUnsigned
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errAgentRequestStale
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > agentRequestMaxSkew || skew < -agentRequestMaxSkew {
+		return "", errAgentRequestStale
+	}
+
+	e, ok := s.Get(machineID)
+	if !ok {
+		return "", errEnrollmentNotFound
+	}
+	if e.RevokedAt != nil {
+		return "", errAgentRevoked
+	}
+	pub, err := base64.StdEncoding.DecodeString(e.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return "", errAgentBadPublicKey
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(pub, protocol.AgentRequestMessage(machineID, r.Method, r.URL.RequestURI(), timestamp, body), sig) {
+		return "", errAgentBadSignature
+	}
+	return machineID, nil
+}
+
+func (s *EnrollmentStore) List() []Enrollment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]Enrollment, 0, len(s.enrollments))
+	for _, e := range s.enrollments {
+		items = append(items, *e)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].EnrolledAt.Before(items[j].EnrolledAt) })
+	return items
+}
+
+func (s *EnrollmentStore) Get(machineID string) (Enrollment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrollments[machineID]
+	if !ok {
+		return Enrollment{}, false
+	}
+	return *e, true
+}
+
+// Revoke rejects every future registration of machineID until it is
+// re-enrolled.
+func (s *EnrollmentStore) Revoke(machineID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrollments[machineID]
+	if !ok {
+		return errEnrollmentNotFound
+	}
+	now := time.Now()
+	e.RevokedAt = &now
+	return s.save()
+}
+
+// Reenroll forgets the key of machineID so the next registration enrolls
+// whatever key it presents.
+func (s *EnrollmentStore) Reenroll(machineID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.enrollments[machineID]; !ok {
+		return errEnrollmentNotFound
+	}
+	delete(s.enrollments, machineID)
+	return s.save()
+}
+
+// Flush saves changes not saved yet.
+func (s *EnrollmentStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+func runEnrollmentSaver(s *EnrollmentStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.Flush(); err != nil {
+			log.Printf("failed to save enrollments: %v", err)
+		}
+	}
+}
+
+func (s *EnrollmentStore) save() error {
+	b, err := json.MarshalIndent(s.enrollments, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode enrollments: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("failed to write enrollments: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace enrollments: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *EnrollmentStore) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(map[string]any{"items": s.List()}); err != nil {
+		log.Printf("failed to encode enrollments: %v\n", err)
+	}
+}
+
+// enrollmentActionHandler serves an operator action on the machine_id given
+// in the query, like revoke or re-enroll.
+func enrollmentActionHandler(name string, action func(machineID string) error, onDone func(machineID string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		machineID := r.URL.Query().Get("machine_id")
+		if machineID == "" {
+			http.Error(w, "machine_id is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := action(machineID); err != nil {
+			if errors.Is(err, errEnrollmentNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to %s %s: %v", name, machineID, err)
+			http.Error(w, "failed to "+name, http.StatusInternalServerError)
+			return
+		}
+
+		if op := auth.Operator(r); op != nil {
+			auth.Audit(op, r, name+" "+machineID)
+		}
+		if onDone != nil {
+			onDone(machineID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
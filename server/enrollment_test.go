@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+)
+
+func openEnrollmentTest(t *testing.T, dir string) *EnrollmentStore {
+	t.Helper()
+
+	s, err := OpenEnrollmentStore(filepath.Join(dir, "enrollments.json"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func verifyEnrollment(s *EnrollmentStore, machineID, hostname string, key ed25519.PrivateKey) error {
+	publicKey := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, protocol.AgentRegistrationMessage(machineID, "nonce")))
+	return s.Verify(machineID, hostname, "user", publicKey, "nonce", signature)
+}
+
+func TestEnrollmentMachineID(t *testing.T) {
+	s := openEnrollmentTest(t, t.TempDir())
+	key := newAgentKey(t)
+
+	if err := verifyEnrollment(s, strings.Repeat("0123456789abcdef", 4), "host", key); err != nil {
+		t.Fatal(err)
+	}
+	for _, machineID := range []string{"", "../x", "a b", "a\nb", strings.Repeat("a", 129)} {
+		if err := verifyEnrollment(s, machineID, "host", key); !errors.Is(err, errAgentBadMachineID) {
+			t.Errorf("machine ID %q: got %v, want %v", machineID, err, errAgentBadMachineID)
+		}
+	}
+}
+
+func TestEnrollmentLimit(t *testing.T) {
+	s := openEnrollmentTest(t, t.TempDir())
+	key := newAgentKey(t)
+
+	for i := range maxNewEnrollments {
+		if err := verifyEnrollment(s, fmt.Sprintf("m%d", i), "host", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := verifyEnrollment(s, "over", "host", key); !errors.Is(err, errEnrollmentLimit) {
+		t.Fatalf("got %v, want %v", err, errEnrollmentLimit)
+	}
+	// Known machines still register.
+	if err := verifyEnrollment(s, "m0", "host", key); err != nil {
+		t.Fatal(err)
+	}
+
+	s.newSince = time.Now().Add(-2 * newEnrollmentWindow)
+	if err := verifyEnrollment(s, "over", "host", key); err != nil {
+		t.Fatalf("got %v after the window", err)
+	}
+}
+
+func TestEnrollmentSave(t *testing.T) {
+	dir := t.TempDir()
+	s := openEnrollmentTest(t, dir)
+	key := newAgentKey(t)
+
+	// New enrollments are saved right away.
+	if err := verifyEnrollment(s, "m", "host", key); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := openEnrollmentTest(t, dir).Get("m"); !ok || e.Hostname != "host" {
+		t.Fatalf("got %+v, want the enrollment saved", e)
+	}
+
+	// Registrations of known machines are saved by Flush.
+	if err := verifyEnrollment(s, "m", "renamed", key); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := openEnrollmentTest(t, dir).Get("m"); e.Hostname != "host" {
+		t.Fatalf("got hostname %q saved before flushing", e.Hostname)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := openEnrollmentTest(t, dir).Get("m"); e.Hostname != "renamed" {
+		t.Fatalf("got hostname %q after flushing, want renamed", e.Hostname)
+	}
+
+	// A machine whose enrollment cannot be saved is not enrolled.
+	if err := os.Mkdir(s.path+".tmp", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyEnrollment(s, "unsaved", "host", key); err == nil {
+		t.Fatal("enrolled a machine without saving it")
+	}
+	if _, ok := s.Get("unsaved"); ok {
+		t.Fatal("kept the unsaved enrollment")
+	}
+}
@@ -2,4 +2,9 @@ module github.com/willywotz/fivem/server
 
 go 1.24.3
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/willywotz/fivem v0.0.0
+)
+
+replace github.com/willywotz/fivem => ../
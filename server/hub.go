@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willywotz/fivem/protocol"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Connections that miss pings for pongWait are considered dead.
+	pongWait = 60 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// Connections have to register as an agent before sending more than
+	// this.
+	maxUnregisteredMessageSize = 64 << 10
+
+	// Registered agents send files in chunks of at most
+	// protocol.MaxChunkSize, plus the frame header.
+	maxAgentMessageSize = protocol.MaxChunkSize + 64<<10
+
+	// Agents from before chunked uploads send screenshots inline; results
+	// of several 4K displays fit comfortably.
+	maxInlineMessageSize = 64 << 20
+
+	// Messages queued for a client before it is dropped as a slow consumer.
+	sendQueueSize = 256
+)
+
+type outbound struct {
+	messageType int
+	data        []byte
+}
+
+// Client is one /ws connection, either an agent or an operator browser.
+// Only writePump writes to conn; everything else goes through Send.
+type Client struct {
+	hub      *Hub
+	conn     *websocket.Conn
+	request  *http.Request
+	operator *Operator
+
+	send      chan outbound
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newClient(hub *Hub, conn *websocket.Conn, r *http.Request, op *Operator) *Client {
+	return &Client{
+		hub:      hub,
+		conn:     conn,
+		request:  r,
+		operator: op,
+		send:     make(chan outbound, sendQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// Send queues env for the client. A client whose queue is full is closed
+// rather than allowed to hold up the sender.
+func (c *Client) Send(env *protocol.Envelope) bool {
+	b, err := env.Marshal()
+	if err != nil {
+		log.Printf("failed to encode %s message: %v", env.Type, err)
+		return false
+	}
+	return c.queue(outbound{websocket.TextMessage, b})
+}
+
+func (c *Client) queue(m outbound) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- m:
+		return true
+	default:
+		log.Printf("Dropping slow client %s", c.request.RemoteAddr)
+		c.Close()
+		return false
+	}
+}
+
+// CloseWith sends a close frame after the messages already queued.
+func (c *Client) CloseWith(code int, reason string) {
+	c.queue(outbound{websocket.CloseMessage, websocket.FormatCloseMessage(code, reason)})
+}
+
+func (c *Client) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = c.conn.Close()
+	}()
+
+	for {
+		select {
+		case m := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(m.messageType, m.data); err != nil {
+				log.Printf("Error writing message to %s: %v", c.request.RemoteAddr, err)
+				c.Close()
+				return
+			}
+			if m.messageType == websocket.CloseMessage {
+				c.Close()
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			_ = c.conn.WriteMessage(websocket.CloseMessage, nil)
+			return
+		}
+	}
+}
+
+// Hub keeps the set of connected clients.
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[*Client]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{clients: make(map[*Client]struct{})}
+}
+
+func (h *Hub) Register(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.clients[c] = struct{}{}
+}
+
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+
+	c.Close()
+}
+
+func (h *Hub) Connected(c *Client) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, ok := h.clients[c]
+	return ok
+}
+
+// Broadcast sends env to every operator.
+func (h *Hub) Broadcast(env *protocol.Envelope) {
+	b, err := env.Marshal()
+	if err != nil {
+		log.Printf("failed to encode %s message: %v", env.Type, err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.clients {
+		if c.operator != nil {
+			c.queue(outbound{websocket.TextMessage, b})
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/fivem"
+)
+
+var errLinkNotFound = errors.New("machine is not linked to the identifier")
+
+// agentLinkMaxAge is how long a link an agent reported lasts without being
+// reported again. Agents find identifiers only while the player is signed
+// in, so a registration without them does not unlink them.
+const agentLinkMaxAge = 90 * 24 * time.Hour
+
+// Sources of links.
+const (
+	LinkSourceAgent    = "agent"
+	LinkSourceOperator = "operator"
+)
+
+// Link ties a machine to a FiveM player identifier, so the players page can
+// tell who runs the agent. Agents report the identifiers they find when
+// they register; operators link the rest.
+type Link struct {
+	MachineID  string    `json:"machine_id"`
+	Identifier string    `json:"identifier"`
+	Source     string    `json:"source"`
+	LinkedBy   string    `json:"linked_by,omitempty"`
+	LinkedAt   time.Time `json:"linked_at"`
+	// ReportedAt is when the agent last reported the identifier, to the day.
+	ReportedAt time.Time `json:"reported_at,omitempty"`
+	// RemovedAt is set when an operator unlinked an identifier the agent
+	// reported, which keeps the agent from linking it again.
+	RemovedAt *time.Time `json:"removed_at,omitempty"`
+
+	// Hostname and Version are from the last registration of the machine.
+	Hostname string `json:"hostname,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+type LinkStore struct {
+	mu    sync.Mutex
+	path  string
+	links []*Link
+}
+
+func OpenLinkStore(path string) (*LinkStore, error) {
+	s := &LinkStore{path: path, links: make([]*Link, 0)}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read links: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.links); err != nil {
+			return nil, fmt.Errorf("failed to decode links: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *LinkStore) find(machineID, identifier string) *Link {
+	for _, l := range s.links {
+		if l.MachineID == machineID && l.Identifier == identifier {
+			return l
+		}
+	}
+	return nil
+}
+
+// Report records the registration of machineID, with the identifiers its
+// agent found. Identifiers agents stopped reporting are unlinked after
+// agentLinkMaxAge, unless an operator linked them.
+func (s *LinkStore) Report(machineID, hostname, version string, identifiers []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	changed := false
+	s.links = slices.DeleteFunc(s.links, func(l *Link) bool {
+		remove := l.Source == LinkSourceAgent && l.RemovedAt == nil && now.Sub(l.lastReported()) > agentLinkMaxAge
+		changed = changed || remove
+		return remove
+	})
+	for _, id := range identifiers {
+		if !fivem.ValidIdentifier(id) {
+			continue
+		}
+		if l := s.find(machineID, id); l != nil {
+			if l.Source == LinkSourceAgent && now.Sub(l.lastReported()) >= 24*time.Hour {
+				l.ReportedAt = now
+				changed = true
+			}
+			continue
+		}
+		s.links = append(s.links, &Link{MachineID: machineID, Identifier: id, Source: LinkSourceAgent, LinkedAt: now, ReportedAt: now})
+		changed = true
+	}
+	for _, l := range s.links {
+		if l.MachineID == machineID && (l.Hostname != hostname || l.Version != version) {
+			l.Hostname, l.Version = hostname, version
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// lastReported is when the agent last reported the identifier of l, links
+// from before ReportedAt go by when they were made.
+func (l *Link) lastReported() time.Time {
+	if l.ReportedAt.IsZero() {
+		return l.LinkedAt
+	}
+	return l.ReportedAt
+}
+
+// Link ties machineID to identifier on behalf of an operator.
+func (s *LinkStore) Link(machineID, identifier, operator string) (*Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.find(machineID, identifier)
+	if l == nil {
+		l = &Link{MachineID: machineID, Identifier: identifier}
+		if e, ok := enrollments.Get(machineID); ok {
+			l.Hostname = e.Hostname
+		}
+		if info, _, ok := agents.Get(machineID); ok {
+			l.Hostname, l.Version = info.Hostname, info.Version
+		}
+		s.links = append(s.links, l)
+	}
+	l.Source = LinkSourceOperator
+	l.LinkedBy = operator
+	l.LinkedAt = time.Now()
+	l.RemovedAt = nil
+
+	v := *l
+	return &v, s.save()
+}
+
+// Unlink removes the link of machineID to identifier.
+func (s *LinkStore) Unlink(machineID, identifier string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.find(machineID, identifier)
+	if l == nil || l.RemovedAt != nil {
+		return errLinkNotFound
+	}
+	if l.Source == LinkSourceAgent {
+		now := time.Now()
+		l.RemovedAt = &now
+	} else {
+		s.links = slices.DeleteFunc(s.links, func(other *Link) bool { return other == l })
+	}
+	return s.save()
+}
+
+func (s *LinkStore) List() []Link {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	links := make([]Link, 0, len(s.links))
+	for _, l := range s.links {
+		links = append(links, *l)
+	}
+	return links
+}
+
+// PlayerAgent is the agent of a player, found through a link.
+type PlayerAgent struct {
+	MachineID string `json:"machine_id,omitempty"`
+	Hostname  string `json:"hostname,omitempty"`
+	Version   string `json:"version"`
+	// Connected tells whether the agent is connected, with Version as
+	// registered now rather than last time.
+	Connected bool `json:"connected"`
+	// Verified is set for links an operator made. Agents only claim the
+	// identifiers they report, which nothing proves.
+	Verified bool `json:"verified"`
+}
+
+// better reports whether the agent a is shown rather than b: a verified
+// link goes first, then a connected agent.
+func (a *PlayerAgent) better(b *PlayerAgent) bool {
+	if a.Verified != b.Verified {
+		return a.Verified
+	}
+	return a.Connected && !b.Connected
+}
+
+// Annotate sets the agent of the players linked to a machine, preferring
+// a verified link, then a connected agent. The players are replaced by
+// copies.
+func (s *LinkStore) Annotate(players []*Player) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, p := range players {
+		var agent *PlayerAgent
+		for _, l := range s.links {
+			if l.RemovedAt != nil || (l.Identifier != p.Key && !slices.Contains(p.Identifiers, l.Identifier)) {
+				continue
+			}
+			candidate := &PlayerAgent{MachineID: l.MachineID, Hostname: l.Hostname, Version: l.Version, Verified: l.Source == LinkSourceOperator}
+			if info, _, ok := agents.Get(l.MachineID); ok {
+				candidate.Hostname, candidate.Version, candidate.Connected = info.Hostname, info.Version, true
+			}
+			if agent == nil || candidate.better(agent) {
+				agent = candidate
+			}
+		}
+
+		annotated := *p
+		annotated.Agent = agent
+		players[i] = &annotated
+	}
+}
+
+func (s *LinkStore) save() error {
+	b, err := json.MarshalIndent(s.links, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode links: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("failed to write links: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace links: %w", err)
+	}
+	return nil
+}
+
+// ListHandler returns the links, of ?machine_id= when given.
+func (s *LinkStore) ListHandler(w http.ResponseWriter, r *http.Request) {
+	links := s.List()
+	if machineID := r.URL.Query().Get("machine_id"); machineID != "" {
+		links = slices.DeleteFunc(links, func(l Link) bool { return l.MachineID != machineID })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(map[string]any{"items": links}); err != nil {
+		log.Printf("failed to encode links: %v\n", err)
+	}
+}
+
+// LinkHandler links {machine_id} to the player {identifier}.
+func (s *LinkStore) LinkHandler(w http.ResponseWriter, r *http.Request) {
+	machineID, identifier := r.PathValue("machine_id"), r.PathValue("identifier")
+	if !fivem.ValidIdentifier(identifier) {
+		http.Error(w, "identifier must look like steam:110000112345678", http.StatusBadRequest)
+		return
+	}
+	if _, ok := enrollments.Get(machineID); !ok {
+		http.Error(w, errEnrollmentNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	op := auth.Operator(r)
+	var username string
+	if op != nil {
+		username = op.Username
+	}
+	l, err := s.Link(machineID, identifier, username)
+	if err != nil {
+		log.Printf("failed to link %s to %s: %v", machineID, identifier, err)
+		http.Error(w, "failed to link", http.StatusInternalServerError)
+		return
+	}
+	if op != nil {
+		auth.Audit(op, r, "link "+machineID+" "+identifier)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		log.Printf("failed to encode link: %v\n", err)
+	}
+}
+
+// UnlinkHandler removes the link of {machine_id} to {identifier}.
+func (s *LinkStore) UnlinkHandler(w http.ResponseWriter, r *http.Request) {
+	machineID, identifier := r.PathValue("machine_id"), r.PathValue("identifier")
+	if err := s.Unlink(machineID, identifier); err != nil {
+		if errors.Is(err, errLinkNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("failed to unlink %s from %s: %v", machineID, identifier, err)
+		http.Error(w, "failed to unlink", http.StatusInternalServerError)
+		return
+	}
+	if op := auth.Operator(r); op != nil {
+		auth.Audit(op, r, "unlink "+machineID+" "+identifier)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
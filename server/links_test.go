@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/willywotz/fivem/fivem"
+)
+
+func TestAnnotateVerified(t *testing.T) {
+	s, err := OpenLinkStore(filepath.Join(t.TempDir(), "links.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const identifier = "steam:110000112345678"
+	player := &Player{Player: fivem.Player{Identifiers: []string{identifier}}}
+	annotate := func() *PlayerAgent {
+		players := []*Player{player}
+		s.Annotate(players)
+		return players[0].Agent
+	}
+
+	// Any agent can claim an identifier.
+	if err := s.Report("claimed", "host-claimed", "v1.0.0", []string{identifier}); err != nil {
+		t.Fatal(err)
+	}
+	if a := annotate(); a == nil || a.MachineID != "claimed" || a.Verified {
+		t.Fatalf("got agent %+v, want the unverified claim", a)
+	}
+
+	if _, err := s.Link("linked", identifier, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Report("other", "host-other", "v1.0.0", []string{identifier}); err != nil {
+		t.Fatal(err)
+	}
+	if a := annotate(); a == nil || a.MachineID != "linked" || !a.Verified {
+		t.Fatalf("got agent %+v, want the operator's link", a)
+	}
+}
+
+func TestReportKeepsLinks(t *testing.T) {
+	s, err := OpenLinkStore(filepath.Join(t.TempDir(), "links.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const identifier = "steam:110000112345678"
+	linked := func(machineID string) bool {
+		for _, l := range s.List() {
+			if l.MachineID == machineID && l.Identifier == identifier && l.RemovedAt == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := s.Report("agent", "host", "v1.0.0", []string{identifier}); err != nil {
+		t.Fatal(err)
+	}
+	// The service registers at boot, before the player signs in to Steam.
+	if err := s.Report("agent", "host", "v1.1.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !linked("agent") {
+		t.Fatal("a registration without identifiers unlinked the identifier")
+	}
+	if l := s.List()[0]; l.Version != "v1.1.0" {
+		t.Fatalf("got version %q, want the one of the last registration", l.Version)
+	}
+
+	// Links nobody reported for agentLinkMaxAge expire.
+	s.links[0].ReportedAt = time.Now().Add(-agentLinkMaxAge - time.Hour)
+	if err := s.Report("agent", "host", "v1.1.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	if linked("agent") {
+		t.Fatal("kept a link not reported for longer than agentLinkMaxAge")
+	}
+}
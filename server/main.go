@@ -1,210 +1,291 @@
 package main
 
 import (
-	"bytes"
+	"crypto/ed25519"
 	"embed"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
-	"strings"
-	"sync"
 	"text/template"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/willywotz/fivem/protocol"
+	"github.com/willywotz/fivem/releases"
 )
 
 //go:embed static/*
 var staticFS embed.FS
 
-var upgrader = websocket.Upgrader{
-	// ReadBufferSize:  1024,
-	// WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for simplicity in example.
-		// In production, tighten this for security!
-		// Example: return r.Host == "yourdomain.com" || r.Host == "www.yourdomain.com"
-		return true
-	},
-}
-
 var (
-	wsConnections               = make(map[*websocket.Conn]bool)
-	wsConnectionsMachineID      = make(map[string]*websocket.Conn)
-	wsConnectionsMachineIDMutex = &sync.Mutex{}
-	wsChannel                   = make(chan Message, 100)
+	auth        *Auth
+	enrollments *EnrollmentStore
+	agents      = NewRegistry()
+	uninstalls  = NewUninstalls()
+	screenshots *ScreenshotStore
+	uploads     *UploadStore
+	agentConfig *AgentConfigStore
+	rollouts    *RolloutStore
+
+	playerTracker *PlayerTracker
+	links         *LinkStore
+
+	releaseStore *ReleaseStore
+
+	transparency protocol.TransparencyPolicy
 )
 
-type Message struct {
-	Type int           `json:"type"`
-	Data *bytes.Buffer `json:"data"`
+type Status struct {
+	MachineID string `json:"machine_id"`
+	Hostname  string `json:"hostname"`
+	Username  string `json:"username"`
+	IP        string `json:"ip"`
+	Country   string `json:"country"`
+	From      string `json:"from"`
+	Status    string `json:"status"`
+	Version   string `json:"version"`
+
+	Time time.Time `json:"time"`
 }
 
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("failed to upgrade connection: %v", err)
-		return
+const (
+	// maxStatusSize bounds the body of a status posted to /status.
+	maxStatusSize = 4 << 10
+	// maxStatusFieldLength bounds each field of a posted status.
+	maxStatusFieldLength = 256
+)
+
+// validate checks the fields an agent posts to /status.
+func (s *Status) validate() error {
+	for name, v := range map[string]string{
+		"machine_id": s.MachineID,
+		"hostname":   s.Hostname,
+		"username":   s.Username,
+		"from":       s.From,
+		"status":     s.Status,
+		"version":    s.Version,
+	} {
+		if len(v) > maxStatusFieldLength {
+			return fmt.Errorf("%s is longer than %d bytes", name, maxStatusFieldLength)
+		}
 	}
-	defer func() {
-		delete(wsConnections, conn)
-		_ = conn.Close()
-	}()
+	return nil
+}
 
-	conn.SetPongHandler(func(appData string) error {
-		return nil
-	})
+var (
+	statusStoreKind     = flag.String("status-store", "file", "status store backend: file or memory")
+	statusStorePath     = flag.String("status-file", "status.jsonl", "path of the file status store")
+	statusMaxAge        = flag.Duration("status-max-age", 24*time.Hour, "drop statuses older than this (0 keeps all)")
+	statusMaxPerMachine = flag.Int("status-max-per-machine", 0, "keep at most this many statuses per machine (0 keeps all)")
+	statusPruneInterval = flag.Duration("status-prune-interval", 4*time.Hour, "how often the status retention policy is applied")
+
+	operatorsPath    = flag.String("operators", "operators.json", "path of the operators file")
+	auditLogPath     = flag.String("audit-log", "audit.jsonl", "path of the operator audit log")
+	hashPasswordFlag = flag.Bool("hash-password", false, "read a password from stdin, print its hash and exit")
+	newTokenFlag     = flag.Bool("new-token", false, "print a new operator API token with its hash and exit")
+
+	enrollmentsPath = flag.String("enrollments", "enrollments.json", "path of the agent enrollments file")
+	serverKeyPath   = flag.String("server-key", "server.key", "path of the server identity key, created if missing")
+	linksPath       = flag.String("links", "links.json", "path of the file linking machines to FiveM player identifiers")
+
+	screenshotsDir    = flag.String("screenshots", "screenshots", "directory where screenshots are stored")
+	screenshotsMaxAge = flag.Duration("screenshots-max-age", 30*24*time.Hour, "delete screenshots older than this (0 keeps all)")
+	uploadsDir        = flag.String("uploads", "uploads", "directory where chunked agent uploads are assembled")
+
+	remoteConfigPath = flag.String("remote-config", "remote-config.txt", "signed agent config record served at /config, see cmd/configsign")
+	agentConfigPath  = flag.String("agent-config", "agent-config.json", "path of the config pushed to agents over /ws")
+
+	releasesDir           = flag.String("releases", "releases", "directory of the release feed agents update from")
+	releasePublicKey      = flag.String("release-public-key", "", "base64 Ed25519 key release artifacts must be signed with, see cmd/releasesign (empty accepts unsigned artifacts)")
+	releaseMirror         = flag.String("release-mirror", "", "GitHub repository (owner/name) whose releases are copied into the feed, e.g. willywotz/fivem")
+	releaseMirrorInterval = flag.Duration("release-mirror-interval", 15*time.Minute, "how often the GitHub mirror is synced")
+
+	rolloutsPath          = flag.String("rollouts", "rollouts.json", "path of the release channels and rollouts file")
+	rolloutHealthTimeout  = flag.Duration("rollout-health-timeout", 30*time.Minute, "how long a machine assigned to a rollout may take to come up on its version")
+	rolloutMinFailures    = flag.Int("rollout-min-failures", 3, "pause a rollout once at least this many machines rolled back or did not come up on it")
+	rolloutMaxFailurePcnt = flag.Int("rollout-max-failure-percent", 20, "pause a rollout once at least this percentage of its machines rolled back or did not come up on it")
+
+	fivemServersPath = flag.String("fivem-servers", "fivem-servers.json", "FiveM servers whose players are tracked, see fivem-servers.example.json")
+	sessionsPath     = flag.String("sessions", "sessions.jsonl", "path of the player sessions file")
+	sessionsMaxAge   = flag.Duration("sessions-max-age", 90*24*time.Hour, "drop player sessions that ended longer ago than this (0 keeps all)")
+	alertsPath       = flag.String("alerts", "alerts.json", "alert rules and webhooks for FiveM outages and player drops, see alerts.example.json")
+	alertStatePath   = flag.String("alert-state", "alert-state.json", "path of the firing alerts file")
+
+	trustedProxiesFlag = flag.String("trusted-proxies", "127.0.0.1,::1", "comma separated CIDRs of reverse proxies whose Cf-Connecting-Ip and X-Real-Ip headers are trusted")
+
+	transparencyMode = flag.String("transparency", "off", "what users at agent machines are shown: off, notify (a notice per capture) or consent (notify, and ask before enrolling)")
+)
 
-	go func() {
-		for range time.Tick(5 * time.Second) {
-			_ = conn.WriteMessage(websocket.PingMessage, []byte("ping"))
-		}
-	}()
+func main() {
+	flag.Parse()
 
-	wsConnections[conn] = r.URL.Query().Get("b") == "true"
-	log.Printf("Client connected from %s", r.RemoteAddr)
+	if *hashPasswordFlag {
+		runHashPassword()
+		return
+	}
 
-	for {
-		messageType, p, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("Error reading message: %v", err)
-			break
-		}
+	if *newTokenFlag {
+		runNewToken()
+		return
+	}
 
-		if messageType == websocket.TextMessage && p != nil && string(p[:4]) == "ping" {
-			if err := conn.WriteMessage(websocket.PongMessage, []byte("pong")); err != nil {
-				log.Printf("Error writing pong message: %v", err)
-				break
-			}
-			continue
-		}
+	switch *transparencyMode {
+	case "off":
+	case "notify":
+		transparency = protocol.TransparencyPolicy{Notify: true}
+	case "consent":
+		transparency = protocol.TransparencyPolicy{Notify: true, RequireConsent: true}
+	default:
+		log.Fatalf("invalid transparency mode %q", *transparencyMode)
+	}
 
-		// if messageType == websocket.TextMessage && p != nil {
-		// 	log.Printf("Received message: %s", string(p))
-		// }
+	var err error
+	if trustedProxies, err = ParseTrustedProxies(*trustedProxiesFlag); err != nil {
+		log.Fatalf("failed to parse trusted proxies: %v", err)
+	}
 
-		if messageType == websocket.TextMessage && p != nil && string(p[:10]) == "screenshot" {
-			parts := strings.Split(string(p), " ")
-			if len(parts) < 2 {
-				_ = conn.WriteMessage(websocket.TextMessage, []byte("Invalid screenshot command"))
-				continue
-			}
+	if auth, err = LoadAuth(*operatorsPath, *auditLogPath); err != nil {
+		log.Fatalf("failed to load operators: %v", err)
+	}
+	defer func() { _ = auth.Close() }()
 
-			if parts[1][:3] == "all" {
-				wsConnectionsMachineIDMutex.Lock()
-				for machineID, targetConn := range wsConnectionsMachineID {
-					if err := targetConn.WriteMessage(websocket.TextMessage, []byte("take_screenshot")); err != nil {
-						log.Printf("Error sending screenshot command to machine ID %s: %v", machineID, err)
-						_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to send screenshot command to machine ID "+machineID))
-						continue
-					}
-					_ = conn.WriteMessage(websocket.TextMessage, []byte("Screenshot command sent to machine ID "+machineID))
-				}
-				wsConnectionsMachineIDMutex.Unlock()
-				continue
-			}
+	if enrollments, err = OpenEnrollmentStore(*enrollmentsPath, *serverKeyPath); err != nil {
+		log.Fatalf("failed to open enrollments: %v", err)
+	}
+	defer func() { _ = enrollments.Flush() }()
+	go runEnrollmentSaver(enrollments, enrollmentSaveInterval)
+	if links, err = OpenLinkStore(*linksPath); err != nil {
+		log.Fatalf("failed to open links: %v", err)
+	}
 
-			if parts[1][:10] == "machine_id" {
-				targetMachineID := parts[1][11:]
-				wsConnectionsMachineIDMutex.Lock()
-				targetConn, exists := wsConnectionsMachineID[targetMachineID]
-				wsConnectionsMachineIDMutex.Unlock()
-				if !exists {
-					_ = conn.WriteMessage(websocket.TextMessage, []byte("Machine ID not found"))
-					continue
-				}
-				if err := targetConn.WriteMessage(websocket.TextMessage, []byte("take_screenshot")); err != nil {
-					log.Printf("Error sending screenshot command to machine ID %s: %v", targetMachineID, err)
-					_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to send screenshot command"))
-					continue
-				}
-				_ = conn.WriteMessage(websocket.TextMessage, []byte("Screenshot command sent to machine ID "+targetMachineID))
-				continue
-			}
-		}
+	statusStore, err := NewStatusStore(*statusStoreKind, *statusStorePath)
+	if err != nil {
+		log.Fatalf("failed to open status store: %v", err)
+	}
+	defer func() { _ = statusStore.Close() }()
 
-		if messageType == websocket.TextMessage {
-			var data struct {
-				Action    string `json:"action"`
-				MachineID string `json:"machine_id"`
-				Hostname  string `json:"hostname"`
-				Username  string `json:"username"`
+	statusRetention := StatusRetention{MaxAge: *statusMaxAge, MaxPerMachine: *statusMaxPerMachine}
+	if _, err := statusStore.Prune(statusRetention); err != nil {
+		log.Printf("failed to prune status store: %v", err)
+	}
+	go runStatusRetention(statusStore, statusRetention, *statusPruneInterval)
 
-				Data  any    `json:"data"`
-				Error string `json:"error"`
-			}
+	if screenshots, err = OpenScreenshotStore(*screenshotsDir); err != nil {
+		log.Fatalf("failed to open screenshot store: %v", err)
+	}
+	if *screenshotsMaxAge > 0 {
+		go runScreenshotRetention(screenshots, *screenshotsMaxAge, *statusPruneInterval)
+	}
 
-			if err := json.Unmarshal(p, &data); err != nil {
-				continue
-			}
+	if uploads, err = OpenUploadStore(*uploadsDir); err != nil {
+		log.Fatalf("failed to open upload store: %v", err)
+	}
+	go runUploadRetention(uploads, uploadMaxAge, time.Hour)
 
-			if data.Action == "register" && data.MachineID != "" {
-				wsConnectionsMachineIDMutex.Lock()
-				wsConnectionsMachineID[data.MachineID] = conn
-				wsConnectionsMachineIDMutex.Unlock()
-				log.Printf("Registered machine ID: %s", data.MachineID)
-				wsChannel <- Message{
-					Type: websocket.TextMessage,
-					Data: bytes.NewBufferString(fmt.Sprintf("Machine %s registered with hostname %s, username %s", data.MachineID, data.Hostname, data.Username)),
-				}
-			} else if data.Action == "unregister" && data.MachineID != "" {
-				wsConnectionsMachineIDMutex.Lock()
-				delete(wsConnectionsMachineID, data.MachineID)
-				wsConnectionsMachineIDMutex.Unlock()
-				log.Printf("Unregistered machine ID: %s", data.MachineID)
-				wsChannel <- Message{
-					Type: websocket.TextMessage,
-					Data: bytes.NewBufferString(fmt.Sprintf("Machine %s unregistered", data.MachineID)),
-				}
-			} else if data.Action == "screenshot" {
-				log.Printf("Received screenshot data from %s, %s, %s", data.MachineID, data.Hostname, data.Username)
-				wsChannel <- Message{
-					Type: websocket.TextMessage,
-					Data: bytes.NewBuffer(p),
-				}
-			}
+	if agentConfig, err = OpenAgentConfigStore(*agentConfigPath); err != nil {
+		log.Fatalf("failed to open agent config: %v", err)
+	}
+
+	var releaseKey ed25519.PublicKey
+	if *releasePublicKey != "" {
+		if releaseKey, err = releases.ParsePublicKey(*releasePublicKey); err != nil {
+			log.Fatalf("failed to parse release public key: %v", err)
 		}
 	}
+	if releaseStore, err = OpenReleaseStore(*releasesDir, releaseKey); err != nil {
+		log.Fatalf("failed to open release feed: %v", err)
+	}
+	if *releaseMirror != "" {
+		go runGitHubMirror(releaseStore, *releaseMirror, *releaseMirrorInterval)
+	}
 
-	log.Printf("Client disconnected from %s", r.RemoteAddr)
-}
+	if rollouts, err = OpenRolloutStore(*rolloutsPath); err != nil {
+		log.Fatalf("failed to open rollouts: %v", err)
+	}
+	go runRolloutHealth(rollouts, RolloutHealth{
+		Timeout:           *rolloutHealthTimeout,
+		MinFailures:       *rolloutMinFailures,
+		MaxFailurePercent: *rolloutMaxFailurePcnt,
+	}, time.Minute)
 
-type Status struct {
-	MachineID string `json:"machine_id"`
-	Hostname  string `json:"hostname"`
-	Username  string `json:"username"`
-	IP        string `json:"ip"`
-	Country   string `json:"country"`
-	From      string `json:"from"`
-	Status    string `json:"status"`
-	Version   string `json:"version"`
+	fivemServers, err := LoadFiveMServers(*fivemServersPath)
+	if err != nil {
+		log.Fatalf("failed to load FiveM servers: %v", err)
+	}
+	sessions, err := OpenSessionStore(*sessionsPath)
+	if err != nil {
+		log.Fatalf("failed to open sessions: %v", err)
+	}
+	defer func() { _ = sessions.Close() }()
+	if _, err := sessions.Prune(*sessionsMaxAge); err != nil {
+		log.Printf("failed to prune sessions: %v", err)
+	}
+	go runSessionRetention(sessions, *sessionsMaxAge, 24*time.Hour)
 
-	Time time.Time `json:"time"`
-}
+	alertsConfig, err := LoadAlerts(*alertsPath, fivemServers)
+	if err != nil {
+		log.Fatalf("failed to load alerts: %v", err)
+	}
+	alerter, err := NewAlerter(alertsConfig, *alertStatePath)
+	if err != nil {
+		log.Fatalf("failed to open alerts: %v", err)
+	}
+	go alerter.Run()
 
-func main() {
-	status := make([]Status, 0)
-	statusMu := &sync.Mutex{}
-
-	go func() {
-		for range time.Tick(4 * time.Hour) {
-			statusMu.Lock()
-			newStatus := make([]Status, 0)
-			for _, s := range status {
-				if time.Since(s.Time) < 24*time.Hour {
-					newStatus = append(newStatus, s)
-				}
-			}
-			status = newStatus
-			statusMu.Unlock()
-		}
-	}()
+	playerTracker = NewPlayerTracker(fivemServers, sessions, alerter)
+	playerTracker.Run()
 
 	http.HandleFunc("/ws", wsHandler)
 
-	http.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/agents", auth.RequireOperator(agents.ListHandler))
+	http.HandleFunc("POST /api/agents/{machine_id}/uninstall", auth.RequireOperator(uninstalls.RequestHandler))
+	http.HandleFunc("GET /api/agents/{machine_id}/uninstall", auth.RequireOperator(uninstalls.GetHandler))
+	http.HandleFunc("PUT /api/agents/{machine_id}/identifiers/{identifier}", auth.RequireOperator(links.LinkHandler))
+	http.HandleFunc("DELETE /api/agents/{machine_id}/identifiers/{identifier}", auth.RequireOperator(links.UnlinkHandler))
+	http.HandleFunc("GET /api/links", auth.RequireOperator(links.ListHandler))
+
+	http.HandleFunc("GET /api/alerts", auth.RequireOperator(alerter.ListHandler))
+	http.HandleFunc("POST /api/alerts/test", auth.RequireOperator(alerter.TestHandler))
+
+	http.HandleFunc("/api/enrollments", auth.RequireOperator(enrollments.ListHandler))
+	http.HandleFunc("/api/enrollments/revoke", auth.RequireOperator(enrollmentActionHandler("revoke", enrollments.Revoke, func(machineID string) {
+		for _, a := range agents.All(machineID) {
+			a.client.Close()
+		}
+	})))
+	http.HandleFunc("/api/enrollments/reenroll", auth.RequireOperator(enrollmentActionHandler("re-enroll", enrollments.Reenroll, nil)))
+
+	http.HandleFunc("GET /api/screenshots", auth.RequireOperator(screenshots.ListHandler))
+	http.HandleFunc("GET /api/screenshots/{id}", auth.RequireOperator(screenshots.GetHandler))
+	http.HandleFunc("GET /api/screenshots/{id}/image", auth.RequireOperator(screenshots.ImageHandler))
+	http.HandleFunc("GET /api/screenshots/{id}/thumbnail", auth.RequireOperator(screenshots.ThumbnailHandler))
+	http.HandleFunc("DELETE /api/screenshots/{id}", auth.RequireOperator(screenshots.DeleteHandler))
+
+	http.HandleFunc("GET /api/config", auth.RequireOperator(agentConfig.GetHandler))
+	http.HandleFunc("PUT /api/config/global", auth.RequireOperator(agentConfig.ScopeHandler("global")))
+	http.HandleFunc("PUT /api/config/groups/{name}", auth.RequireOperator(agentConfig.ScopeHandler("group")))
+	http.HandleFunc("DELETE /api/config/groups/{name}", auth.RequireOperator(agentConfig.ScopeHandler("group")))
+	http.HandleFunc("PUT /api/config/machines/{name}", auth.RequireOperator(agentConfig.ScopeHandler("machine")))
+	http.HandleFunc("DELETE /api/config/machines/{name}", auth.RequireOperator(agentConfig.ScopeHandler("machine")))
+	http.HandleFunc("PUT /api/config/machines/{name}/group", auth.RequireOperator(agentConfig.GroupHandler))
+
+	http.HandleFunc("GET /api/rollouts", auth.RequireOperator(rollouts.ListHandler))
+	http.HandleFunc("PUT /api/rollouts/{channel}", auth.RequireOperator(rollouts.StartHandler))
+	http.HandleFunc("POST /api/rollouts/{channel}/pause", auth.RequireOperator(rollouts.PauseHandler(true)))
+	http.HandleFunc("POST /api/rollouts/{channel}/resume", auth.RequireOperator(rollouts.PauseHandler(false)))
+	http.HandleFunc("PUT /api/rollouts/machines/{machine_id}", auth.RequireOperator(rollouts.MachineHandler))
+	http.HandleFunc("POST /api/rollouts/machines/{machine_id}/retry", auth.RequireOperator(rollouts.RetryHandler))
+
+	http.HandleFunc("PUT /api/releases/{version}/{name}", auth.RequireOperator(releaseStore.UploadHandler))
+	http.HandleFunc("DELETE /api/releases/{version}", auth.RequireOperator(releaseStore.DeleteHandler))
+
+	http.HandleFunc("/login", auth.LoginHandler)
+	http.HandleFunc("/logout", auth.LogoutHandler)
+
+	http.HandleFunc("/chat", auth.RequireOperator(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 		w.WriteHeader(http.StatusOK)
@@ -216,48 +297,41 @@ func main() {
 		}
 
 		_, _ = w.Write(htmlContent)
-	})
-
-	go func() {
-		for msg := range wsChannel {
-			for conn := range wsConnections {
-				if !wsConnections[conn] {
-					continue
-				}
-				if err := conn.WriteMessage(msg.Type, msg.Data.Bytes()); err != nil {
-					log.Printf("Error sending message to client: %v", err)
-				}
-			}
-		}
-	}()
+	}))
 
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		statusMu.Lock()
-		defer statusMu.Unlock()
-
 		if r.Method == http.MethodPost {
 			var newStatus Status
 			defer func() { _ = r.Body.Close() }()
+			r.Body = http.MaxBytesReader(w, r.Body, maxStatusSize)
 			if err := json.NewDecoder(r.Body).Decode(&newStatus); err != nil {
 				hostname := r.Header.Get("Client-Hostname")
 				log.Printf("[%v]: failed to decode request body: %v\n", hostname, err)
 				http.Error(w, "Invalid request body", http.StatusBadRequest)
 				return
 			}
-			newStatus.IP = r.Header.Get("Cf-Connecting-Ip")
-			newStatus.Country = r.Header.Get("Cf-Ipcountry")
+			if err := newStatus.validate(); err != nil {
+				log.Printf("[%v]: invalid status: %v\n", r.Header.Get("Client-Hostname"), err)
+				http.Error(w, "Invalid status: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			newStatus.IP = remoteIP(r)
+			if viaTrustedProxy(r) {
+				newStatus.Country = r.Header.Get("Cf-Ipcountry")
+			}
 			newStatus.Time = time.Now()
-			buf := bytes.NewBuffer(nil)
-			if err := json.NewEncoder(buf).Encode(newStatus); err != nil {
+			env, err := protocol.New(protocol.TypeStatus, newStatus)
+			if err != nil {
 				log.Printf("[%v]: failed to encode status data: %v\n", newStatus.Hostname, err)
 				http.Error(w, "failed to encode status data", http.StatusInternalServerError)
 				return
 			}
-			wsChannel <- Message{
-				Type: websocket.TextMessage,
-				Data: buf,
+			if err := statusStore.Add(newStatus); err != nil {
+				log.Printf("[%v]: failed to store status: %v\n", newStatus.Hostname, err)
+				http.Error(w, "failed to store status", http.StatusInternalServerError)
+				return
 			}
-			status = append(status, newStatus)
+			hub.Broadcast(env)
 			w.WriteHeader(http.StatusCreated)
 			return
 		}
@@ -265,10 +339,7 @@ func main() {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	})
 
-	http.HandleFunc("/get-status", func(w http.ResponseWriter, r *http.Request) {
-		statusMu.Lock()
-		defer statusMu.Unlock()
-
+	http.HandleFunc("/get-status", auth.RequireOperator(func(w http.ResponseWriter, r *http.Request) {
 		var data struct {
 			Items      []Status `json:"items"`
 			TotalItems int      `json:"total_items"`
@@ -299,26 +370,20 @@ func main() {
 			data.Reversed = false
 		}
 
-		items := make([]Status, len(status))
-		copy(items, status)
-
-		if data.Reversed {
-			for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
-				items[i], items[j] = items[j], items[i]
-			}
-		}
-
-		start := (data.Page - 1) * data.PerPage
-		end := start + data.PerPage
-		if start >= len(items) {
-			data.Items = []Status{}
-		} else if end > len(items) {
-			data.Items = items[start:]
-		} else {
-			data.Items = items[start:end]
+		items, total, err := statusStore.List(StatusQuery{
+			MachineID: r.URL.Query().Get("machine_id"),
+			Offset:    (data.Page - 1) * data.PerPage,
+			Limit:     data.PerPage,
+			Reversed:  data.Reversed,
+		})
+		if err != nil {
+			log.Printf("failed to list status: %v\n", err)
+			http.Error(w, "failed to list status", http.StatusInternalServerError)
+			return
 		}
 
-		data.TotalItems = len(items)
+		data.Items = items
+		data.TotalItems = total
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "max-age=0")
@@ -327,19 +392,16 @@ func main() {
 			http.Error(w, "failed to encode status", http.StatusInternalServerError)
 			return
 		}
-	})
+	}))
 
-	http.HandleFunc("/players.json", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	http.HandleFunc("/players.json", playerTracker.JSONHandler)
+	http.HandleFunc("/servers.json", playerTracker.ServersHandler)
+	http.HandleFunc("GET /players/peaks.json", sessions.PeaksHandler)
 
-		playerData, err := GetPlayerData()
-		data := map[string]any{"players": playerData, "error": err}
-		_ = json.NewEncoder(w).Encode(data)
-	})
+	http.HandleFunc("GET /api/players", auth.RequireOperator(sessions.ListHandler))
+	http.HandleFunc("GET /api/players/{key}", auth.RequireOperator(sessions.HistoryHandler))
 
-	playerHtmlContent, _ := staticFS.ReadFile("static/players.html")
-	playerTemplate, _ := template.New("players").Funcs(template.FuncMap{
+	templateFuncs := template.FuncMap{
 		"json": func(v any) string {
 			b, err := json.Marshal(v)
 			if err != nil {
@@ -348,14 +410,32 @@ func main() {
 			}
 			return string(b)
 		},
-	}).Parse(string(playerHtmlContent))
+	}
+
+	playerHtmlContent, _ := staticFS.ReadFile("static/players.html")
+	playerTemplate, _ := template.New("players").Funcs(templateFuncs).Parse(string(playerHtmlContent))
 
 	http.HandleFunc("/players", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 
-		playerData, err := GetPlayerData()
-		data := map[string]any{"players": playerData, "error": err}
+		view, err := playerTracker.Players(r.URL.Query().Get("server"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		links.Annotate(view.Players)
+		operator := auth.Operator(r) != nil
+		if !operator {
+			view.withoutIdentifiers()
+		}
+		var details *ServerDetails
+		if view.Server != "" {
+			if servers, err := playerTracker.Servers(view.Server); err == nil {
+				details = servers[0]
+			}
+		}
+		data := map[string]any{"players": view.Players, "error": view.Error, "server": view.Server, "servers": view.Servers, "details": details, "operator": operator}
 
 		if err := playerTemplate.Execute(w, data); err != nil {
 			log.Printf("failed to execute template: %v", err)
@@ -364,61 +444,50 @@ func main() {
 		}
 	})
 
-	var downloadURL string
+	playerHistoryContent, _ := staticFS.ReadFile("static/player.html")
+	playerHistoryTemplate, _ := template.New("player").Funcs(templateFuncs).Parse(string(playerHistoryContent))
 
-	doGetDownloadURL := func() {
-		resp, err := http.Get("https://api.github.com/repos/willywotz/fivem/releases/latest")
-		if err != nil {
-			log.Printf("failed to fetch latest release: %v", err)
+	http.HandleFunc("GET /players/{key}", auth.RequireOperator(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := sessions.History(r.PathValue("key"))
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
 			return
 		}
-		defer func() { _ = resp.Body.Close() }()
 
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Unexpected status code: %d", resp.StatusCode)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		if err := playerHistoryTemplate.Execute(w, map[string]any{"player": h}); err != nil {
+			log.Printf("failed to execute template: %v", err)
+			http.Error(w, "Failed to render player page", http.StatusInternalServerError)
 			return
 		}
+	}))
 
-		var release struct {
-			Assets []struct {
-				Name string `json:"name"`
-				URL  string `json:"browser_download_url"`
-			} `json:"assets"`
-		}
-
-		if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-			log.Printf("failed to decode response: %v", err)
+	// Agents only trust the record if it is signed, so it is served as is.
+	http.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		b, err := os.ReadFile(*remoteConfigPath)
+		if os.IsNotExist(err) {
+			http.Error(w, "Not Found", http.StatusNotFound)
 			return
 		}
-
-		for _, asset := range release.Assets {
-			if asset.Name == "fivem-windows-amd64.exe" {
-				downloadURL = asset.URL
-				break
-			}
-		}
-	}
-
-	doGetDownloadURL()
-
-	go func() {
-		for range time.Tick(5 * time.Minute) {
-			doGetDownloadURL()
-		}
-	}()
-
-	http.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
-		if downloadURL == "" {
-			http.Error(w, "Download URL not available", http.StatusServiceUnavailable)
+		if err != nil {
+			log.Printf("failed to read remote config: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusFound)
-		w.Header().Set("Location", downloadURL)
-		s := fmt.Sprintf("<script>window.location.href = '%s';</script>", downloadURL)
-		_, _ = w.Write([]byte(s))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write(b)
 	})
 
+	http.HandleFunc("GET /update", rollouts.TargetHandler)
+	http.HandleFunc("POST /update/report", rollouts.ReportHandler)
+	http.HandleFunc("GET /releases/manifest.json", releaseStore.ManifestHandler)
+	http.HandleFunc("GET /releases/{version}/{name}", releaseStore.ArtifactHandler)
+
+	http.HandleFunc("GET /download", releaseStore.DownloadHandler)
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Not Found", http.StatusNotFound)
 	})
@@ -426,72 +495,3 @@ func main() {
 	log.Println("Starting server on :8080")
 	log.Println(http.ListenAndServe(":8080", nil))
 }
-
-type Player struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-	Ping int    `json:"ping"`
-}
-
-var (
-	playerData          []*Player
-	playerDataError     error
-	playerDataMu        sync.Mutex
-	playerDataLastFetch time.Time
-)
-
-func GetPlayerData() ([]*Player, error) {
-	playerDataMu.Lock()
-	defer playerDataMu.Unlock()
-
-	if playerData == nil {
-		playerData = make([]*Player, 0)
-		playerDataError = nil
-		playerDataLastFetch = time.Time{}
-	}
-
-	if time.Since(playerDataLastFetch) < 15*time.Second {
-		return playerData, playerDataError
-	}
-
-	defer func() {
-		playerDataLastFetch = time.Now()
-	}()
-
-	url := "http://141.98.19.200:30120/players.json"
-	resp, err := http.Get(url)
-	if err != nil {
-		playerDataError = fmt.Errorf("failed to fetch players: %w", err)
-		return playerData, playerDataError
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		playerDataError = fmt.Errorf("failed to fetch players: unexpected status code %d", resp.StatusCode)
-		return playerData, playerDataError
-	}
-
-	var players []*Player
-	if err := json.NewDecoder(resp.Body).Decode(&players); err != nil {
-		playerDataError = fmt.Errorf("failed to decode players response: %w", err)
-		return playerData, playerDataError
-	}
-
-	if len(players) == 0 {
-		playerDataError = fmt.Errorf("no players online")
-		return playerData, playerDataError
-	}
-
-	playerData = make([]*Player, len(players))
-	for i, p := range players {
-		playerData[i] = &Player{
-			ID:   p.ID,
-			Name: p.Name,
-			Ping: p.Ping,
-		}
-	}
-
-	playerDataError = nil
-
-	return playerData, nil
-}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/fivem"
+)
+
+var errUnknownFiveMServer = errors.New("unknown FiveM server")
+
+const defaultPollInterval = 15 * time.Second
+
+// FiveMServer is a FiveM server whose players are tracked.
+type FiveMServer struct {
+	Name string `json:"name"`
+	// URL is the HTTP endpoint of the server, e.g. http://127.0.0.1:30120.
+	URL string `json:"url"`
+	// Interval between polls, e.g. "30s"; 15s when empty.
+	Interval string `json:"interval,omitempty"`
+}
+
+// defaultFiveMServers apply while there is no servers file.
+var defaultFiveMServers = []*FiveMServer{
+	{Name: "main", URL: "http://141.98.19.200:30120"},
+}
+
+// LoadFiveMServers reads the servers file, {"servers": [...]}.
+func LoadFiveMServers(path string) ([]*FiveMServer, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return defaultFiveMServers, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FiveM servers: %w", err)
+	}
+
+	var file struct {
+		Servers []*FiveMServer `json:"servers"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode FiveM servers: %w", err)
+	}
+	if len(file.Servers) == 0 {
+		return nil, fmt.Errorf("no FiveM servers in %s", path)
+	}
+
+	names := make(map[string]bool)
+	for _, s := range file.Servers {
+		if s.Name == "" || names[s.Name] {
+			return nil, fmt.Errorf("FiveM server names must be unique and not empty, got %q", s.Name)
+		}
+		names[s.Name] = true
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q of FiveM server %s", s.URL, s.Name)
+		}
+		if _, err := s.pollInterval(); err != nil {
+			return nil, err
+		}
+	}
+	return file.Servers, nil
+}
+
+func (s *FiveMServer) pollInterval() (time.Duration, error) {
+	if s.Interval == "" {
+		return defaultPollInterval, nil
+	}
+	d, err := time.ParseDuration(s.Interval)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid interval %q of FiveM server %s", s.Interval, s.Name)
+	}
+	return d, nil
+}
+
+// Player is a player of the tracked server Server.
+type Player struct {
+	fivem.Player
+	Server string `json:"server"`
+	// Key identifies the player in the session history, see playerKey.
+	Key string `json:"key,omitempty"`
+	// Agent is set for players linked to a machine, see LinkStore.
+	Agent *PlayerAgent `json:"agent,omitempty"`
+}
+
+// ServerPlayers is what the last poll of a server found. Players, Info and
+// Dynamic are kept from the last successful poll when a poll fails.
+type ServerPlayers struct {
+	Server    string         `json:"server"`
+	Players   []*Player      `json:"players"`
+	Info      *fivem.Info    `json:"info,omitempty"`
+	Dynamic   *fivem.Dynamic `json:"dynamic,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	CheckedAt time.Time      `json:"checked_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	// DownSince is the first of the polls failing to list players since
+	// the last one that did.
+	DownSince *time.Time `json:"down_since,omitempty"`
+}
+
+// PlayerTracker polls the players of every FiveM server.
+type PlayerTracker struct {
+	servers []*trackedServer
+}
+
+type trackedServer struct {
+	*FiveMServer
+	interval time.Duration
+	client   *fivem.Client
+	sessions *SessionStore
+	alerts   *Alerter
+
+	mu      sync.Mutex
+	players ServerPlayers
+	failing bool
+}
+
+func NewPlayerTracker(servers []*FiveMServer, sessions *SessionStore, alerts *Alerter) *PlayerTracker {
+	t := &PlayerTracker{}
+	for _, s := range servers {
+		interval, _ := s.pollInterval()
+		t.servers = append(t.servers, &trackedServer{
+			FiveMServer: s,
+			interval:    interval,
+			client:      fivem.NewClient(s.URL),
+			sessions:    sessions,
+			alerts:      alerts,
+			players:     ServerPlayers{Server: s.Name, Players: make([]*Player, 0), Error: "not polled yet"},
+		})
+	}
+	return t
+}
+
+// Run polls every server at its interval until the process exits.
+func (t *PlayerTracker) Run() {
+	for _, s := range t.servers {
+		go func() {
+			for {
+				s.poll()
+				time.Sleep(s.interval)
+			}
+		}()
+	}
+}
+
+// poll fetches players.json, then info.json and dynamic.json; each is kept
+// when it succeeds, even if another fails. A server that does not list its
+// players is not asked for the rest.
+func (s *trackedServer) poll() {
+	ctx := context.Background()
+	var (
+		info    *fivem.Info
+		dynamic *fivem.Dynamic
+		errs    []string
+	)
+
+	players, err := s.fetchPlayers(ctx)
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		if info, err = s.client.Info(ctx); err != nil {
+			errs = append(errs, err.Error())
+		} else if _, err := base64.StdEncoding.DecodeString(info.Icon); err != nil {
+			// The icon goes into a data: URL of the page.
+			info.Icon = ""
+		}
+		if dynamic, err = s.client.Dynamic(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	now := time.Now()
+
+	if players != nil {
+		if err := s.sessions.Observe(s.Name, players, now, sessionGap(s.interval)); err != nil {
+			log.Printf("failed to record sessions of FiveM server %s: %v", s.Name, err)
+		}
+		s.alerts.Observe(s.Name, len(players), "", now)
+	} else {
+		s.alerts.Observe(s.Name, 0, errs[0], now)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.players.CheckedAt = now
+	if players != nil {
+		s.players.Players = players
+		s.players.UpdatedAt = now
+		s.players.DownSince = nil
+	} else if s.players.DownSince == nil {
+		s.players.DownSince = &now
+	}
+	if info != nil {
+		s.players.Info = info
+	}
+	if dynamic != nil {
+		s.players.Dynamic = dynamic
+	}
+	s.players.Error = strings.Join(errs, "; ")
+
+	if len(errs) > 0 {
+		if !s.failing {
+			log.Printf("FiveM server %s failed: %s", s.Name, s.players.Error)
+		}
+		s.failing = true
+		return
+	}
+	if s.failing {
+		log.Printf("FiveM server %s recovered", s.Name)
+	}
+	s.failing = false
+}
+
+func (s *trackedServer) fetchPlayers(ctx context.Context) ([]*Player, error) {
+	fetched, err := s.client.Players(ctx)
+	if err != nil {
+		return nil, err
+	}
+	players := make([]*Player, 0, len(fetched))
+	for _, p := range fetched {
+		players = append(players, &Player{Player: *p, Server: s.Name, Key: playerKey(p)})
+	}
+	return players, nil
+}
+
+func (s *trackedServer) snapshot() ServerPlayers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := s.players
+	snapshot.Players = slices.Clone(s.players.Players)
+	return snapshot
+}
+
+// Players returns the players of server, or of every server when server is
+// empty.
+func (t *PlayerTracker) Players(server string) (*PlayersView, error) {
+	view := &PlayersView{Server: server, Players: make([]*Player, 0), Servers: make([]ServerSummary, 0, len(t.servers))}
+
+	var errs []string
+	found := false
+	for _, s := range t.servers {
+		snapshot := s.snapshot()
+		view.Servers = append(view.Servers, snapshot.summary())
+		if server != "" && s.Name != server {
+			continue
+		}
+
+		found = true
+		view.Players = append(view.Players, snapshot.Players...)
+		if snapshot.Error == "" {
+			continue
+		}
+		if server != "" {
+			errs = append(errs, snapshot.Error)
+		} else {
+			errs = append(errs, s.Name+": "+snapshot.Error)
+		}
+	}
+	if !found {
+		return nil, errUnknownFiveMServer
+	}
+
+	view.Error = strings.Join(errs, "; ")
+	return view, nil
+}
+
+// Servers returns the details of server, or of every server when server is
+// empty.
+func (t *PlayerTracker) Servers(server string) ([]*ServerDetails, error) {
+	servers := make([]*ServerDetails, 0, len(t.servers))
+	for _, s := range t.servers {
+		if server != "" && s.Name != server {
+			continue
+		}
+		snapshot := s.snapshot()
+		servers = append(servers, &ServerDetails{ServerSummary: snapshot.summary(), Info: snapshot.Info, Dynamic: snapshot.Dynamic})
+	}
+	if len(servers) == 0 {
+		return nil, errUnknownFiveMServer
+	}
+	return servers, nil
+}
+
+// PlayersView is served at /players.json, for one server or aggregated.
+type PlayersView struct {
+	// Server is empty for the aggregated view.
+	Server  string          `json:"server,omitempty"`
+	Players []*Player       `json:"players"`
+	Error   string          `json:"error,omitempty"`
+	Servers []ServerSummary `json:"servers"`
+}
+
+// withoutIdentifiers hides the identifiers and addresses of players, and
+// the machines of their agents, from everyone but operators.
+func (v *PlayersView) withoutIdentifiers() {
+	for i, p := range v.Players {
+		redacted := *p
+		redacted.Identifiers = nil
+		redacted.Endpoint = ""
+		redacted.Key = ""
+		if p.Agent != nil {
+			redacted.Agent = &PlayerAgent{Version: p.Agent.Version, Connected: p.Agent.Connected}
+		}
+		v.Players[i] = &redacted
+	}
+}
+
+type ServerSummary struct {
+	Name string `json:"name"`
+	// Hostname is without color codes.
+	Hostname   string     `json:"hostname,omitempty"`
+	Online     int        `json:"online"`
+	MaxClients int        `json:"max_clients,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CheckedAt  time.Time  `json:"checked_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	DownSince  *time.Time `json:"down_since,omitempty"`
+}
+
+func (p *ServerPlayers) summary() ServerSummary {
+	summary := ServerSummary{
+		Name:      p.Server,
+		Online:    len(p.Players),
+		Error:     p.Error,
+		CheckedAt: p.CheckedAt,
+		UpdatedAt: p.UpdatedAt,
+		DownSince: p.DownSince,
+	}
+	if p.Info != nil {
+		summary.MaxClients = p.Info.MaxClients()
+	}
+	if p.Dynamic != nil {
+		summary.Hostname = fivem.StripColors(p.Dynamic.Hostname)
+		if p.Dynamic.MaxClients > 0 {
+			summary.MaxClients = int(p.Dynamic.MaxClients)
+		}
+	}
+	return summary
+}
+
+// ServerDetails is served at /servers.json, with the info.json and
+// dynamic.json of the server as last fetched.
+type ServerDetails struct {
+	ServerSummary
+	Info    *fivem.Info    `json:"info,omitempty"`
+	Dynamic *fivem.Dynamic `json:"dynamic,omitempty"`
+}
+
+func (t *PlayerTracker) JSONHandler(w http.ResponseWriter, r *http.Request) {
+	view, err := t.Players(r.URL.Query().Get("server"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	links.Annotate(view.Players)
+	if auth.Operator(r) == nil {
+		view.withoutIdentifiers()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(w).Encode(view); err != nil {
+		log.Printf("failed to encode players: %v\n", err)
+	}
+}
+
+func (t *PlayerTracker) ServersHandler(w http.ResponseWriter, r *http.Request) {
+	servers, err := t.Servers(r.URL.Query().Get("server"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(w).Encode(servers); err != nil {
+		log.Printf("failed to encode servers: %v\n", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+)
+
+type Agent struct {
+	protocol.AgentInfo
+
+	client *Client
+}
+
+// Registry tracks the agents currently connected to /ws. The service and
+// the client of a machine register with the same machine ID, so agents are
+// keyed by machine ID and From and a machine may be connected twice.
+type Registry struct {
+	mu       sync.Mutex
+	agents   map[agentKey]*Agent
+	byClient map[*Client]*Agent
+}
+
+type agentKey struct {
+	machineID string
+	from      string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{agents: make(map[agentKey]*Agent), byClient: make(map[*Client]*Agent)}
+}
+
+// Add registers a, replacing any previous connection of the same machine
+// and From, and announces it on the operator stream.
+func (reg *Registry) Add(a *Agent) {
+	reg.mu.Lock()
+	key := agentKey{a.MachineID, a.From}
+	old, ok := reg.agents[key]
+	reg.agents[key] = a
+	reg.byClient[a.client] = a
+	if ok && old.client != a.client {
+		delete(reg.byClient, old.client)
+	}
+	reg.mu.Unlock()
+
+	if ok && old.client != a.client {
+		log.Printf("Machine ID %s (%s) reconnected, closing previous connection", a.MachineID, a.From)
+		old.client.Close()
+	}
+	broadcastPresence(protocol.PresenceOnline, a.AgentInfo)
+}
+
+// Remove evicts the agent registered on c.
+func (reg *Registry) Remove(c *Client) {
+	reg.mu.Lock()
+	a, ok := reg.byClient[c]
+	if ok {
+		delete(reg.byClient, c)
+		delete(reg.agents, agentKey{a.MachineID, a.From})
+	}
+	reg.mu.Unlock()
+
+	if ok {
+		broadcastPresence(protocol.PresenceOffline, a.AgentInfo)
+	}
+}
+
+func (reg *Registry) Heartbeat(c *Client) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if a, ok := reg.byClient[c]; ok {
+		a.LastHeartbeat = time.Now()
+	}
+}
+
+// preferred reports whether commands for a machine go to the connection a
+// rather than b: the client, which runs in the session of the user, goes
+// before the service.
+func preferred(a, b *Agent) bool {
+	if (a.From == "client") != (b.From == "client") {
+		return a.From == "client"
+	}
+	return a.ConnectedSince.Before(b.ConnectedSince)
+}
+
+func (reg *Registry) preferredLocked(machineID string) (*Agent, bool) {
+	var p *Agent
+	for key, a := range reg.agents {
+		if key.machineID == machineID && (p == nil || preferred(a, p)) {
+			p = a
+		}
+	}
+	return p, p != nil
+}
+
+// Client returns the preferred connection of machineID.
+func (reg *Registry) Client(machineID string) (*Client, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	a, ok := reg.preferredLocked(machineID)
+	if !ok {
+		return nil, false
+	}
+	return a.client, true
+}
+
+// Get returns the preferred agent of machineID and its client.
+func (reg *Registry) Get(machineID string) (protocol.AgentInfo, *Client, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	a, ok := reg.preferredLocked(machineID)
+	if !ok {
+		return protocol.AgentInfo{}, nil, false
+	}
+	return a.AgentInfo, a.client, true
+}
+
+// All returns every connection of machineID, the service and the client.
+func (reg *Registry) All(machineID string) []Agent {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	all := make([]Agent, 0, 2)
+	for key, a := range reg.agents {
+		if key.machineID == machineID {
+			all = append(all, *a)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].From < all[j].From })
+	return all
+}
+
+// SetConfigVersion records the pushed config version the agent on c
+// applied.
+func (reg *Registry) SetConfigVersion(c *Client, version int64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if a, ok := reg.byClient[c]; ok {
+		a.ConfigVersion = version
+	}
+}
+
+// Clients returns the preferred client of every registered machine by
+// machine ID.
+func (reg *Registry) Clients() map[string]*Client {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	agents := make(map[string]*Agent, len(reg.agents))
+	for key, a := range reg.agents {
+		if p, ok := agents[key.machineID]; !ok || preferred(a, p) {
+			agents[key.machineID] = a
+		}
+	}
+	clients := make(map[string]*Client, len(agents))
+	for machineID, a := range agents {
+		clients[machineID] = a.client
+	}
+	return clients
+}
+
+func (reg *Registry) List() []protocol.AgentInfo {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	items := make([]protocol.AgentInfo, 0, len(reg.agents))
+	for _, a := range reg.agents {
+		items = append(items, a.AgentInfo)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ConnectedSince.Before(items[j].ConnectedSince) })
+	return items
+}
+
+func (reg *Registry) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(map[string]any{"items": reg.List()}); err != nil {
+		log.Printf("failed to encode agents: %v\n", err)
+	}
+}
+
+func broadcastPresence(event string, info protocol.AgentInfo) {
+	env, err := protocol.New(protocol.TypePresence, &protocol.Presence{Event: event, Agent: info})
+	if err != nil {
+		log.Printf("failed to encode presence: %v", err)
+		return
+	}
+	hub.Broadcast(env)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/willywotz/fivem/delta"
+	"github.com/willywotz/fivem/releases"
+)
+
+// maxPatchRatio drops patches that save too little over the full asset to
+// be worth applying.
+const maxPatchRatio = 0.8
+
+// requestPatches wakes runPatches without blocking.
+func (s *ReleaseStore) requestPatches() {
+	select {
+	case s.patches <- struct{}{}:
+	default:
+	}
+}
+
+// runPatches creates the missing patches whenever releases change. Diffing
+// large executables takes a while, so it runs on its own.
+func (s *ReleaseStore) runPatches() {
+	for range s.patches {
+		if err := s.CreatePatches(); err != nil {
+			log.Printf("failed to create release patches: %v", err)
+		}
+	}
+}
+
+// CreatePatches patches every asset from the asset of the same name in the
+// previous release, replacing patches from other releases.
+func (s *ReleaseStore) CreatePatches() error {
+	m := s.Manifest()
+	for i := 0; i+1 < len(m.Releases); i++ {
+		release, previous := m.Releases[i], m.Releases[i+1]
+		for _, asset := range release.Assets {
+			from, ok := findAsset(previous, asset.Name)
+			if !ok || s.isUnpatchable(from, asset) || slices.ContainsFunc(asset.Patches, func(p *releases.Patch) bool {
+				return p.From == previous.Version && p.FromSHA256 == from.SHA256
+			}) {
+				continue
+			}
+			if err := s.createPatch(release, asset, previous, from); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *ReleaseStore) createPatch(release *releases.Release, asset *releases.Asset, previous *releases.Release, from *releases.Asset) error {
+	oldData, err := os.ReadFile(filepath.Join(s.dir, previous.Version, from.Name))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", previous.Path(from), err)
+	}
+	newData, err := os.ReadFile(filepath.Join(s.dir, release.Version, asset.Name))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", release.Path(asset), err)
+	}
+
+	data, err := delta.Diff(oldData, newData)
+	if err != nil {
+		return fmt.Errorf("failed to diff %s: %w", release.Path(asset), err)
+	}
+
+	patch := &releases.Patch{
+		From:       previous.Version,
+		FromSHA256: from.SHA256,
+		Name:       releases.PatchName(asset.Name, previous.Version),
+		Size:       int64(len(data)),
+	}
+	sum := sha256.Sum256(data)
+	patch.SHA256 = hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Releases may have changed while diffing.
+	current, ok := s.manifest.Find(release.Version)
+	if !ok {
+		return nil
+	}
+	target, ok := findAsset(current, asset.Name)
+	if !ok || target.ID != asset.ID {
+		return nil
+	}
+
+	worthwhile := float64(len(data)) <= maxPatchRatio*float64(asset.Size)
+	for _, p := range target.Patches {
+		if !worthwhile || p.Name != patch.Name {
+			_ = os.Remove(filepath.Join(s.dir, release.Version, p.Name))
+		}
+	}
+
+	target.Patches = make([]*releases.Patch, 0, 1)
+	if worthwhile {
+		path := filepath.Join(s.dir, release.Version, patch.Name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return fmt.Errorf("failed to write patch: %w", err)
+		}
+		target.Patches = append(target.Patches, patch)
+		log.Printf("Created patch %s, %d of %d bytes", release.PatchPath(patch), patch.Size, asset.Size)
+	} else {
+		s.unpatchable[patch.FromSHA256+"/"+asset.SHA256] = true
+	}
+	return s.saveLocked()
+}
+
+func (s *ReleaseStore) isUnpatchable(from, asset *releases.Asset) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.unpatchable[from.SHA256+"/"+asset.SHA256]
+}
+
+func findAsset(release *releases.Release, name string) (*releases.Asset, bool) {
+	for _, a := range release.Assets {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+	"github.com/willywotz/fivem/releases"
+)
+
+var errReleaseNotFound = errors.New("release not found")
+
+// maxArtifactSize bounds uploaded and mirrored artifacts.
+const maxArtifactSize = 256 << 20
+
+// ReleaseStore hosts the release feed agents update from. Artifacts live in
+// <dir>/<version>/<name> next to <dir>/manifest.json.
+type ReleaseStore struct {
+	mu       sync.Mutex
+	dir      string
+	manifest releases.Manifest
+	// publicKey, if set, rejects artifacts not signed with its key.
+	publicKey ed25519.PublicKey
+
+	// patches wakes runPatches; unpatchable remembers pairs of assets,
+	// by SHA-256, whose patch was not worth keeping.
+	patches     chan struct{}
+	unpatchable map[string]bool
+}
+
+func OpenReleaseStore(dir string, publicKey ed25519.PublicKey) (*ReleaseStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create release directory: %w", err)
+	}
+
+	s := &ReleaseStore{
+		dir:         dir,
+		manifest:    releases.Manifest{NextID: 1},
+		publicKey:   publicKey,
+		patches:     make(chan struct{}, 1),
+		unpatchable: make(map[string]bool),
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read release manifest: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.manifest); err != nil {
+			return nil, fmt.Errorf("failed to decode release manifest: %w", err)
+		}
+	}
+	if s.manifest.Releases == nil {
+		s.manifest.Releases = make([]*releases.Release, 0)
+	}
+
+	go s.runPatches()
+	s.requestPatches()
+
+	return s, nil
+}
+
+func (s *ReleaseStore) saveLocked() error {
+	sortReleases(s.manifest.Releases)
+
+	b, err := json.MarshalIndent(s.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode release manifest: %w", err)
+	}
+	path := filepath.Join(s.dir, "manifest.json")
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return fmt.Errorf("failed to write release manifest: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to replace release manifest: %w", err)
+	}
+	return nil
+}
+
+// sortReleases orders releases newest first.
+func sortReleases(items []*releases.Release) {
+	slices.SortFunc(items, func(a, b *releases.Release) int {
+		return releases.Compare(b.Version, a.Version)
+	})
+}
+
+func (s *ReleaseStore) Manifest() releases.Manifest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, _ := json.Marshal(s.manifest)
+	var m releases.Manifest
+	_ = json.Unmarshal(b, &m)
+	return m
+}
+
+func (s *ReleaseStore) Has(version string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.manifest.Find(version)
+	return ok
+}
+
+// Tag returns the version of the release of version as the feed writes
+// it, which may differ in the "v" prefix.
+func (s *ReleaseStore) Tag(version string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	release, ok := s.manifest.Find(version)
+	if !ok {
+		return "", false
+	}
+	return release.Version, true
+}
+
+// Latest returns the newest release, if any.
+func (s *ReleaseStore) Latest() (*releases.Release, bool) {
+	m := s.Manifest()
+	if len(m.Releases) == 0 {
+		return nil, false
+	}
+	return m.Releases[0], true
+}
+
+// Add stores the artifact name of version read from r, replacing an asset
+// of the same name. The release is created if needed.
+func (s *ReleaseStore) Add(version, name string, r io.Reader, signature string) (*releases.Asset, error) {
+	if !releases.ValidVersion(version) {
+		return nil, fmt.Errorf("invalid version %q", version)
+	}
+	if !releases.ValidName(name) {
+		return nil, fmt.Errorf("invalid asset name %q", name)
+	}
+	// Assets of an existing release go to it however the version is written.
+	if tag, ok := s.Tag(version); ok {
+		version = tag
+	}
+
+	dir := filepath.Join(s.dir, version)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create release directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create artifact: %w", err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, maxArtifactSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write artifact: %w", err)
+	}
+	if n > maxArtifactSize {
+		return nil, fmt.Errorf("artifact is larger than %d bytes", maxArtifactSize)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if s.publicKey != nil {
+		if err := releases.VerifyDigest(s.publicKey, version, name, sum, signature); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		return nil, fmt.Errorf("failed to store artifact: %w", err)
+	}
+
+	release, ok := s.manifest.Find(version)
+	if !ok {
+		release = &releases.Release{Version: version, Published: time.Now(), Assets: make([]*releases.Asset, 0)}
+		s.manifest.Releases = append(s.manifest.Releases, release)
+	}
+	release.Assets = slices.DeleteFunc(release.Assets, func(a *releases.Asset) bool { return a.Name == name })
+
+	asset := &releases.Asset{
+		ID:        s.manifest.NextID,
+		Name:      name,
+		Size:      n,
+		SHA256:    sum,
+		Signature: strings.TrimSpace(signature),
+	}
+	s.manifest.NextID++
+	release.Assets = append(release.Assets, asset)
+
+	if err := s.saveLocked(); err != nil {
+		return nil, err
+	}
+	s.requestPatches()
+	return asset, nil
+}
+
+// Delete removes version and its artifacts.
+func (s *ReleaseStore) Delete(version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	release, ok := s.manifest.Find(version)
+	if !ok {
+		return errReleaseNotFound
+	}
+	s.manifest.Releases = slices.DeleteFunc(s.manifest.Releases, func(r *releases.Release) bool { return r == release })
+	if err := s.saveLocked(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(s.dir, release.Version)); err != nil {
+		return fmt.Errorf("failed to remove release %s: %w", version, err)
+	}
+	s.requestPatches()
+	return nil
+}
+
+func (s *ReleaseStore) ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=60")
+	if err := json.NewEncoder(w).Encode(s.Manifest()); err != nil {
+		log.Printf("failed to encode release manifest: %v\n", err)
+	}
+}
+
+func (s *ReleaseStore) ArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	version, name := r.PathValue("version"), r.PathValue("name")
+
+	m := s.Manifest()
+	release, ok := m.Find(version)
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	var sum string
+	for _, a := range release.Assets {
+		if a.Name == name {
+			sum = a.SHA256
+		}
+		for _, p := range a.Patches {
+			if p.Name == name {
+				sum = p.SHA256
+			}
+		}
+	}
+	// Assets may be uploaded again and patches recreated under the same
+	// name; only a URL naming the current SHA-256 is cached for good.
+	want := r.URL.Query().Get("sha256")
+	if sum == "" || (want != "" && want != sum) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if want == sum {
+		w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "max-age=0")
+	}
+	http.ServeFile(w, r, filepath.Join(s.dir, release.Version, name))
+}
+
+// UploadHandler stores the request body as artifact {name} of {version}.
+// A signature may be given in the X-Signature header.
+func (s *ReleaseStore) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	version, name := r.PathValue("version"), r.PathValue("name")
+	defer func() { _ = r.Body.Close() }()
+
+	asset, err := s.Add(version, name, r.Body, r.Header.Get("X-Signature"))
+	if err != nil {
+		log.Printf("failed to add release artifact %s/%s: %v", version, name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if op := auth.Operator(r); op != nil {
+		auth.Audit(op, r, fmt.Sprintf("upload release %s/%s sha256 %s", version, name, asset.SHA256))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(asset); err != nil {
+		log.Printf("failed to encode release asset: %v\n", err)
+	}
+}
+
+func (s *ReleaseStore) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	version := r.PathValue("version")
+
+	err := s.Delete(version)
+	if errors.Is(err, errReleaseNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to delete release %s: %v", version, err)
+		http.Error(w, "failed to delete release", http.StatusInternalServerError)
+		return
+	}
+
+	if op := auth.Operator(r); op != nil {
+		auth.Audit(op, r, "delete release "+version)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DownloadHandler redirects to the Windows artifact of the stable channel's
+// version, or of the newest release while stable has none.
+func (s *ReleaseStore) DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	m := s.Manifest()
+
+	var release *releases.Release
+	if version := rollouts.Get().Channels[protocol.ChannelStable].Version; version != "" {
+		release, _ = m.Find(version)
+	}
+	if release == nil {
+		release, _ = s.Latest()
+	}
+
+	if release != nil {
+		for _, a := range release.Assets {
+			if a.Name == "fivem-windows-amd64.exe" {
+				http.Redirect(w, r, "/releases/"+release.Path(a), http.StatusFound)
+				return
+			}
+		}
+	}
+	http.Error(w, "Download not available", http.StatusServiceUnavailable)
+}
+
+type githubRelease struct {
+	TagName     string    `json:"tag_name"`
+	Draft       bool      `json:"draft"`
+	Body        string    `json:"body"`
+	PublishedAt time.Time `json:"published_at"`
+	Assets      []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+		Size int64  `json:"size"`
+	} `json:"assets"`
+}
+
+// SyncGitHub copies the releases of the GitHub repository (owner/name) the
+// feed does not have yet. An asset <name>.sig holds the signature of <name>.
+func (s *ReleaseStore) SyncGitHub(repo string) error {
+	client := &http.Client{Timeout: 10 * time.Minute}
+
+	resp, err := client.Get("https://api.github.com/repos/" + repo + "/releases?per_page=10")
+	if err != nil {
+		return fmt.Errorf("failed to list GitHub releases: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list GitHub releases, got status code: %d", resp.StatusCode)
+	}
+
+	var items []githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return fmt.Errorf("failed to decode GitHub releases: %w", err)
+	}
+
+	for _, item := range items {
+		if item.Draft || !releases.ValidVersion(item.TagName) || s.Has(item.TagName) {
+			continue
+		}
+
+		signatures := make(map[string]string)
+		for _, a := range item.Assets {
+			if name, ok := strings.CutSuffix(a.Name, ".sig"); ok {
+				b, err := fetchGitHubAsset(client, a.URL)
+				if err != nil {
+					return err
+				}
+				sig, _ := io.ReadAll(io.LimitReader(b, 4<<10))
+				_ = b.Close()
+				signatures[name] = strings.TrimSpace(string(sig))
+			}
+		}
+
+		for _, a := range item.Assets {
+			if strings.HasSuffix(a.Name, ".sig") || a.Size > maxArtifactSize {
+				continue
+			}
+			b, err := fetchGitHubAsset(client, a.URL)
+			if err != nil {
+				return err
+			}
+			_, err = s.Add(item.TagName, a.Name, b, signatures[a.Name])
+			_ = b.Close()
+			if errors.Is(err, releases.ErrUnsigned) {
+				log.Printf("Not mirroring unsigned %s/%s", item.TagName, a.Name)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to mirror %s/%s: %w", item.TagName, a.Name, err)
+			}
+		}
+
+		if err := s.setReleaseInfo(item.TagName, item.PublishedAt, item.Body); err != nil {
+			return err
+		}
+		log.Printf("Mirrored release %s from GitHub", item.TagName)
+	}
+	return nil
+}
+
+func fetchGitHubAsset(client *http.Client, u string) (io.ReadCloser, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", u, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s, got status code: %d", u, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (s *ReleaseStore) setReleaseInfo(version string, published time.Time, notes string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	release, ok := s.manifest.Find(version)
+	if !ok {
+		return nil
+	}
+	if !published.IsZero() {
+		release.Published = published
+	}
+	release.Notes = notes
+	return s.saveLocked()
+}
+
+func runGitHubMirror(s *ReleaseStore, repo string, interval time.Duration) {
+	for {
+		if err := s.SyncGitHub(repo); err != nil {
+			log.Printf("failed to sync releases from GitHub: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
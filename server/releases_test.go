@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestArtifactHandlerCaching(t *testing.T) {
+	s, err := OpenReleaseStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /releases/{version}/{name}", s.ArtifactHandler)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/releases/"+path, nil))
+		return w
+	}
+
+	first, err := s.Add("v1.0.0", "agent.exe", strings.NewReader("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := s.Manifest()
+	r, _ := m.Find("v1.0.0")
+	firstPath := r.Path(first)
+
+	w := get(firstPath)
+	if w.Code != http.StatusOK || w.Body.String() != "first" || !strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+		t.Fatalf("got %d %q cached %q, want the first upload cached for good", w.Code, w.Body.String(), w.Header().Get("Cache-Control"))
+	}
+
+	second, err := s.Add("1.0.0", "agent.exe", strings.NewReader("second"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := get(firstPath); w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d for the replaced upload, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := get(r.Path(second)); w.Code != http.StatusOK || w.Body.String() != "second" || !strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+		t.Fatalf("got %d %q cached %q, want the second upload cached for good", w.Code, w.Body.String(), w.Header().Get("Cache-Control"))
+	}
+	if w := get("1.0.0/agent.exe"); w.Code != http.StatusOK || w.Body.String() != "second" || w.Header().Get("Cache-Control") != "max-age=0" {
+		t.Fatalf("got %d %q cached %q without the SHA-256, want the second upload uncached", w.Code, w.Body.String(), w.Header().Get("Cache-Control"))
+	}
+	if w := get("v1.0.0/other.exe"); w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d for an unknown asset, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+	"github.com/willywotz/fivem/releases"
+)
+
+var (
+	errUnknownChannel = errors.New("unknown channel")
+	errNoRollout      = errors.New("channel has no rollout")
+	errRolloutChanged = errors.New("channel rolls out another version")
+)
+
+// Channel is the version a release channel runs, plus the rollout of the
+// next one if any.
+type Channel struct {
+	Version string   `json:"version"`
+	Rollout *Rollout `json:"rollout,omitempty"`
+}
+
+// Rollout moves a percentage of a channel to Version. Machines are picked by
+// a hash of their machine ID, so raising Percent only adds machines.
+type Rollout struct {
+	Version     string    `json:"version"`
+	Percent     int       `json:"percent"`
+	Started     time.Time `json:"started"`
+	Paused      bool      `json:"paused"`
+	PauseReason string    `json:"pause_reason,omitempty"`
+	// Assigned records when each machine was first told to run Version, for
+	// the health check.
+	Assigned map[string]time.Time `json:"assigned"`
+	// RolledBack holds the reason of each machine that rolled Version back.
+	RolledBack map[string]string `json:"rolled_back,omitempty"`
+	// Reported holds the version each process of an assigned machine last
+	// ran, by machine ID and From, as told by enrolled agents since the
+	// machine was assigned.
+	Reported map[string]map[string]ReportedVersion `json:"reported,omitempty"`
+}
+
+// ReportedVersion is the version a process of a machine ran at Time.
+type ReportedVersion struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+type Rollouts struct {
+	Channels map[string]*Channel `json:"channels"`
+	// MachineChannels puts machines in a channel other than the one they
+	// ask for.
+	MachineChannels map[string]string `json:"machine_channels"`
+	// Pins fixes the version of single machines, overriding any channel.
+	Pins map[string]string `json:"pins"`
+	// Retries holds until when machines are asked to install the versions
+	// they rolled back again, long enough for the service and the client to
+	// ask for their version.
+	Retries map[string]time.Time `json:"retries,omitempty"`
+}
+
+// retryWindow is how long the agents of a machine are asked to retry
+// their rolled back versions.
+const retryWindow = time.Hour
+
+// RolloutHealth decides when a rollout is paused: once at least MinFailures
+// of the machines assigned to it either rolled it back or, assigned for
+// longer than Timeout, still run another version in a process, see
+// runsVersion, and they are at least MaxFailurePercent of those machines.
+type RolloutHealth struct {
+	Timeout           time.Duration
+	MinFailures       int
+	MaxFailurePercent int
+}
+
+type RolloutStore struct {
+	mu       sync.Mutex
+	path     string
+	rollouts Rollouts
+	// unsaved is set by assignments, which are saved by SaveAssignments
+	// rather than on every request.
+	unsaved bool
+}
+
+func OpenRolloutStore(path string) (*RolloutStore, error) {
+	s := &RolloutStore{path: path}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read rollouts: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.rollouts); err != nil {
+			return nil, fmt.Errorf("failed to decode rollouts: %w", err)
+		}
+	}
+
+	if s.rollouts.Channels == nil {
+		s.rollouts.Channels = make(map[string]*Channel)
+	}
+	for _, name := range protocol.Channels {
+		if s.rollouts.Channels[name] == nil {
+			s.rollouts.Channels[name] = &Channel{}
+		}
+	}
+	if s.rollouts.MachineChannels == nil {
+		s.rollouts.MachineChannels = make(map[string]string)
+	}
+	if s.rollouts.Pins == nil {
+		s.rollouts.Pins = make(map[string]string)
+	}
+	if s.rollouts.Retries == nil {
+		s.rollouts.Retries = make(map[string]time.Time)
+	}
+
+	return s, nil
+}
+
+func (s *RolloutStore) saveLocked() error {
+	b, err := json.MarshalIndent(s.rollouts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode rollouts: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("failed to write rollouts: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace rollouts: %w", err)
+	}
+	s.unsaved = false
+	return nil
+}
+
+// SaveAssignments saves the machines assigned to rollouts since the last
+// save.
+func (s *RolloutStore) SaveAssignments() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.unsaved {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+// rolloutBucket maps a machine to 0-99 for the rollout of version on channel.
+func rolloutBucket(channel, version, machineID string) int {
+	sum := sha256.Sum256([]byte(channel + "/" + version + "/" + machineID))
+	return int(binary.BigEndian.Uint32(sum[:4]) % 100)
+}
+
+// Target returns the version machineID should run. The channel it asked for
+// applies unless an operator moved it to another one. An empty machineID,
+// of a machine that could not prove who it is, gets the channel's version
+// and is never assigned to a rollout.
+func (s *RolloutStore) Target(machineID, channel string) protocol.UpdateTarget {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.rollouts.MachineChannels[machineID]; ok {
+		channel = c
+	}
+	if !protocol.ValidChannel(channel) {
+		channel = protocol.ChannelStable
+	}
+	target := protocol.UpdateTarget{Channel: channel}
+	if until, ok := s.rollouts.Retries[machineID]; ok && time.Now().Before(until) {
+		target.Retry = true
+	}
+
+	if pin, ok := s.rollouts.Pins[machineID]; ok {
+		target.Version = pin
+		return target
+	}
+
+	c := s.rollouts.Channels[channel]
+	if c.Version == "" && c.Rollout == nil {
+		// An unused channel follows stable.
+		channel = protocol.ChannelStable
+		c = s.rollouts.Channels[channel]
+	}
+	target.Version = c.Version
+
+	r := c.Rollout
+	if r == nil || machineID == "" {
+		return target
+	}
+	if _, assigned := r.Assigned[machineID]; assigned {
+		target.Version = r.Version
+		return target
+	}
+	// A paused rollout keeps the machines it has, but takes no new ones.
+	if r.Paused || rolloutBucket(channel, r.Version, machineID) >= r.Percent {
+		return target
+	}
+
+	target.Version = r.Version
+	r.Assigned[machineID] = time.Now()
+	s.unsaved = true
+	return target
+}
+
+func (s *RolloutStore) Get() Rollouts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, _ := json.Marshal(s.rollouts)
+	var rollouts Rollouts
+	_ = json.Unmarshal(b, &rollouts)
+	return rollouts
+}
+
+// Start rolls version out to percent of channel. Rolling out to 100 percent
+// makes version the channel's version and ends the rollout.
+func (s *RolloutStore) Start(channel, version string, percent int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.rollouts.Channels[channel]
+	if !ok {
+		return errUnknownChannel
+	}
+
+	switch {
+	case percent >= 100:
+		c.Version = version
+		c.Rollout = nil
+	case c.Rollout != nil && c.Rollout.Version == version:
+		c.Rollout.Percent = percent
+	default:
+		c.Rollout = &Rollout{
+			Version:  version,
+			Percent:  percent,
+			Started:  time.Now(),
+			Assigned: make(map[string]time.Time),
+		}
+	}
+	return s.saveLocked()
+}
+
+// SetPaused pauses or resumes the rollout of channel, if version is not
+// empty only while that version is rolled out.
+func (s *RolloutStore) SetPaused(channel, version string, paused bool, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.rollouts.Channels[channel]
+	if !ok {
+		return errUnknownChannel
+	}
+	if c.Rollout == nil {
+		return errNoRollout
+	}
+	if version != "" && c.Rollout.Version != version {
+		return errRolloutChanged
+	}
+	c.Rollout.Paused = paused
+	c.Rollout.PauseReason = reason
+	return s.saveLocked()
+}
+
+// SetMachine moves machineID to channel and pins it to version; empty values
+// clear them.
+func (s *RolloutStore) SetMachine(machineID, channel, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if channel != "" && !protocol.ValidChannel(channel) {
+		return errUnknownChannel
+	}
+
+	if channel == "" {
+		delete(s.rollouts.MachineChannels, machineID)
+	} else {
+		s.rollouts.MachineChannels[machineID] = channel
+	}
+	if version == "" {
+		delete(s.rollouts.Pins, machineID)
+	} else {
+		s.rollouts.Pins[machineID] = version
+	}
+	return s.saveLocked()
+}
+
+// Retry asks the agents of machineID to install the versions they rolled
+// back again, and forgets its rollbacks.
+func (s *RolloutStore) Retry(machineID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, until := range s.rollouts.Retries {
+		if now.After(until) {
+			delete(s.rollouts.Retries, id)
+		}
+	}
+	s.rollouts.Retries[machineID] = now.Add(retryWindow)
+	for _, c := range s.rollouts.Channels {
+		if c.Rollout != nil {
+			delete(c.Rollout.RolledBack, machineID)
+		}
+	}
+	return s.saveLocked()
+}
+
+// CheckHealth pauses every running rollout whose machines do not come up on
+// the new version.
+func (s *RolloutStore) CheckHealth(h RolloutHealth) {
+	now := time.Now()
+	for name, c := range s.Get().Channels {
+		r := c.Rollout
+		if r == nil || r.Paused {
+			continue
+		}
+
+		var healthy, failed int
+		for machineID, assigned := range r.Assigned {
+			if _, ok := r.RolledBack[machineID]; ok {
+				failed++
+				continue
+			}
+			if now.Sub(assigned) < h.Timeout {
+				continue
+			}
+			switch ok, reported := runsVersion(r.Reported[machineID], r.Version); {
+			case !reported:
+				// Switched off since, nothing to tell.
+			case ok:
+				healthy++
+			default:
+				failed++
+			}
+		}
+
+		if failed == 0 || failed < h.MinFailures || failed*100 < h.MaxFailurePercent*(healthy+failed) {
+			continue
+		}
+
+		reason := fmt.Sprintf("%d of %d machines on %s rolled back or did not come up on it", failed, healthy+failed, r.Version)
+		if err := s.SetPaused(name, r.Version, true, reason); err != nil {
+			if errors.Is(err, errRolloutChanged) || errors.Is(err, errNoRollout) {
+				// Replaced while judging it.
+				continue
+			}
+			log.Printf("failed to pause rollout of %s: %v", name, err)
+			continue
+		}
+		log.Printf("Paused rollout of %s on %s: %s", r.Version, name, reason)
+		hub.Broadcast(notice("Paused rollout of %s on %s: %s", r.Version, name, reason))
+	}
+}
+
+// runsVersion reports whether every process of a machine that reported
+// its version since the machine was assigned last ran version. A machine
+// none of whose processes reported is not judged.
+func runsVersion(reported map[string]ReportedVersion, version string) (ok, judged bool) {
+	for _, v := range reported {
+		if !releases.SameVersion(v.Version, version) {
+			return false, true
+		}
+	}
+	return true, len(reported) > 0
+}
+
+// ReportVersion records that the from process of machineID runs version, for
+// the health check of the rollouts it is assigned to. Only enrolled agents,
+// which proved who they are, report.
+func (s *RolloutStore) ReportVersion(machineID, from, version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if (from != "service" && from != "client") || !releases.ValidVersion(version) {
+		return
+	}
+	now := time.Now()
+	for _, c := range s.rollouts.Channels {
+		r := c.Rollout
+		if r == nil {
+			continue
+		}
+		if _, assigned := r.Assigned[machineID]; !assigned {
+			continue
+		}
+		if r.Reported == nil {
+			r.Reported = make(map[string]map[string]ReportedVersion)
+		}
+		if r.Reported[machineID] == nil {
+			r.Reported[machineID] = make(map[string]ReportedVersion)
+		}
+		r.Reported[machineID][from] = ReportedVersion{Version: version, Time: now}
+		s.unsaved = true
+	}
+}
+
+// ReportRollback records that a machine rolled version back.
+func (s *RolloutStore) ReportRollback(report *protocol.UpdateReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.rollouts.Channels {
+		r := c.Rollout
+		if r == nil || !releases.SameVersion(r.Version, report.Version) {
+			continue
+		}
+		if _, assigned := r.Assigned[report.MachineID]; !assigned {
+			continue
+		}
+		if r.RolledBack == nil {
+			r.RolledBack = make(map[string]string)
+		}
+		r.RolledBack[report.MachineID] = report.Reason
+		return s.saveLocked()
+	}
+	return nil
+}
+
+func runRolloutHealth(s *RolloutStore, h RolloutHealth, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.SaveAssignments(); err != nil {
+			log.Printf("failed to save rollouts: %v", err)
+		}
+		s.CheckHealth(h)
+	}
+}
+
+// TargetHandler answers agents asking which version to run. Requests have
+// to be signed with the agent key, see EnrollmentStore.VerifyRequest;
+// agents too old to sign them, or not enrolled yet, get the version of their
+// channel. The version and From of signed requests go to the health check.
+func (s *RolloutStore) TargetHandler(w http.ResponseWriter, r *http.Request) {
+	machineID, err := enrollments.VerifyRequest(r, nil)
+	if errors.Is(err, errAgentUnsigned) || errors.Is(err, errEnrollmentNotFound) {
+		machineID, err = "", nil
+	}
+	if err != nil {
+		log.Printf("refused update target for %s from %s: %v", r.Header.Get(protocol.HeaderMachineID), remoteIP(r), err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	target := s.Target(machineID, r.URL.Query().Get("channel"))
+	if machineID != "" {
+		s.ReportVersion(machineID, r.URL.Query().Get("from"), r.URL.Query().Get("version"))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(target); err != nil {
+		log.Printf("failed to encode update target: %v\n", err)
+	}
+}
+
+// ReportHandler takes the rollbacks agents post to /update/report, signed
+// with their agent key.
+func (s *RolloutStore) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	defer func() { _ = r.Body.Close() }()
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	machineID, err := enrollments.VerifyRequest(r, body)
+	if errors.Is(err, errAgentUnsigned) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("refused rollback report of %s from %s: %v", r.Header.Get(protocol.HeaderMachineID), remoteIP(r), err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var report protocol.UpdateReport
+	if err := json.Unmarshal(body, &report); err != nil || report.MachineID != machineID || report.Version == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Machine ID %s rolled back %s to %s: %s", report.MachineID, report.Version, report.RunningVersion, report.Reason)
+	hub.Broadcast(notice("Machine ID %s rolled back %s to %s: %s", report.MachineID, report.Version, report.RunningVersion, report.Reason))
+
+	if err := s.ReportRollback(&report); err != nil {
+		log.Printf("failed to record rollback: %v", err)
+		http.Error(w, "failed to record rollback", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *RolloutStore) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(s.Get()); err != nil {
+		log.Printf("failed to encode rollouts: %v\n", err)
+	}
+}
+
+// StartHandler takes {"version": "v1.2.3", "percent": 10} for the
+// {channel} path value.
+func (s *RolloutStore) StartHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.PathValue("channel")
+
+	var body struct {
+		Version string `json:"version"`
+		Percent int    `json:"percent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Version == "" || body.Percent < 0 {
+		http.Error(w, "invalid rollout", http.StatusBadRequest)
+		return
+	}
+	version, ok := releaseStore.Tag(body.Version)
+	if !ok {
+		http.Error(w, fmt.Sprintf("version %s is not in the release feed", body.Version), http.StatusBadRequest)
+		return
+	}
+
+	s.respond(w, r, s.Start(channel, version, body.Percent), fmt.Sprintf("rollout %s to %d%% of %s", version, body.Percent, channel))
+}
+
+func (s *RolloutStore) PauseHandler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		channel := r.PathValue("channel")
+
+		action, reason := "resume", ""
+		if paused {
+			action, reason = "pause", "paused by operator"
+		}
+		s.respond(w, r, s.SetPaused(channel, "", paused, reason), action+" rollout of "+channel)
+	}
+}
+
+// MachineHandler takes {"channel": "beta", "version": "v1.2.3"} for the
+// {machine_id} path value.
+func (s *RolloutStore) MachineHandler(w http.ResponseWriter, r *http.Request) {
+	machineID := r.PathValue("machine_id")
+
+	var body struct {
+		Channel string `json:"channel"`
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid machine rollout", http.StatusBadRequest)
+		return
+	}
+	if body.Version != "" {
+		version, ok := releaseStore.Tag(body.Version)
+		if !ok {
+			http.Error(w, fmt.Sprintf("version %s is not in the release feed", body.Version), http.StatusBadRequest)
+			return
+		}
+		body.Version = version
+	}
+
+	s.respond(w, r, s.SetMachine(machineID, body.Channel, body.Version), fmt.Sprintf("set channel of %s to %q and pin to %q", machineID, body.Channel, body.Version))
+}
+
+// RetryHandler asks the {machine_id} machine to install the versions it
+// rolled back again.
+func (s *RolloutStore) RetryHandler(w http.ResponseWriter, r *http.Request) {
+	machineID := r.PathValue("machine_id")
+	s.respond(w, r, s.Retry(machineID), "retry rolled back versions on "+machineID)
+}
+
+func (s *RolloutStore) respond(w http.ResponseWriter, r *http.Request, err error, action string) {
+	if errors.Is(err, errUnknownChannel) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNoRollout) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to update rollouts: %v", err)
+		http.Error(w, "failed to update rollouts", http.StatusInternalServerError)
+		return
+	}
+
+	if op := auth.Operator(r); op != nil {
+		auth.Audit(op, r, action)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
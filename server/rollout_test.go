@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+)
+
+// enrollAgent enrolls a new machine ID with a new key.
+func enrollAgent(t *testing.T, name string) (string, ed25519.PrivateKey) {
+	t.Helper()
+
+	machineID, key := newMachineID(name), newAgentKey(t)
+	publicKey := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, protocol.AgentRegistrationMessage(machineID, "nonce")))
+	if err := enrollments.Verify(machineID, "host-"+machineID, "user", publicKey, "nonce", signature); err != nil {
+		t.Fatal(err)
+	}
+	return machineID, key
+}
+
+// signedRequest makes a request signed like the agent does, at the given
+// time.
+func signedRequest(method, uri string, body []byte, machineID string, key ed25519.PrivateKey, at time.Time) *http.Request {
+	r := httptest.NewRequest(method, uri, bytes.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set(protocol.HeaderMachineID, machineID)
+	r.Header.Set(protocol.HeaderTimestamp, timestamp)
+	r.Header.Set(protocol.HeaderSignature, base64.StdEncoding.EncodeToString(ed25519.Sign(key, protocol.AgentRequestMessage(machineID, method, r.URL.RequestURI(), timestamp, body))))
+	return r
+}
+
+// newRolloutTest returns a store whose stable channel runs v1.0.0 and rolls
+// out v1.1.0 to 99 percent.
+func newRolloutTest(t *testing.T) *RolloutStore {
+	t.Helper()
+
+	s, err := OpenRolloutStore(filepath.Join(t.TempDir(), "rollouts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(protocol.ChannelStable, "v1.0.0", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(protocol.ChannelStable, "v1.1.0", 99); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// enrollRolloutAgent enrolls a machine in the bucket of the rollout.
+func enrollRolloutAgent(t *testing.T, name string) (string, ed25519.PrivateKey) {
+	t.Helper()
+
+	for {
+		machineID, key := enrollAgent(t, name)
+		if rolloutBucket(protocol.ChannelStable, "v1.1.0", machineID) < 99 {
+			return machineID, key
+		}
+	}
+}
+
+func getTarget(t *testing.T, s *RolloutStore, r *http.Request) (int, protocol.UpdateTarget) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.TargetHandler(w, r)
+	var target protocol.UpdateTarget
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, target
+}
+
+func TestTargetHandler(t *testing.T) {
+	s := newRolloutTest(t)
+	machineID, key := enrollRolloutAgent(t, "rollout")
+	const uri = "/update?channel=stable&version=v1.0.0"
+
+	// Agents that cannot sign are never assigned.
+	code, target := getTarget(t, s, httptest.NewRequest(http.MethodGet, uri+"&machine_id="+machineID, nil))
+	if code != http.StatusOK || target.Version != "v1.0.0" {
+		t.Fatalf("got %d %+v unsigned, want v1.0.0", code, target)
+	}
+	if len(s.Get().Channels[protocol.ChannelStable].Rollout.Assigned) != 0 {
+		t.Fatal("an unsigned request was assigned to the rollout")
+	}
+
+	_, other := enrollAgent(t, "other")
+	for name, r := range map[string]*http.Request{
+		"another key": signedRequest(http.MethodGet, uri, nil, machineID, other, time.Now()),
+		"stale":       signedRequest(http.MethodGet, uri, nil, machineID, key, time.Now().Add(-time.Hour)),
+		"another uri": signedRequest(http.MethodGet, "/update?channel=canary", nil, machineID, key, time.Now()),
+	} {
+		r.URL.RawQuery = strings.TrimPrefix(uri, "/update?")
+		if code, _ := getTarget(t, s, r); code != http.StatusForbidden {
+			t.Errorf("got status %d signed with %s, want %d", code, name, http.StatusForbidden)
+		}
+	}
+
+	code, target = getTarget(t, s, signedRequest(http.MethodGet, uri, nil, machineID, key, time.Now()))
+	if code != http.StatusOK || target.Version != "v1.1.0" {
+		t.Fatalf("got %d %+v signed, want v1.1.0", code, target)
+	}
+
+	// Assignments are saved by the health check tick, not per request.
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte(machineID)) {
+		t.Fatal("the assignment was saved by the request")
+	}
+	if err := s.SaveAssignments(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenRolloutStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get().Channels[protocol.ChannelStable].Rollout.Assigned[machineID]; !ok {
+		t.Fatal("the assignment was not saved")
+	}
+}
+
+func TestReportHandler(t *testing.T) {
+	s := newRolloutTest(t)
+	machineID, key := enrollRolloutAgent(t, "report")
+	getTarget(t, s, signedRequest(http.MethodGet, "/update?channel=stable", nil, machineID, key, time.Now()))
+
+	report := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		s.ReportHandler(w, r)
+		return w.Code
+	}
+	body, _ := json.Marshal(protocol.UpdateReport{MachineID: machineID, Version: "1.1.0", RunningVersion: "v1.0.0", Reason: "crashed"})
+
+	if code := report(httptest.NewRequest(http.MethodPost, "/update/report", bytes.NewReader(body))); code != http.StatusUnauthorized {
+		t.Fatalf("got status %d unsigned, want %d", code, http.StatusUnauthorized)
+	}
+	otherID, otherKey := enrollAgent(t, "other")
+	if code := report(signedRequest(http.MethodPost, "/update/report", body, otherID, otherKey, time.Now())); code != http.StatusBadRequest {
+		t.Fatalf("got status %d reporting for another machine, want %d", code, http.StatusBadRequest)
+	}
+	if _, ok := s.Get().Channels[protocol.ChannelStable].Rollout.RolledBack[machineID]; ok {
+		t.Fatal("recorded the rollback another machine reported")
+	}
+
+	if code := report(signedRequest(http.MethodPost, "/update/report", body, machineID, key, time.Now())); code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", code, http.StatusNoContent)
+	}
+	if reason := s.Get().Channels[protocol.ChannelStable].Rollout.RolledBack[machineID]; reason != "crashed" {
+		t.Fatalf("got rollback reason %q, want crashed", reason)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	now := time.Now()
+	h := RolloutHealth{Timeout: 30 * time.Minute, MinFailures: 1}
+	reported := func(versions ...string) map[string]ReportedVersion {
+		m := make(map[string]ReportedVersion)
+		for i, from := range []string{"service", "client"}[:len(versions)] {
+			m[from] = ReportedVersion{Version: versions[i], Time: now.Add(-10 * time.Minute)}
+		}
+		return m
+	}
+
+	tests := []struct {
+		maxFailurePercent int
+		paused            bool
+	}{
+		{50, false},
+		{40, true},
+	}
+	for _, tt := range tests {
+		s := newRolloutTest(t)
+		assigned := now.Add(-time.Hour)
+		r := s.rollouts.Channels[protocol.ChannelStable].Rollout
+		r.Assigned = map[string]time.Time{
+			"both": assigned, "service": assigned, "bare": assigned, "behind": assigned, "stuck": assigned,
+			// Switched off since it was assigned.
+			"off": assigned,
+			// Not assigned long enough to tell.
+			"new": now,
+		}
+		r.Reported = map[string]map[string]ReportedVersion{
+			// Both processes moved.
+			"both": reported("v1.1.0", "v1.1.0"),
+			// No client runs, the service moved.
+			"service": reported("v1.1.0"),
+			"bare":    reported("1.1.0"),
+			// The client stayed behind.
+			"behind": reported("v1.1.0", "v1.0.0"),
+			// Asked for the version, but never came up on it.
+			"stuck": reported("v1.0.0"),
+			"new":   reported("v1.0.0"),
+		}
+
+		h.MaxFailurePercent = tt.maxFailurePercent
+		s.CheckHealth(h)
+		r = s.Get().Channels[protocol.ChannelStable].Rollout
+		if r.Paused != tt.paused {
+			t.Errorf("got paused %v at %d%%, want %v", r.Paused, tt.maxFailurePercent, tt.paused)
+		}
+		if tt.paused && !strings.HasPrefix(r.PauseReason, "2 of 5 machines") {
+			t.Errorf("got pause reason %q, want 2 of 5 machines", r.PauseReason)
+		}
+	}
+}
+
+func TestSetPausedVersion(t *testing.T) {
+	s := newRolloutTest(t)
+
+	// Health judged v1.1.0, but an operator started another rollout since.
+	if err := s.Start(protocol.ChannelStable, "v1.2.0", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPaused(protocol.ChannelStable, "v1.1.0", true, "failed"); !errors.Is(err, errRolloutChanged) {
+		t.Fatalf("got %v, want %v", err, errRolloutChanged)
+	}
+	if r := s.Get().Channels[protocol.ChannelStable].Rollout; r.Paused {
+		t.Fatalf("paused the rollout of %s for %s", r.Version, r.PauseReason)
+	}
+
+	if err := s.SetPaused(protocol.ChannelStable, "v1.2.0", true, "failed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPaused(protocol.ChannelStable, "", false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.Get().Channels[protocol.ChannelStable].Rollout; r.Paused {
+		t.Fatal("an operator did not resume the rollout")
+	}
+}
+
+func TestReportVersion(t *testing.T) {
+	s := newRolloutTest(t)
+	machineID, key := enrollRolloutAgent(t, "report-version")
+	reported := func() map[string]ReportedVersion {
+		return s.Get().Channels[protocol.ChannelStable].Rollout.Reported[machineID]
+	}
+
+	// Only signed requests report, an unsigned one could claim any machine.
+	getTarget(t, s, httptest.NewRequest(http.MethodGet, "/update?channel=stable&from=service&version=v1.0.0&machine_id="+machineID, nil))
+	if r := reported(); len(r) != 0 {
+		t.Fatalf("an unsigned request reported %+v", r)
+	}
+
+	// The request that assigns the machine reports the version it ran.
+	getTarget(t, s, signedRequest(http.MethodGet, "/update?channel=stable&from=service&version=v1.0.0", nil, machineID, key, time.Now()))
+	getTarget(t, s, signedRequest(http.MethodGet, "/update?channel=stable&from=client&version=v1.1.0", nil, machineID, key, time.Now()))
+	// Agents from before the from parameter do not report.
+	getTarget(t, s, signedRequest(http.MethodGet, "/update?channel=stable&version=v1.1.0", nil, machineID, key, time.Now()))
+	if r := reported(); len(r) != 2 || r["service"].Version != "v1.0.0" || r["client"].Version != "v1.1.0" {
+		t.Fatalf("got reported %+v, want the service on v1.0.0 and the client on v1.1.0", r)
+	}
+
+	// Registrations report too.
+	s.ReportVersion(machineID, "service", "v1.1.0")
+	s.ReportVersion(machineID, "service", strings.Repeat("x", 300))
+	if ok, judged := runsVersion(reported(), "v1.1.0"); !ok || !judged {
+		t.Fatalf("got %+v, want both processes on v1.1.0", reported())
+	}
+
+	// Machines that are not assigned are not recorded.
+	s.ReportVersion("unassigned", "service", "v1.1.0")
+	if r := s.Get().Channels[protocol.ChannelStable].Rollout.Reported["unassigned"]; r != nil {
+		t.Fatalf("recorded %+v for a machine not assigned", r)
+	}
+}
+
+func TestRolloutVersionInFeed(t *testing.T) {
+	store, err := OpenReleaseStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add("v1.2.0", "fivem-windows-amd64.exe", strings.NewReader("exe"), ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func(prev *ReleaseStore) { releaseStore = prev }(releaseStore)
+	releaseStore = store
+
+	s := newRolloutTest(t)
+	put := func(handler http.HandlerFunc, pattern, path, body string) int {
+		mux := http.NewServeMux()
+		mux.HandleFunc("PUT "+pattern, handler)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPut, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := put(s.StartHandler, "/api/rollouts/{channel}", "/api/rollouts/beta", `{"version": "v9.9.9", "percent": 10}`); code != http.StatusBadRequest {
+		t.Fatalf("got status %d rolling out a version not in the feed, want %d", code, http.StatusBadRequest)
+	}
+	if code := put(s.StartHandler, "/api/rollouts/{channel}", "/api/rollouts/beta", `{"version": "1.2.0", "percent": 10}`); code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", code, http.StatusNoContent)
+	}
+	if r := s.Get().Channels[protocol.ChannelBeta].Rollout; r == nil || r.Version != "v1.2.0" {
+		t.Fatalf("got rollout %+v, want one of v1.2.0", r)
+	}
+
+	if code := put(s.MachineHandler, "/api/rollouts/machines/{machine_id}", "/api/rollouts/machines/m", `{"version": "v9.9.9"}`); code != http.StatusBadRequest {
+		t.Fatalf("got status %d pinning a version not in the feed, want %d", code, http.StatusBadRequest)
+	}
+	if code := put(s.MachineHandler, "/api/rollouts/machines/{machine_id}", "/api/rollouts/machines/m", `{"version": "1.2.0"}`); code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", code, http.StatusNoContent)
+	}
+	if pin := s.Get().Pins["m"]; pin != "v1.2.0" {
+		t.Fatalf("got pin %q, want v1.2.0", pin)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	s := newRolloutTest(t)
+	machineID, key := enrollRolloutAgent(t, "retry")
+	s.rollouts.Channels[protocol.ChannelStable].Rollout.RolledBack = map[string]string{machineID: "crashed"}
+	const uri = "/update?channel=stable"
+
+	if _, target := getTarget(t, s, signedRequest(http.MethodGet, uri, nil, machineID, key, time.Now())); target.Retry {
+		t.Fatal("asked to retry before the operator did")
+	}
+	if err := s.Retry(machineID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get().Channels[protocol.ChannelStable].Rollout.RolledBack[machineID]; ok {
+		t.Fatal("the rollback was kept")
+	}
+	// Both processes of the machine are asked.
+	for range 2 {
+		if _, target := getTarget(t, s, signedRequest(http.MethodGet, uri, nil, machineID, key, time.Now())); !target.Retry || target.Version != "v1.1.0" {
+			t.Fatalf("got %+v, want a retry of v1.1.0", target)
+		}
+	}
+	if _, target := getTarget(t, s, httptest.NewRequest(http.MethodGet, uri+"&machine_id="+machineID, nil)); target.Retry {
+		t.Fatal("asked an unsigned request to retry")
+	}
+
+	s.rollouts.Retries[machineID] = time.Now().Add(-time.Minute)
+	if _, target := getTarget(t, s, signedRequest(http.MethodGet, uri, nil, machineID, key, time.Now())); target.Retry {
+		t.Fatal("asked to retry after the window")
+	}
+}
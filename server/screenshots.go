@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/imaging"
+	"github.com/willywotz/fivem/protocol"
+)
+
+const thumbnailWidth = 320
+
+// maxScreenshotPixels bounds the images decoded for thumbnails, a bit more
+// than an 8K display.
+const maxScreenshotPixels = 8192 * 4608
+
+var errScreenshotNotFound = errors.New("screenshot not found")
+
+// screenshotExtensions are the image types agents capture, by content type.
+// Anything else is refused, as it would be served on the operator origin.
+var screenshotExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// screenshotContentType sniffs the content type of an image from its first
+// bytes.
+func screenshotContentType(head []byte) (string, error) {
+	contentType := http.DetectContentType(head)
+	if _, ok := screenshotExtensions[contentType]; !ok {
+		return "", fmt.Errorf("screenshot of type %s is not an image", contentType)
+	}
+	return contentType, nil
+}
+
+// Screenshot is the metadata of one stored display capture. The image lives
+// next to it in the store directory.
+type Screenshot struct {
+	ID            string          `json:"id"`
+	MachineID     string          `json:"machine_id"`
+	Hostname      string          `json:"hostname"`
+	Username      string          `json:"username"`
+	DisplayIndex  int             `json:"display_index"`
+	DisplayBounds image.Rectangle `json:"display_bounds"`
+	ContentType   string          `json:"content_type"`
+	Size          int64           `json:"size"`
+	RequestID     string          `json:"request_id"`
+	RequestedBy   string          `json:"requested_by"`
+	Time          time.Time       `json:"time"`
+}
+
+type ScreenshotStore struct {
+	mu    sync.Mutex
+	dir   string
+	items map[string]*Screenshot
+}
+
+func OpenScreenshotStore(dir string) (*ScreenshotStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create screenshot directory: %w", err)
+	}
+
+	s := &ScreenshotStore{dir: dir, items: make(map[string]*Screenshot)}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list screenshots: %w", err)
+	}
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read screenshot metadata: %w", err)
+		}
+		var item Screenshot
+		if err := json.Unmarshal(b, &item); err != nil {
+			log.Printf("skipping corrupt screenshot metadata %s: %v", name, err)
+			continue
+		}
+		s.items[item.ID] = &item
+	}
+
+	return s, nil
+}
+
+func (s *ScreenshotStore) imagePath(id string) string {
+	return filepath.Join(s.dir, id+".img")
+}
+
+func (s *ScreenshotStore) thumbnailPath(id string) string {
+	return filepath.Join(s.dir, id+".thumb.jpg")
+}
+
+func (s *ScreenshotStore) metadataPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Save stores data as a new screenshot described by item, filling in its ID,
+// size, content type and time.
+func (s *ScreenshotStore) Save(item Screenshot, data []byte) (*Screenshot, error) {
+	contentType, err := screenshotContentType(data)
+	if err != nil {
+		return nil, err
+	}
+
+	item.ID = protocol.NewID()
+	item.Size = int64(len(data))
+	item.ContentType = contentType
+
+	if err := os.WriteFile(s.imagePath(item.ID), data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write screenshot: %w", err)
+	}
+	return s.add(item)
+}
+
+// SaveFile is like Save for an image already on disk, which is moved into
+// the store. An upload that is not an image is removed.
+func (s *ScreenshotStore) SaveFile(item Screenshot, path string) (*Screenshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open screenshot: %w", err)
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	fi, err := f.Stat()
+	_ = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat screenshot: %w", err)
+	}
+	contentType, err := screenshotContentType(head[:n])
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	item.ID = protocol.NewID()
+	item.Size = fi.Size()
+	item.ContentType = contentType
+
+	if err := os.Rename(path, s.imagePath(item.ID)); err != nil {
+		return nil, fmt.Errorf("failed to move screenshot: %w", err)
+	}
+	return s.add(item)
+}
+
+func (s *ScreenshotStore) add(item Screenshot) (*Screenshot, error) {
+	if item.Time.IsZero() {
+		item.Time = time.Now()
+	}
+
+	meta, err := json.Marshal(item)
+	if err != nil {
+		_ = os.Remove(s.imagePath(item.ID))
+		return nil, fmt.Errorf("failed to encode screenshot metadata: %w", err)
+	}
+	if err := os.WriteFile(s.metadataPath(item.ID), meta, 0o600); err != nil {
+		_ = os.Remove(s.imagePath(item.ID))
+		return nil, fmt.Errorf("failed to write screenshot metadata: %w", err)
+	}
+
+	s.mu.Lock()
+	s.items[item.ID] = &item
+	s.mu.Unlock()
+
+	return &item, nil
+}
+
+// List returns screenshots newest first, optionally of one machine.
+func (s *ScreenshotStore) List(machineID string, offset, limit int) ([]Screenshot, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]Screenshot, 0)
+	for _, item := range s.items {
+		if machineID == "" || item.MachineID == machineID {
+			items = append(items, *item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Time.After(items[j].Time) })
+
+	total := len(items)
+	if offset >= total {
+		return []Screenshot{}, total
+	}
+	items = items[offset:]
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items, total
+}
+
+func (s *ScreenshotStore) Get(id string) (*Screenshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[id]
+	if !ok {
+		return nil, errScreenshotNotFound
+	}
+	copied := *item
+	return &copied, nil
+}
+
+func (s *ScreenshotStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[id]; !ok {
+		return errScreenshotNotFound
+	}
+	delete(s.items, id)
+
+	for _, name := range []string{s.metadataPath(id), s.imagePath(id), s.thumbnailPath(id)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete screenshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// Prune deletes screenshots older than maxAge.
+func (s *ScreenshotStore) Prune(maxAge time.Duration) (int, error) {
+	s.mu.Lock()
+	ids := make([]string, 0)
+	for id, item := range s.items {
+		if time.Since(item.Time) >= maxAge {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		if err := s.Delete(id); err != nil && !errors.Is(err, errScreenshotNotFound) {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+func runScreenshotRetention(s *ScreenshotStore, maxAge, interval time.Duration) {
+	for {
+		n, err := s.Prune(maxAge)
+		if err != nil {
+			log.Printf("failed to prune screenshots: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d screenshots", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Thumbnail returns a small JPEG of the screenshot, generated on first use.
+func (s *ScreenshotStore) Thumbnail(id string) ([]byte, error) {
+	if _, err := s.Get(id); err != nil {
+		return nil, err
+	}
+
+	if b, err := os.ReadFile(s.thumbnailPath(id)); err == nil {
+		return b, nil
+	}
+
+	f, err := os.Open(s.imagePath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open screenshot: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	// Agents choose the image, which may claim any size.
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode screenshot: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxScreenshotPixels {
+		return nil, fmt.Errorf("screenshot of %dx%d is too large for a thumbnail", config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read screenshot: %w", err)
+	}
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode screenshot: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := imaging.Encode(&buf, img, imaging.Options{Quality: 70, MaxWidth: thumbnailWidth}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	if err := os.WriteFile(s.thumbnailPath(id), buf.Bytes(), 0o600); err != nil {
+		log.Printf("failed to cache thumbnail of %s: %v", id, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SaveResult stores every image of an agent's screenshot result, whether
+// inline or uploaded, and records the stored IDs on the items.
+func (s *ScreenshotStore) SaveResult(result *protocol.ScreenshotResult, requestID, requestedBy string) {
+	for _, item := range result.Items {
+		meta := Screenshot{
+			MachineID:     result.MachineID,
+			Hostname:      result.Hostname,
+			Username:      result.Username,
+			DisplayIndex:  item.DisplayIndex,
+			DisplayBounds: item.DisplayBounds,
+			RequestID:     requestID,
+			RequestedBy:   requestedBy,
+		}
+
+		var stored *Screenshot
+		var err error
+		switch {
+		case item.UploadID != "":
+			var path string
+			if path, err = uploads.Take(result.MachineID, item.UploadID); err == nil {
+				stored, err = s.SaveFile(meta, path)
+			}
+		case item.Image != "":
+			var data []byte
+			if data, err = decodeBase64Image(item.Image); err == nil {
+				stored, err = s.Save(meta, data)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("failed to store screenshot from %s: %v", result.MachineID, err)
+			if item.Error == "" {
+				item.Error = "failed to store screenshot"
+			}
+			continue
+		}
+		item.ID = stored.ID
+	}
+}
+
+func (s *ScreenshotStore) ListHandler(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Items      []Screenshot `json:"items"`
+		TotalItems int          `json:"total_items"`
+		Page       int          `json:"page"`
+		PerPage    int          `json:"per_page"`
+	}
+
+	data.Page = 1
+	data.PerPage = 100
+
+	if page, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && page > 0 {
+		data.Page = page
+	}
+	if perPage, err := strconv.Atoi(r.URL.Query().Get("per_page")); err == nil && perPage > 0 && perPage <= 100 {
+		data.PerPage = perPage
+	}
+
+	data.Items, data.TotalItems = s.List(r.URL.Query().Get("machine_id"), (data.Page-1)*data.PerPage, data.PerPage)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("failed to encode screenshots: %v\n", err)
+	}
+}
+
+func (s *ScreenshotStore) GetHandler(w http.ResponseWriter, r *http.Request) {
+	item, err := s.Get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(item); err != nil {
+		log.Printf("failed to encode screenshot: %v\n", err)
+	}
+}
+
+func (s *ScreenshotStore) ImageHandler(w http.ResponseWriter, r *http.Request) {
+	item, err := s.Get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// Stored before content types were checked.
+	ext, ok := screenshotExtensions[item.ContentType]
+	if !ok {
+		http.Error(w, "screenshot is not an image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", item.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", `inline; filename="`+item.ID+ext+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, s.imagePath(item.ID))
+}
+
+func (s *ScreenshotStore) ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := s.Thumbnail(r.PathValue("id"))
+	if errors.Is(err, errScreenshotNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to create thumbnail: %v", err)
+		http.Error(w, "failed to create thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	_, _ = w.Write(b)
+}
+
+func (s *ScreenshotStore) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.Delete(id); err != nil {
+		if errors.Is(err, errScreenshotNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("failed to delete screenshot %s: %v", id, err)
+		http.Error(w, "failed to delete screenshot", http.StatusInternalServerError)
+		return
+	}
+
+	if op := auth.Operator(r); op != nil {
+		auth.Audit(op, r, "delete screenshot "+id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeBase64Image(s string) ([]byte, error) {
+	if _, data, ok := strings.Cut(s, ";base64,"); ok {
+		s = data
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
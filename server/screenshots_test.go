@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func pngImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestThumbnail(t *testing.T) {
+	s, err := OpenScreenshotStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := s.Save(Screenshot{MachineID: "m"}, pngImage(t, 1920, 1080))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Thumbnail(stored.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(b)); err != nil || config.Width != thumbnailWidth {
+		t.Fatalf("got thumbnail %+v, %v, want %d wide", config, err, thumbnailWidth)
+	}
+
+	// A PNG header claiming 65535x65535 pixels, which decoding would
+	// allocate.
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, 65535)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, 65535)
+	ihdr = append(ihdr, 8, 0, 0, 0, 0)
+	bomb := []byte("\x89PNG\r\n\x1a\n")
+	bomb = binary.BigEndian.AppendUint32(bomb, uint32(len(ihdr)-4))
+	bomb = append(bomb, ihdr...)
+	bomb = binary.BigEndian.AppendUint32(bomb, crc32.ChecksumIEEE(ihdr))
+	stored, err = s.Save(Screenshot{MachineID: "m"}, bomb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Thumbnail(stored.ID); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("got %v, want the screenshot refused as too large", err)
+	}
+}
+
+func TestScreenshotNotAnImage(t *testing.T) {
+	s, err := OpenScreenshotStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := []byte("<!DOCTYPE html><script>alert(document.cookie)</script>")
+	if _, err := s.Save(Screenshot{MachineID: "m"}, page); err == nil {
+		t.Fatal("stored an HTML page as a screenshot")
+	}
+	upload := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(upload, page, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SaveFile(Screenshot{MachineID: "m"}, upload); err == nil {
+		t.Fatal("stored an uploaded HTML page as a screenshot")
+	}
+	if _, err := os.Stat(upload); !os.IsNotExist(err) {
+		t.Fatalf("kept the refused upload: %v", err)
+	}
+	if _, total := s.List("", 0, 0); total != 0 {
+		t.Fatalf("got %d screenshots, want none", total)
+	}
+}
+
+func TestImageHandler(t *testing.T) {
+	s, err := OpenScreenshotStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.Save(Screenshot{MachineID: "m"}, pngImage(t, 16, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/screenshots/{id}/image", s.ImageHandler)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/screenshots/"+stored.ID+"/image", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":           "image/png",
+		"X-Content-Type-Options": "nosniff",
+		"Content-Disposition":    `inline; filename="` + stored.ID + `.png"`,
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+
+	// Stored before content types were checked.
+	s.items[stored.ID].ContentType = "text/html; charset=utf-8"
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/screenshots/"+stored.ID+"/image", nil))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("got status %d for an HTML screenshot, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/fivem"
+)
+
+// playerKeyKinds are the identifiers a player is recognized by, most stable
+// first.
+var playerKeyKinds = []string{"license", "license2", "steam", "discord", "fivem", "xbl", "live"}
+
+// playerKey identifies a player across sessions and servers. Servers that
+// do not list identifiers only leave the name to go by, escaped since the
+// key is a path segment of /players/{key}.
+func playerKey(p *fivem.Player) string {
+	for _, kind := range playerKeyKinds {
+		if id := p.Identifier(kind); id != "" {
+			return id
+		}
+	}
+	if len(p.Identifiers) > 0 {
+		return p.Identifiers[0]
+	}
+	return "name:" + url.PathEscape(p.Name)
+}
+
+// sessionGap is how long a server may go without a successful poll before
+// the sessions on it are ended at the last one, as nobody knows who stayed.
+func sessionGap(interval time.Duration) time.Duration {
+	return max(5*time.Minute, 3*interval)
+}
+
+// Session is a stretch of time a player spent on a server.
+type Session struct {
+	Server      string     `json:"server"`
+	Key         string     `json:"key"`
+	Name        string     `json:"name"`
+	Identifiers []string   `json:"identifiers,omitempty"`
+	JoinedAt    time.Time  `json:"joined_at"`
+	LeftAt      *time.Time `json:"left_at,omitempty"`
+	// Seconds is filled in the views, up to the last poll for a session that
+	// did not end.
+	Seconds int64 `json:"seconds"`
+}
+
+// sessionRecord is a line of the sessions file. Seen records mark
+// successful polls nobody joined or left in, so that after a restart open
+// sessions are ended at the last poll rather than the first one after it.
+type sessionRecord struct {
+	Type        string    `json:"type"`
+	Server      string    `json:"server"`
+	Key         string    `json:"key,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Identifiers []string  `json:"identifiers,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+const (
+	recordLeave = "leave"
+	recordJoin  = "join"
+	recordSeen  = "seen"
+)
+
+// SessionStore turns the players of successive polls into sessions, kept in
+// an append-only JSON lines file of join and leave records, which is
+// replayed on open and rewritten on prune.
+type SessionStore struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	sessions []*Session
+	byKey    map[string][]*Session
+	// open sessions by server and key.
+	open map[string]map[string]*Session
+	// seen is the last successful poll of a server, recorded is the last
+	// record written for it.
+	seen     map[string]time.Time
+	recorded map[string]time.Time
+}
+
+func OpenSessionStore(path string) (*SessionStore, error) {
+	s := &SessionStore{
+		path:     path,
+		byKey:    make(map[string][]*Session),
+		open:     make(map[string]map[string]*Session),
+		seen:     make(map[string]time.Time),
+		recorded: make(map[string]time.Time),
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open sessions file: %w", err)
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			var record sessionRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				log.Printf("skipping corrupt session record %s:%d: %v", path, line, err)
+				continue
+			}
+			s.apply(record)
+		}
+		err := scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sessions file: %w", err)
+		}
+	}
+	for server, t := range s.seen {
+		s.recorded[server] = t
+	}
+
+	if s.file, err = openAppendFile(path); err != nil {
+		return nil, fmt.Errorf("failed to open sessions file: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *SessionStore) apply(record sessionRecord) {
+	if record.Time.After(s.seen[record.Server]) {
+		s.seen[record.Server] = record.Time
+	}
+
+	open := s.open[record.Server]
+	if open == nil {
+		open = make(map[string]*Session)
+		s.open[record.Server] = open
+	}
+
+	switch record.Type {
+	case recordJoin:
+		if open[record.Key] != nil {
+			return
+		}
+		session := &Session{Server: record.Server, Key: record.Key, Name: record.Name, Identifiers: record.Identifiers, JoinedAt: record.Time}
+		open[record.Key] = session
+		s.sessions = append(s.sessions, session)
+		s.byKey[record.Key] = append(s.byKey[record.Key], session)
+	case recordLeave:
+		if session := open[record.Key]; session != nil {
+			leftAt := record.Time
+			session.LeftAt = &leftAt
+			delete(open, record.Key)
+		}
+	}
+}
+
+// Observe records who joined and left server since its last successful
+// poll, at which players were online. gap is the sessionGap of the server.
+func (s *SessionStore) Observe(server string, players []*Player, at time.Time, gap time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open := s.open[server]
+	var records []sessionRecord
+	// After a gap the sessions end at the last poll, and whoever is online
+	// now starts a new one.
+	if last, ok := s.seen[server]; ok && at.Sub(last) > gap {
+		for key := range open {
+			records = append(records, sessionRecord{Type: recordLeave, Server: server, Key: key, Time: last})
+		}
+		open = nil
+	}
+
+	online := make(map[string]*Player, len(players))
+	for _, p := range players {
+		online[p.Key] = p
+	}
+	for key := range open {
+		if online[key] == nil {
+			records = append(records, sessionRecord{Type: recordLeave, Server: server, Key: key, Time: at})
+		}
+	}
+	for key, p := range online {
+		if open[key] == nil {
+			records = append(records, sessionRecord{Type: recordJoin, Server: server, Key: key, Name: p.Name, Identifiers: p.Identifiers, Time: at})
+		}
+	}
+	if len(records) == 0 && at.Sub(s.recorded[server]) >= gap/2 {
+		records = append(records, sessionRecord{Type: recordSeen, Server: server, Time: at})
+	}
+
+	var b []byte
+	for _, record := range records {
+		s.apply(record)
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode session record: %w", err)
+		}
+		b = append(append(b, line...), '\n')
+	}
+	s.seen[server] = at
+	if len(b) == 0 {
+		return nil
+	}
+	s.recorded[server] = at
+	if _, err := s.file.Write(b); err != nil {
+		return fmt.Errorf("failed to write session records: %w", err)
+	}
+	return nil
+}
+
+// end is when session ended, or the last poll of its server for a session
+// that did not.
+func (s *SessionStore) end(session *Session) time.Time {
+	if session.LeftAt != nil {
+		return *session.LeftAt
+	}
+	return s.seen[session.Server]
+}
+
+func (s *SessionStore) view(session *Session) *Session {
+	v := *session
+	v.Seconds = int64(s.end(session).Sub(session.JoinedAt) / time.Second)
+	return &v
+}
+
+// Prune drops the sessions that ended more than maxAge ago; 0 keeps all.
+func (s *SessionStore) Prune(maxAge time.Duration) (int, error) {
+	if maxAge <= 0 {
+		return 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxAge)
+	old := s.sessions
+	s.sessions = slices.DeleteFunc(slices.Clone(old), func(session *Session) bool {
+		return session.LeftAt != nil && session.LeftAt.Before(cutoff)
+	})
+	n := len(old) - len(s.sessions)
+	if n == 0 {
+		return 0, nil
+	}
+	s.byKey = make(map[string][]*Session)
+	for _, session := range s.sessions {
+		s.byKey[session.Key] = append(s.byKey[session.Key], session)
+	}
+
+	records := make([]sessionRecord, 0, 2*len(s.sessions)+len(s.seen))
+	for _, session := range s.sessions {
+		records = append(records, sessionRecord{Type: recordJoin, Server: session.Server, Key: session.Key, Name: session.Name, Identifiers: session.Identifiers, Time: session.JoinedAt})
+		if session.LeftAt != nil {
+			records = append(records, sessionRecord{Type: recordLeave, Server: session.Server, Key: session.Key, Time: *session.LeftAt})
+		}
+	}
+	for server, t := range s.seen {
+		records = append(records, sessionRecord{Type: recordSeen, Server: server, Time: t})
+	}
+	// Replaying must end a session before the next one of the player begins.
+	order := map[string]int{recordLeave: 0, recordJoin: 1, recordSeen: 2}
+	slices.SortStableFunc(records, func(a, b sessionRecord) int {
+		if c := a.Time.Compare(b.Time); c != 0 {
+			return c
+		}
+		return order[a.Type] - order[b.Type]
+	})
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return n, fmt.Errorf("failed to create sessions file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			_ = tmp.Close()
+			return n, fmt.Errorf("failed to encode session record: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return n, fmt.Errorf("failed to write sessions file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return n, fmt.Errorf("failed to write sessions file: %w", err)
+	}
+
+	_ = s.file.Close()
+	renameErr := os.Rename(tmp.Name(), s.path)
+	if s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return n, fmt.Errorf("failed to reopen sessions file: %w", err)
+	}
+	if renameErr != nil {
+		return n, fmt.Errorf("failed to replace sessions file: %w", renameErr)
+	}
+
+	return n, nil
+}
+
+func runSessionRetention(store *SessionStore, maxAge, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := store.Prune(maxAge)
+		if err != nil {
+			log.Printf("failed to prune sessions: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Pruned %d sessions", n)
+		}
+	}
+}
+
+func (s *SessionStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// PlayerHistory is what is known of a player: the sessions, newest first,
+// and the playtime in seconds, in total and by server.
+type PlayerHistory struct {
+	Key             string           `json:"key"`
+	Name            string           `json:"name"`
+	Identifiers     []string         `json:"identifiers,omitempty"`
+	Online          bool             `json:"online"`
+	FirstSeen       time.Time        `json:"first_seen"`
+	LastSeen        time.Time        `json:"last_seen"`
+	Playtime        int64            `json:"playtime"`
+	PlaytimeServers map[string]int64 `json:"playtime_servers"`
+	Sessions        []*Session       `json:"sessions,omitempty"`
+}
+
+func (s *SessionStore) history(key string, sessions bool) *PlayerHistory {
+	h := &PlayerHistory{Key: key, PlaytimeServers: make(map[string]int64)}
+	for _, session := range s.byKey[key] {
+		v := s.view(session)
+		h.Name = v.Name
+		h.Identifiers = v.Identifiers
+		h.Online = h.Online || v.LeftAt == nil
+		if h.FirstSeen.IsZero() {
+			h.FirstSeen = v.JoinedAt
+		}
+		if end := s.end(session); end.After(h.LastSeen) {
+			h.LastSeen = end
+		}
+		h.Playtime += v.Seconds
+		h.PlaytimeServers[v.Server] += v.Seconds
+		if sessions {
+			h.Sessions = append(h.Sessions, v)
+		}
+	}
+	slices.Reverse(h.Sessions)
+	return h
+}
+
+// History returns the history of the player key, or false when the player
+// was never seen.
+func (s *SessionStore) History(key string) (*PlayerHistory, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.byKey[key]) == 0 {
+		return nil, false
+	}
+	return s.history(key, true), true
+}
+
+// List returns the history, without sessions, of the players whose name or
+// identifiers contain q, most playtime first.
+func (s *SessionStore) List(q string) []*PlayerHistory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q = strings.ToLower(q)
+	players := make([]*PlayerHistory, 0)
+	for key := range s.byKey {
+		h := s.history(key, false)
+		if q != "" && !strings.Contains(strings.ToLower(h.Name), q) && !slices.ContainsFunc(append([]string{key}, h.Identifiers...), func(id string) bool {
+			return strings.Contains(strings.ToLower(id), q)
+		}) {
+			continue
+		}
+		players = append(players, h)
+	}
+	slices.SortFunc(players, func(a, b *PlayerHistory) int {
+		if c := cmp.Compare(b.Playtime, a.Playtime); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return players
+}
+
+// HourPeak is the most players online at once within an hour.
+type HourPeak struct {
+	Hour time.Time `json:"hour"`
+	Peak int       `json:"peak"`
+}
+
+// Peaks returns the peak concurrent players of server, or of every server
+// when server is empty, for each of the last hours.
+func (s *SessionStore) Peaks(server string, hours int, now time.Time) []HourPeak {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	var events []event
+	for _, session := range s.sessions {
+		if server != "" && session.Server != server {
+			continue
+		}
+		events = append(events, event{session.JoinedAt, 1}, event{s.end(session), -1})
+	}
+	// A player who left at a poll was not online with one who joined at it.
+	slices.SortFunc(events, func(a, b event) int {
+		if c := a.at.Compare(b.at); c != 0 {
+			return c
+		}
+		return a.delta - b.delta
+	})
+
+	first := now.Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour)
+	peaks := make([]HourPeak, 0, hours)
+	online, i := 0, 0
+	for ; i < len(events) && events[i].at.Before(first); i++ {
+		online += events[i].delta
+	}
+	for h := 0; h < hours; h++ {
+		start := first.Add(time.Duration(h) * time.Hour)
+		peak := online
+		for ; i < len(events) && events[i].at.Before(start.Add(time.Hour)); i++ {
+			online += events[i].delta
+			peak = max(peak, online)
+		}
+		peaks = append(peaks, HourPeak{Hour: start, Peak: peak})
+	}
+	return peaks
+}
+
+// PeaksHandler returns the hourly peaks of ?server= over the last ?hours=,
+// 24 by default.
+func (s *SessionStore) PeaksHandler(w http.ResponseWriter, r *http.Request) {
+	server := r.URL.Query().Get("server")
+	if server != "" {
+		if _, err := playerTracker.Servers(server); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	hours := 24
+	if v := r.URL.Query().Get("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 31*24 {
+			http.Error(w, "hours must be between 1 and 744", http.StatusBadRequest)
+			return
+		}
+		hours = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(w).Encode(s.Peaks(server, hours, time.Now())); err != nil {
+		log.Printf("failed to encode peaks: %v\n", err)
+	}
+}
+
+// ListHandler returns the players matching ?q=.
+func (s *SessionStore) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(s.List(r.URL.Query().Get("q"))); err != nil {
+		log.Printf("failed to encode players: %v\n", err)
+	}
+}
+
+// HistoryHandler returns the history of the player {key}.
+func (s *SessionStore) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	h, ok := s.History(r.PathValue("key"))
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(h); err != nil {
+		log.Printf("failed to encode player history: %v\n", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/willywotz/fivem/fivem"
+)
+
+func openSessionTest(t *testing.T, path string) *SessionStore {
+	t.Helper()
+
+	s, err := OpenSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// observe records a poll of server at which the players keys were online.
+func observe(t *testing.T, s *SessionStore, server string, at time.Time, gap time.Duration, keys ...string) {
+	t.Helper()
+
+	players := make([]*Player, 0, len(keys))
+	for _, key := range keys {
+		players = append(players, &Player{Player: fivem.Player{Name: "name-" + key}, Server: server, Key: key})
+	}
+	if err := s.Observe(server, players, at, gap); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sessionSpans returns the sessions of key, oldest first, as seconds since
+// base of joining and leaving, -1 for sessions that did not end.
+func sessionSpans(t *testing.T, s *SessionStore, key string, base time.Time) [][2]int64 {
+	t.Helper()
+
+	h, ok := s.History(key)
+	if !ok {
+		return nil
+	}
+	var spans [][2]int64
+	for _, session := range slices.Backward(h.Sessions) {
+		left := int64(-1)
+		if session.LeftAt != nil {
+			left = int64(session.LeftAt.Sub(base) / time.Second)
+		}
+		spans = append(spans, [2]int64{int64(session.JoinedAt.Sub(base) / time.Second), left})
+	}
+	return spans
+}
+
+func TestObserveJoinLeave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	s := openSessionTest(t, path)
+	t0 := time.Date(2026, 1, 1, 20, 0, 0, 0, time.UTC)
+	const gap = 5 * time.Minute
+
+	observe(t, s, "main", t0, gap, "a", "b")
+	observe(t, s, "main", t0.Add(time.Minute), gap, "a")
+	observe(t, s, "main", t0.Add(2*time.Minute), gap)
+
+	check := func(s *SessionStore) {
+		t.Helper()
+		if got, want := sessionSpans(t, s, "a", t0), [][2]int64{{0, 120}}; !slices.Equal(got, want) {
+			t.Errorf("got sessions %v of a, want %v", got, want)
+		}
+		if got, want := sessionSpans(t, s, "b", t0), [][2]int64{{0, 60}}; !slices.Equal(got, want) {
+			t.Errorf("got sessions %v of b, want %v", got, want)
+		}
+		h, _ := s.History("a")
+		if h.Playtime != 120 || h.PlaytimeServers["main"] != 120 || h.Online || h.Name != "name-a" {
+			t.Errorf("got history %+v of a, want 120 seconds offline on main", h)
+		}
+	}
+	check(s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(openSessionTest(t, path))
+}
+
+func TestSessionPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	s := openSessionTest(t, path)
+	t0 := time.Date(2026, 1, 1, 20, 0, 0, 0, time.UTC)
+	const gap = 5 * time.Minute
+
+	observe(t, s, "main", t0, gap, "a")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A crash while writing leaves a record without its newline.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(b, `{"partial`...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openSessionTest(t, path)
+	observe(t, s, "main", t0.Add(time.Minute), gap)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openSessionTest(t, path)
+	if got, want := sessionSpans(t, s, "a", t0), [][2]int64{{0, 60}}; !slices.Equal(got, want) {
+		t.Fatalf("got sessions %v, want %v", got, want)
+	}
+}
+
+func TestObserveGap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	s := openSessionTest(t, path)
+	t0 := time.Date(2026, 1, 1, 20, 0, 0, 0, time.UTC)
+	const gap = 5 * time.Minute
+
+	observe(t, s, "main", t0, gap, "a")
+	observe(t, s, "main", t0.Add(time.Minute), gap, "a")
+	// Long enough after the last record to be written, as a seen record.
+	observe(t, s, "main", t0.Add(4*time.Minute), gap, "a")
+	if got, want := sessionSpans(t, s, "a", t0), [][2]int64{{0, -1}}; !slices.Equal(got, want) {
+		t.Fatalf("got sessions %v, want one that did not end", got)
+	}
+	if h, _ := s.History("a"); h.Playtime != 240 || !h.Online {
+		t.Fatalf("got history %+v, want 240 seconds online", h)
+	}
+
+	// The server restarts and polls again after the gap: the session ends
+	// at the last poll before, not at the last join, and a new one begins.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openSessionTest(t, path)
+	observe(t, s, "main", t0.Add(20*time.Minute), gap, "a")
+	if got, want := sessionSpans(t, s, "a", t0), [][2]int64{{0, 240}, {1200, -1}}; !slices.Equal(got, want) {
+		t.Fatalf("got sessions %v after the gap, want %v", got, want)
+	}
+
+	// A poll within the gap keeps the session.
+	observe(t, s, "main", t0.Add(24*time.Minute), gap, "a")
+	if got, want := sessionSpans(t, s, "a", t0), [][2]int64{{0, 240}, {1200, -1}}; !slices.Equal(got, want) {
+		t.Fatalf("got sessions %v within the gap, want %v", got, want)
+	}
+}
+
+func TestSessionPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	s := openSessionTest(t, path)
+	now := time.Now().Truncate(time.Second)
+	const gap = 2 * time.Hour
+
+	// b left long ago, a left and came back.
+	observe(t, s, "main", now.Add(-10*time.Hour), gap, "b")
+	observe(t, s, "main", now.Add(-9*time.Hour), gap)
+	observe(t, s, "main", now.Add(-3*time.Hour), gap, "a")
+	observe(t, s, "main", now.Add(-2*time.Hour), gap)
+	observe(t, s, "main", now.Add(-time.Hour), gap, "a")
+	observe(t, s, "other", now.Add(-time.Hour), gap, "c")
+
+	if n, err := s.Prune(5 * time.Hour); err != nil || n != 1 {
+		t.Fatalf("pruned %d: %v, want 1", n, err)
+	}
+	if _, ok := s.History("b"); ok {
+		t.Fatal("kept the history of b")
+	}
+
+	want := [][2]int64{{-3 * 3600, -2 * 3600}, {-3600, -1}}
+	if got := sessionSpans(t, s, "a", now); !slices.Equal(got, want) {
+		t.Fatalf("got sessions %v of a, want %v", got, want)
+	}
+
+	// The rewritten file replays to the same sessions, and keeps the last
+	// poll of each server.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openSessionTest(t, path)
+	if got := sessionSpans(t, s, "a", now); !slices.Equal(got, want) {
+		t.Fatalf("got sessions %v of a after reopening, want %v", got, want)
+	}
+	if _, ok := s.History("b"); ok {
+		t.Fatal("the history of b came back")
+	}
+	if h, _ := s.History("c"); h == nil || !h.LastSeen.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("got history %+v of c, want last seen at the last poll", h)
+	}
+	// Appending after the rewrite goes to the new file.
+	observe(t, s, "main", now, gap)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openSessionTest(t, path)
+	if got, want := sessionSpans(t, s, "a", now), [][2]int64{{-3 * 3600, -2 * 3600}, {-3600, 0}}; !slices.Equal(got, want) {
+		t.Fatalf("got sessions %v of a after leaving, want %v", got, want)
+	}
+}
+
+func TestPeaks(t *testing.T) {
+	s := openSessionTest(t, filepath.Join(t.TempDir(), "sessions.jsonl"))
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour, minute int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+	const gap = 2 * time.Hour
+
+	// a leaves at 11:00 as b joins, which does not make two.
+	observe(t, s, "main", at(10, 0), gap, "a")
+	observe(t, s, "main", at(11, 0), gap, "b")
+	observe(t, s, "main", at(11, 10), gap, "b", "c")
+	observe(t, s, "main", at(11, 30), gap, "c")
+	observe(t, s, "main", at(12, 10), gap)
+	observe(t, s, "other", at(10, 30), gap, "d")
+	observe(t, s, "other", at(10, 40), gap)
+
+	tests := []struct {
+		server string
+		want   []int
+	}{
+		{"main", []int{0, 1, 2, 1}},
+		{"other", []int{0, 1, 0, 0}},
+		{"", []int{0, 2, 2, 1}},
+	}
+	for _, tt := range tests {
+		peaks := s.Peaks(tt.server, 4, at(12, 30))
+		got := make([]int, len(peaks))
+		for i, p := range peaks {
+			got[i] = p.Peak
+			if want := at(9+i, 0); !p.Hour.Equal(want) {
+				t.Errorf("got hour %v at %d, want %v", p.Hour, i, want)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("got peaks %v of %q, want %v", got, tt.server, tt.want)
+		}
+	}
+}
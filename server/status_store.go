@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// StatusStore keeps the check-ins posted to /status.
+type StatusStore interface {
+	Add(s Status) error
+	List(q StatusQuery) ([]Status, int, error)
+	Prune(r StatusRetention) (int, error)
+	Close() error
+}
+
+// StatusQuery selects a page of statuses, oldest first unless Reversed.
+type StatusQuery struct {
+	MachineID string
+	Offset    int
+	Limit     int
+	Reversed  bool
+}
+
+// StatusRetention describes which statuses survive a Prune.
+// Zero values disable the corresponding rule.
+type StatusRetention struct {
+	MaxAge        time.Duration
+	MaxPerMachine int
+}
+
+func NewStatusStore(kind, path string) (StatusStore, error) {
+	switch kind {
+	case "memory":
+		return newMemoryStatusStore(), nil
+	case "file":
+		return openFileStatusStore(path)
+	}
+	return nil, fmt.Errorf("unknown status store %q", kind)
+}
+
+func runStatusRetention(store StatusStore, r StatusRetention, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := store.Prune(r)
+		if err != nil {
+			log.Printf("failed to prune status store: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Pruned %d statuses", n)
+		}
+	}
+}
+
+type memoryStatusStore struct {
+	mu        sync.Mutex
+	items     []Status
+	byMachine map[string][]int
+}
+
+func newMemoryStatusStore() *memoryStatusStore {
+	return &memoryStatusStore{
+		items:     make([]Status, 0),
+		byMachine: make(map[string][]int),
+	}
+}
+
+func (m *memoryStatusStore) Add(s Status) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.add(s)
+	return nil
+}
+
+func (m *memoryStatusStore) add(s Status) {
+	m.byMachine[s.MachineID] = append(m.byMachine[s.MachineID], len(m.items))
+	m.items = append(m.items, s)
+}
+
+func (m *memoryStatusStore) List(q StatusQuery) ([]Status, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var indexes []int
+	total := len(m.items)
+	if q.MachineID != "" {
+		indexes = m.byMachine[q.MachineID]
+		total = len(indexes)
+	}
+
+	at := func(i int) Status {
+		if q.Reversed {
+			i = total - 1 - i
+		}
+		if indexes != nil {
+			return m.items[indexes[i]]
+		}
+		return m.items[i]
+	}
+
+	items := make([]Status, 0)
+	for i := q.Offset; i >= 0 && i < total && (q.Limit <= 0 || len(items) < q.Limit); i++ {
+		items = append(items, at(i))
+	}
+
+	return items, total, nil
+}
+
+func (m *memoryStatusStore) Prune(r StatusRetention) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.prune(r), nil
+}
+
+func (m *memoryStatusStore) prune(r StatusRetention) int {
+	keep := make([]bool, len(m.items))
+	for _, indexes := range m.byMachine {
+		for n, i := range indexes {
+			if r.MaxAge > 0 && time.Since(m.items[i].Time) >= r.MaxAge {
+				continue
+			}
+			if r.MaxPerMachine > 0 && len(indexes)-n > r.MaxPerMachine {
+				continue
+			}
+			keep[i] = true
+		}
+	}
+
+	old := m.items
+	m.items = make([]Status, 0, len(old))
+	m.byMachine = make(map[string][]int)
+	for i, s := range old {
+		if keep[i] {
+			m.add(s)
+		}
+	}
+
+	return len(old) - len(m.items)
+}
+
+func (m *memoryStatusStore) Close() error {
+	return nil
+}
+
+// fileStatusStore is a memoryStatusStore backed by an append-only JSON lines
+// file, which is replayed on open and rewritten on prune.
+type fileStatusStore struct {
+	*memoryStatusStore
+	path string
+	file *os.File
+}
+
+func openFileStatusStore(path string) (*fileStatusStore, error) {
+	s := &fileStatusStore{memoryStatusStore: newMemoryStatusStore(), path: path}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open status file: %w", err)
+	}
+	if err == nil {
+		err := readStatusRecords(f, path, s.add)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read status file: %w", err)
+		}
+	}
+
+	if s.file, err = openAppendFile(path); err != nil {
+		return nil, fmt.Errorf("failed to open status file: %w", err)
+	}
+
+	return s, nil
+}
+
+// openAppendFile opens a file of JSON lines for appending. A last line left
+// without its newline by a crash is ended first, so the next record does not
+// join it.
+func openAppendFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return f, nil
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if last[0] != '\n' {
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// maxStatusRecordSize bounds a line of the status file, longer ones are
+// skipped.
+const maxStatusRecordSize = 64 << 10
+
+// readStatusRecords replays the lines of a status file, skipping over-long
+// and corrupt ones.
+func readStatusRecords(r io.Reader, path string, add func(Status)) error {
+	br := bufio.NewReaderSize(r, maxStatusRecordSize)
+	for line := 1; ; line++ {
+		b, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Printf("skipping over-long status record %s:%d", path, line)
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			b = nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if len(bytes.TrimSpace(b)) > 0 {
+			var status Status
+			if err := json.Unmarshal(b, &status); err != nil {
+				log.Printf("skipping corrupt status record %s:%d: %v", path, line, err)
+			} else {
+				add(status)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (s *fileStatusStore) Add(status Status) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to encode status: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write status: %w", err)
+	}
+	s.add(status)
+	return nil
+}
+
+func (s *fileStatusStore) Prune(r StatusRetention) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.prune(r)
+	if n == 0 {
+		return 0, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return n, fmt.Errorf("failed to create status file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, status := range s.items {
+		if err := enc.Encode(status); err != nil {
+			_ = tmp.Close()
+			return n, fmt.Errorf("failed to encode status: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return n, fmt.Errorf("failed to write status file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return n, fmt.Errorf("failed to write status file: %w", err)
+	}
+
+	_ = s.file.Close()
+	renameErr := os.Rename(tmp.Name(), s.path)
+	if s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return n, fmt.Errorf("failed to reopen status file: %w", err)
+	}
+	if renameErr != nil {
+		return n, fmt.Errorf("failed to replace status file: %w", renameErr)
+	}
+
+	return n, nil
+}
+
+func (s *fileStatusStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func statusMachines(statuses []Status) string {
+	ids := make([]string, len(statuses))
+	for i, s := range statuses {
+		ids[i] = s.MachineID + "/" + s.Status
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestStatusStoreList(t *testing.T) {
+	s := newMemoryStatusStore()
+	now := time.Now()
+	for i, id := range []string{"a", "b", "a", "c", "a"} {
+		if err := s.Add(Status{MachineID: id, Status: string(rune('0' + i)), Time: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query StatusQuery
+		want  string
+		total int
+	}{
+		{"all", StatusQuery{}, "a/0 b/1 a/2 c/3 a/4", 5},
+		{"page", StatusQuery{Offset: 1, Limit: 2}, "b/1 a/2", 5},
+		{"reversed page", StatusQuery{Offset: 1, Limit: 2, Reversed: true}, "c/3 a/2", 5},
+		{"past the end", StatusQuery{Offset: 5, Limit: 2}, "", 5},
+		{"machine", StatusQuery{MachineID: "a"}, "a/0 a/2 a/4", 3},
+		{"machine reversed page", StatusQuery{MachineID: "a", Limit: 2, Reversed: true}, "a/4 a/2", 3},
+		{"unknown machine", StatusQuery{MachineID: "z"}, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, total, err := s.List(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := statusMachines(items); got != tt.want || total != tt.total {
+				t.Errorf("got %q of %d, want %q of %d", got, total, tt.want, tt.total)
+			}
+		})
+	}
+}
+
+func TestStatusStorePrune(t *testing.T) {
+	now := time.Now()
+	add := func(s StatusStore) {
+		for _, status := range []Status{
+			{MachineID: "a", Status: "old", Time: now.Add(-2 * time.Hour)},
+			{MachineID: "a", Status: "1", Time: now.Add(-3 * time.Minute)},
+			{MachineID: "b", Status: "1", Time: now.Add(-2 * time.Minute)},
+			{MachineID: "a", Status: "2", Time: now.Add(-time.Minute)},
+		} {
+			if err := s.Add(status); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name      string
+		retention StatusRetention
+		want      string
+	}{
+		{"none", StatusRetention{}, "a/old a/1 b/1 a/2"},
+		{"max age", StatusRetention{MaxAge: time.Hour}, "a/1 b/1 a/2"},
+		{"max per machine", StatusRetention{MaxPerMachine: 1}, "b/1 a/2"},
+		{"both", StatusRetention{MaxAge: 150 * time.Second, MaxPerMachine: 2}, "b/1 a/2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMemoryStatusStore()
+			add(s)
+			n, err := s.Prune(tt.retention)
+			if err != nil {
+				t.Fatal(err)
+			}
+			items, _, _ := s.List(StatusQuery{})
+			if got := statusMachines(items); got != tt.want || n != 4-len(items) {
+				t.Errorf("got %q after pruning %d, want %q", got, n, tt.want)
+			}
+			// The per-machine index follows the pruned items.
+			items, _, _ = s.List(StatusQuery{MachineID: "b"})
+			if got := statusMachines(items); got != "b/1" {
+				t.Errorf("got %q for machine b, want b/1", got)
+			}
+		})
+	}
+}
+
+func TestFileStatusStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.jsonl")
+	now := time.Now()
+
+	s, err := openFileStatusStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []Status{
+		{MachineID: "a", Status: "old", Time: now.Add(-2 * time.Hour)},
+		{MachineID: "b", Status: "1", Time: now},
+		{MachineID: "a", Status: "2", Time: now},
+	} {
+		if err := s.Add(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := s.Prune(StatusRetention{MaxAge: time.Hour}); err != nil || n != 1 {
+		t.Fatalf("pruned %d: %v, want 1", n, err)
+	}
+	if err := s.Add(Status{MachineID: "b", Status: "3", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openFileStatusStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	items, _, _ := s.List(StatusQuery{})
+	if got, want := statusMachines(items), "b/1 a/2 b/3"; got != want {
+		t.Fatalf("got %q after reopening, want %q", got, want)
+	}
+	if items[0].Time.IsZero() {
+		t.Fatal("lost the time of a status")
+	}
+}
+
+func TestFileStatusStoreSkipsBadRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.jsonl")
+	lines := []string{
+		`{"machine_id":"a","status":"1"}`,
+		`{"machine_id":"long","hostname":"` + strings.Repeat("x", 2*maxStatusRecordSize) + `"}`,
+		`not json`,
+		``,
+		`{"machine_id":"a","status":"2"}`,
+	}
+	// The last record lacks its newline, as after a crash while writing.
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openFileStatusStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, _, _ := s.List(StatusQuery{})
+	if got, want := statusMachines(items), "a/1 a/2"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// A record added next goes on a line of its own.
+	if err := s.Add(Status{MachineID: "a", Status: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = openFileStatusStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	items, _, _ = s.List(StatusQuery{})
+	if got, want := statusMachines(items), "a/1 a/2 a/3"; got != want {
+		t.Fatalf("got %q after adding to the file, want %q", got, want)
+	}
+}
+
+func TestStatusValidate(t *testing.T) {
+	if err := (&Status{MachineID: "a", Hostname: "host", Version: "v1.0.0"}).validate(); err != nil {
+		t.Fatalf("valid status: %v", err)
+	}
+	if err := (&Status{Hostname: strings.Repeat("x", maxStatusFieldLength+1)}).validate(); err == nil {
+		t.Fatal("accepted an over-long hostname")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+)
+
+// Uninstall is a decommission an operator asked for and, once the agent
+// answered, its result.
+type Uninstall struct {
+	MachineID string `json:"machine_id"`
+	// From is the process uninstalling, the service when it is connected.
+	From        string                    `json:"from"`
+	RequestedBy string                    `json:"requested_by"`
+	RequestedAt time.Time                 `json:"requested_at"`
+	CompletedAt *time.Time                `json:"completed_at,omitempty"`
+	Result      *protocol.UninstallResult `json:"result,omitempty"`
+}
+
+// Uninstalls tracks remote uninstalls by machine ID.
+type Uninstalls struct {
+	mu    sync.Mutex
+	items map[string]*Uninstall
+}
+
+func NewUninstalls() *Uninstalls {
+	return &Uninstalls{items: make(map[string]*Uninstall)}
+}
+
+func (u *Uninstalls) Get(machineID string) (Uninstall, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	item, ok := u.items[machineID]
+	if !ok {
+		return Uninstall{}, false
+	}
+	return *item, true
+}
+
+// Complete records the agent's result to a requested uninstall. A machine
+// that uninstalled cleanly has its enrollment revoked, so a copy left
+// running cannot come back.
+func (u *Uninstalls) Complete(result *protocol.UninstallResult) {
+	now := time.Now()
+
+	u.mu.Lock()
+	item, ok := u.items[result.MachineID]
+	if !ok || item.CompletedAt != nil {
+		u.mu.Unlock()
+		log.Printf("Ignoring uninstall result of machine ID %s, none was requested", result.MachineID)
+		return
+	}
+	item.CompletedAt = &now
+	item.Result = result
+	u.mu.Unlock()
+
+	for _, step := range result.Steps {
+		if !step.OK {
+			log.Printf("Machine ID %s failed to %s: %s", result.MachineID, step.Name, step.Error)
+		}
+	}
+
+	if !result.OK {
+		log.Printf("Machine ID %s uninstalled with errors", result.MachineID)
+		hub.Broadcast(notice("Machine ID %s uninstalled with errors", result.MachineID))
+		return
+	}
+
+	if err := enrollments.Revoke(result.MachineID); err != nil && !errors.Is(err, errEnrollmentNotFound) {
+		log.Printf("failed to revoke enrollment of uninstalled machine ID %s: %v", result.MachineID, err)
+	}
+	log.Printf("Machine ID %s uninstalled", result.MachineID)
+	hub.Broadcast(notice("Machine ID %s uninstalled", result.MachineID))
+}
+
+// uninstaller picks the connection of all that uninstalls: the service,
+// which stops itself through the service manager, or else the client, which
+// stops the service through it.
+func uninstaller(all []Agent) (Agent, bool) {
+	i := slices.IndexFunc(all, func(a Agent) bool {
+		return a.From == "service" && slices.Contains(a.Capabilities, protocol.CapabilityUninstall)
+	})
+	if i < 0 {
+		i = slices.IndexFunc(all, func(a Agent) bool { return slices.Contains(a.Capabilities, protocol.CapabilityUninstall) })
+	}
+	if i < 0 {
+		return Agent{}, false
+	}
+	return all[i], true
+}
+
+// RequestHandler sends an uninstall to the connected agent {machine_id}.
+// The other connection of the machine is told to exit first.
+func (u *Uninstalls) RequestHandler(w http.ResponseWriter, r *http.Request) {
+	machineID := r.PathValue("machine_id")
+	op := auth.Operator(r)
+
+	all := agents.All(machineID)
+	if len(all) == 0 {
+		http.Error(w, "machine ID is not connected", http.StatusNotFound)
+		return
+	}
+	target, ok := uninstaller(all)
+	if !ok {
+		http.Error(w, "agent version "+all[0].Version+" cannot be uninstalled remotely", http.StatusConflict)
+		return
+	}
+
+	item := &Uninstall{MachineID: machineID, From: target.From, RequestedAt: time.Now()}
+	if op != nil {
+		item.RequestedBy = op.Username
+	}
+	for _, a := range all {
+		if a.client == target.client {
+			continue
+		}
+		if !slices.Contains(a.Capabilities, protocol.CapabilityUninstallExit) {
+			log.Printf("Machine ID %s (%s) cannot be told to exit, version %s", machineID, a.From, a.Version)
+			continue
+		}
+		env, err := protocol.New(protocol.TypeUninstall, &protocol.Uninstall{RequestedBy: item.RequestedBy, ExitOnly: true})
+		if err != nil {
+			log.Printf("failed to encode uninstall: %v", err)
+			http.Error(w, "failed to encode uninstall", http.StatusInternalServerError)
+			return
+		}
+		if !a.client.Send(env) {
+			log.Printf("failed to tell machine ID %s (%s) to exit", machineID, a.From)
+		}
+	}
+
+	env, err := protocol.New(protocol.TypeUninstall, &protocol.Uninstall{RequestedBy: item.RequestedBy})
+	if err != nil {
+		log.Printf("failed to encode uninstall: %v", err)
+		http.Error(w, "failed to encode uninstall", http.StatusInternalServerError)
+		return
+	}
+	// Recorded before sending, so a result that comes back at once is not
+	// ignored.
+	u.mu.Lock()
+	prev, hadPrev := u.items[machineID]
+	u.items[machineID] = item
+	u.mu.Unlock()
+
+	if !target.client.Send(env) {
+		u.mu.Lock()
+		if u.items[machineID] == item {
+			if hadPrev {
+				u.items[machineID] = prev
+			} else {
+				delete(u.items, machineID)
+			}
+		}
+		u.mu.Unlock()
+		http.Error(w, "failed to send uninstall", http.StatusServiceUnavailable)
+		return
+	}
+
+	if op != nil {
+		auth.Audit(op, r, "uninstall "+machineID)
+	}
+	log.Printf("Sent uninstall to machine ID %s (%s)", machineID, target.From)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(item); err != nil {
+		log.Printf("failed to encode uninstall: %v\n", err)
+	}
+}
+
+// GetHandler returns the last uninstall of {machine_id}.
+func (u *Uninstalls) GetHandler(w http.ResponseWriter, r *http.Request) {
+	item, ok := u.Get(r.PathValue("machine_id"))
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0")
+	if err := json.NewEncoder(w).Encode(item); err != nil {
+		log.Printf("failed to encode uninstall: %v\n", err)
+	}
+}
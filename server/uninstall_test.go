@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/willywotz/fivem/protocol"
+)
+
+func TestUninstallReachesBothProcesses(t *testing.T) {
+	url := newWSServer(t)
+	key := newAgentKey(t)
+	machineID := newMachineID("uninstall")
+
+	service := connectAgent(t, url, machineID, "service", key)
+	client := connectAgent(t, url, machineID, "client", key)
+
+	u := NewUninstalls()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/agents/{machine_id}/uninstall", u.RequestHandler)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/agents/"+machineID+"/uninstall", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusAccepted)
+	}
+
+	// The service uninstalls, the client only exits.
+	for _, tt := range []struct {
+		agent    *fakeAgent
+		exitOnly bool
+	}{
+		{client, true},
+		{service, false},
+	} {
+		var req protocol.Uninstall
+		if err := tt.agent.expect(protocol.TypeUninstall, nil).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		if req.ExitOnly != tt.exitOnly {
+			t.Errorf("the %s got exit only %v, want %v", tt.agent.from, req.ExitOnly, tt.exitOnly)
+		}
+	}
+	if item, _ := u.Get(machineID); item.From != "service" {
+		t.Fatalf("got uninstall by the %q, want the service", item.From)
+	}
+}
+
+func TestUninstallResultRecorded(t *testing.T) {
+	url := newWSServer(t)
+	machineID := newMachineID("uninstall")
+	service := connectAgent(t, url, machineID, "service", newAgentKey(t))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/agents/{machine_id}/uninstall", uninstalls.RequestHandler)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/agents/"+machineID+"/uninstall", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusAccepted)
+	}
+
+	// An agent answering as soon as it gets the request.
+	req := service.expect(protocol.TypeUninstall, nil)
+	reply, err := req.Reply(protocol.TypeUninstallResult, &protocol.UninstallResult{MachineID: machineID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.reply(reply)
+	waitFor(t, "the uninstall result", func() bool {
+		item, ok := uninstalls.Get(machineID)
+		return ok && item.CompletedAt != nil
+	})
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+)
+
+const (
+	maxUploadSize = 256 << 20
+
+	// Uploads a machine may have in progress at once, and their total size,
+	// so an agent cannot fill the disk.
+	maxUploadsPerMachine     = 16
+	maxUploadBytesPerMachine = 1 << 30
+
+	// Partial uploads untouched for this long are discarded.
+	uploadMaxAge = 24 * time.Hour
+)
+
+var (
+	errUploadNotFound = errors.New("upload not found")
+	errUploadMismatch = errors.New("upload does not match the one already started")
+	errUploadLimit    = errors.New("too many uploads in progress")
+
+	uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+type upload struct {
+	protocol.UploadBegin
+
+	machineID string
+	next      int
+	complete  bool
+	updated   time.Time
+}
+
+// UploadStore assembles chunked uploads from agents in a directory. Partial
+// files survive reconnects and server restarts so agents can resume them.
+type UploadStore struct {
+	mu      sync.Mutex
+	dir     string
+	uploads map[string]*upload
+}
+
+func OpenUploadStore(dir string) (*UploadStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	return &UploadStore{dir: dir, uploads: make(map[string]*upload)}, nil
+}
+
+func (s *UploadStore) path(id string) string {
+	return filepath.Join(s.dir, id+".part")
+}
+
+// ownerPath holds the machine ID of a partial file, so only that machine
+// resumes it after a restart.
+func (s *UploadStore) ownerPath(id string) string {
+	return filepath.Join(s.dir, id+".owner")
+}
+
+func (s *UploadStore) remove(id string) {
+	_ = os.Remove(s.path(id))
+	_ = os.Remove(s.ownerPath(id))
+}
+
+// Begin starts or resumes an upload and returns the chunk expected next.
+func (s *UploadStore) Begin(machineID string, b *protocol.UploadBegin) (*protocol.UploadAck, error) {
+	if !uploadIDPattern.MatchString(b.UploadID) {
+		return nil, fmt.Errorf("invalid upload ID")
+	}
+	if b.Size <= 0 || b.Size > maxUploadSize {
+		return nil, fmt.Errorf("invalid upload size %d", b.Size)
+	}
+	if b.ChunkSize <= 0 || b.ChunkSize > protocol.MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d", b.ChunkSize)
+	}
+	if sum, err := hex.DecodeString(b.SHA256); err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.uploads[b.UploadID]; ok {
+		if u.machineID != machineID || u.UploadBegin != *b {
+			return nil, errUploadMismatch
+		}
+		u.updated = time.Now()
+		return u.ack(), nil
+	}
+
+	n, size := 0, b.Size
+	for _, u := range s.uploads {
+		if u.machineID == machineID {
+			n++
+			size += u.Size
+		}
+	}
+	if n >= maxUploadsPerMachine || size > maxUploadBytesPerMachine {
+		return nil, errUploadLimit
+	}
+
+	// Pick up a partial file left before a server restart. Only whole
+	// chunks are kept.
+	u := &upload{UploadBegin: *b, machineID: machineID, updated: time.Now()}
+	owner, err := os.ReadFile(s.ownerPath(b.UploadID))
+	switch {
+	case err == nil && string(owner) != machineID:
+		return nil, errUploadMismatch
+	case err == nil:
+		if fi, err := os.Stat(s.path(b.UploadID)); err == nil {
+			u.next = min(int(fi.Size()/int64(b.ChunkSize)), b.Chunks()-1)
+			if err := os.Truncate(s.path(b.UploadID), int64(u.next)*int64(b.ChunkSize)); err != nil {
+				return nil, fmt.Errorf("failed to truncate partial upload: %w", err)
+			}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// A partial file of unknown owner is started over.
+		_ = os.Remove(s.path(b.UploadID))
+		if err := os.WriteFile(s.ownerPath(b.UploadID), []byte(machineID), 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write upload owner: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to read upload owner: %w", err)
+	}
+
+	s.uploads[b.UploadID] = u
+	return u.ack(), nil
+}
+
+// Write stores a chunk. Chunks other than the one expected are ignored and
+// answered with the expected index so the agent can catch up.
+func (s *UploadStore) Write(machineID string, c *protocol.Chunk) (*protocol.UploadAck, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[c.UploadID]
+	if !ok || u.machineID != machineID {
+		return nil, errUploadNotFound
+	}
+	u.updated = time.Now()
+
+	if u.complete || c.Index != u.next {
+		return u.ack(), nil
+	}
+
+	want := u.ChunkSize
+	if c.Index == u.Chunks()-1 {
+		want = int(u.Size - int64(c.Index)*int64(u.ChunkSize))
+	}
+	if len(c.Data) != want {
+		return nil, fmt.Errorf("chunk %d has %d bytes, expected %d", c.Index, len(c.Data), want)
+	}
+
+	f, err := os.OpenFile(s.path(u.UploadID), os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload: %w", err)
+	}
+	_, err = f.WriteAt(c.Data, int64(c.Index)*int64(u.ChunkSize))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write upload: %w", err)
+	}
+	u.next++
+
+	if u.next < u.Chunks() {
+		return u.ack(), nil
+	}
+
+	if err := s.verify(u); err != nil {
+		delete(s.uploads, u.UploadID)
+		s.remove(u.UploadID)
+		ack := u.ack()
+		ack.Error = err.Error()
+		return ack, nil
+	}
+	u.complete = true
+	return u.ack(), nil
+}
+
+func (s *UploadStore) verify(u *upload) error {
+	f, err := os.Open(s.path(u.UploadID))
+	if err != nil {
+		return fmt.Errorf("failed to open upload: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash upload: %w", err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != u.SHA256 {
+		return fmt.Errorf("checksum mismatch: got %s, expected %s", sum, u.SHA256)
+	}
+	return nil
+}
+
+// Take hands a completed upload of machineID over to the caller, who is
+// responsible for the returned file from then on.
+func (s *UploadStore) Take(machineID, id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok || u.machineID != machineID || !u.complete {
+		return "", errUploadNotFound
+	}
+	delete(s.uploads, id)
+	_ = os.Remove(s.ownerPath(id))
+	return s.path(id), nil
+}
+
+// Discard removes an upload of machineID, complete or not.
+func (s *UploadStore) Discard(machineID, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.uploads[id]; ok && u.machineID == machineID {
+		delete(s.uploads, id)
+		s.remove(id)
+	}
+}
+
+// Prune discards uploads that have not progressed for maxAge, including
+// partial files nobody resumed after a restart.
+func (s *UploadStore) Prune(maxAge time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, u := range s.uploads {
+		if time.Since(u.updated) >= maxAge {
+			delete(s.uploads, id)
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.part"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list uploads: %w", err)
+	}
+	owners, err := filepath.Glob(filepath.Join(s.dir, "*.owner"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list uploads: %w", err)
+	}
+	n := 0
+	seen := make(map[string]bool)
+	for _, name := range append(names, owners...) {
+		id := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(name), ".part"), ".owner")
+		if _, ok := s.uploads[id]; ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if time.Since(s.modTime(id)) < maxAge {
+			continue
+		}
+		for _, path := range []string{s.path(id), s.ownerPath(id)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return n, fmt.Errorf("failed to remove upload: %w", err)
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// modTime returns when the partial file of id or its owner last changed.
+func (s *UploadStore) modTime(id string) time.Time {
+	var t time.Time
+	for _, path := range []string{s.path(id), s.ownerPath(id)} {
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+func runUploadRetention(s *UploadStore, maxAge, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := s.Prune(maxAge)
+		if err != nil {
+			log.Printf("failed to prune uploads: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Pruned %d stale uploads", n)
+		}
+	}
+}
+
+func (u *upload) ack() *protocol.UploadAck {
+	return &protocol.UploadAck{UploadID: u.UploadID, NextChunk: u.next, Complete: u.complete}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willywotz/fivem/protocol"
+)
+
+func newUploadBegin(id string, data []byte, chunkSize int) *protocol.UploadBegin {
+	sum := sha256.Sum256(data)
+	return &protocol.UploadBegin{UploadID: id, Size: int64(len(data)), ChunkSize: chunkSize, SHA256: hex.EncodeToString(sum[:])}
+}
+
+func TestUploadLimits(t *testing.T) {
+	s, err := OpenUploadStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range maxUploadsPerMachine {
+		if _, err := s.Begin("m", newUploadBegin("u"+string(rune('a'+i)), []byte("x"), 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Begin("m", newUploadBegin("over", []byte("x"), 1)); !errors.Is(err, errUploadLimit) {
+		t.Fatalf("got %v, want %v", err, errUploadLimit)
+	}
+	// Resuming one in progress and other machines are fine.
+	if _, err := s.Begin("m", newUploadBegin("ua", []byte("x"), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Begin("other", newUploadBegin("over", []byte("x"), 1)); err != nil {
+		t.Fatal(err)
+	}
+	s.Discard("m", "ua")
+	if _, err := s.Begin("m", newUploadBegin("again", []byte("x"), 1)); err != nil {
+		t.Fatalf("got %v after discarding one", err)
+	}
+
+	// The total size counts, not only the number.
+	big := &protocol.UploadBegin{UploadID: "big", Size: maxUploadSize, ChunkSize: protocol.MaxChunkSize, SHA256: strings.Repeat("0", 64)}
+	for i := range maxUploadBytesPerMachine / maxUploadSize {
+		big.UploadID = "big" + string(rune('a'+i))
+		if _, err := s.Begin("big", big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big.UploadID = "bigger"
+	if _, err := s.Begin("big", big); !errors.Is(err, errUploadLimit) {
+		t.Fatalf("got %v, want %v", err, errUploadLimit)
+	}
+}
+
+func TestUploadResumeAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenUploadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("abcdefgh")
+	b := newUploadBegin("resume", data, 4)
+	if _, err := s.Begin("m", b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write("m", &protocol.Chunk{UploadID: "resume", Index: 0, Data: data[:4]}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the machine that started it resumes it.
+	if s, err = OpenUploadStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Begin("other", b); !errors.Is(err, errUploadMismatch) {
+		t.Fatalf("got %v resuming another machine's upload, want %v", err, errUploadMismatch)
+	}
+	ack, err := s.Begin("m", b)
+	if err != nil || ack.NextChunk != 1 {
+		t.Fatalf("got %+v, %v, want to resume at chunk 1", ack, err)
+	}
+	if ack, err := s.Write("m", &protocol.Chunk{UploadID: "resume", Index: 1, Data: data[4:]}); err != nil || !ack.Complete {
+		t.Fatalf("got %+v, %v, want the upload complete", ack, err)
+	}
+	path, err := s.Take("m", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != string(data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := os.Stat(s.ownerPath("resume")); !os.IsNotExist(err) {
+		t.Fatalf("kept the owner of a taken upload: %v", err)
+	}
+
+	// A partial file of unknown owner is started over.
+	if err := os.WriteFile(s.path("unknown"), data[:4], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := s.Begin("m", newUploadBegin("unknown", data, 4)); err != nil || ack.NextChunk != 0 {
+		t.Fatalf("got %+v, %v, want to start at chunk 0", ack, err)
+	}
+}
+
+func TestUploadPrune(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenUploadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Begin("m", newUploadBegin("stale", []byte("x"), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write("m", &protocol.Chunk{UploadID: "stale", Index: 0, Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = OpenUploadStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * uploadMaxAge)
+	for _, path := range []string{s.path("stale"), s.ownerPath("stale")} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := s.Prune(uploadMaxAge); err != nil || n != 1 {
+		t.Fatalf("pruned %d: %v, want 1", n, err)
+	}
+	for _, path := range []string{s.path("stale"), s.ownerPath("stale")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("kept %s: %v", path, err)
+		}
+	}
+}
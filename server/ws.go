@@ -0,0 +1,426 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willywotz/fivem/protocol"
+)
+
+var upgrader = websocket.Upgrader{
+	// ReadBufferSize:  1024,
+	// WriteBufferSize: 1024,
+	CheckOrigin: checkOrigin,
+}
+
+var hub = NewHub()
+
+// pendingRequestTimeout is how long an agent has to answer a request before
+// it is forgotten.
+const pendingRequestTimeout = 10 * time.Minute
+
+// pendingRequest remembers which operator command an agent request was sent
+// for, so the agent's reply can be routed back.
+type pendingRequest struct {
+	client    *Client
+	commandID string
+	operator  string
+	// target is the agent the request was sent to, at machineID.
+	target    *Client
+	machineID string
+	sentAt    time.Time
+}
+
+var (
+	pendingRequests   = make(map[string]*pendingRequest)
+	pendingRequestsMu = &sync.Mutex{}
+)
+
+// addPendingRequest remembers the request id, forgetting the requests that
+// timed out.
+func addPendingRequest(id string, p *pendingRequest) {
+	pendingRequestsMu.Lock()
+	defer pendingRequestsMu.Unlock()
+
+	for other, pending := range pendingRequests {
+		if p.sentAt.Sub(pending.sentAt) > pendingRequestTimeout {
+			delete(pendingRequests, other)
+		}
+	}
+	pendingRequests[id] = p
+}
+
+func takePendingRequest(id string) (*pendingRequest, bool) {
+	pendingRequestsMu.Lock()
+	defer pendingRequestsMu.Unlock()
+
+	p, ok := pendingRequests[id]
+	delete(pendingRequests, id)
+	return p, ok
+}
+
+// takePendingRequestFor is takePendingRequest for replies, which only the
+// agent the request was sent to can answer.
+func takePendingRequestFor(id string, target *Client) (*pendingRequest, bool) {
+	pendingRequestsMu.Lock()
+	defer pendingRequestsMu.Unlock()
+
+	p, ok := pendingRequests[id]
+	if !ok || p.target != target {
+		return nil, false
+	}
+	delete(pendingRequests, id)
+	return p, true
+}
+
+// dropPendingRequests forgets the requests sent to target, which
+// disconnected, and tells the operators waiting for them.
+func dropPendingRequests(target *Client) {
+	pendingRequestsMu.Lock()
+	dropped := make([]*pendingRequest, 0)
+	for id, p := range pendingRequests {
+		if p.target == target {
+			delete(pendingRequests, id)
+			dropped = append(dropped, p)
+		}
+	}
+	pendingRequestsMu.Unlock()
+
+	for _, p := range dropped {
+		if hub.Connected(p.client) {
+			reply := protocol.NewError(protocol.ErrorCodeNotFound, "Machine ID "+p.machineID+" disconnected before answering")
+			reply.CorrelationID = p.commandID
+			p.client.Send(reply)
+		}
+	}
+}
+
+func notice(format string, a ...any) *protocol.Envelope {
+	env, _ := protocol.New(protocol.TypeNotice, &protocol.Notice{Message: fmt.Sprintf(format, a...)})
+	return env
+}
+
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	// Browsers ask for the broadcast stream with b=true and must belong to an
+	// operator, agents connect anonymously.
+	var op *Operator
+	if r.URL.Query().Get("b") == "true" {
+		if op = auth.Operator(r); op == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("failed to upgrade connection: %v", err)
+		return
+	}
+
+	c := newClient(hub, conn, r, op)
+	hub.Register(c)
+	go c.writePump()
+
+	var machineID string
+
+	defer func() {
+		if machineID != "" {
+			agents.Remove(c)
+		}
+		dropPendingRequests(c)
+		hub.Unregister(c)
+	}()
+
+	conn.SetReadLimit(maxUnregisteredMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(appData string) error {
+		if machineID != "" {
+			agents.Heartbeat(c)
+		}
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	// Agents have to sign this nonce in their register message, see
+	// EnrollmentStore.Verify.
+	nonce := enrollments.NewChallenge()
+	if op == nil {
+		challenge, _ := protocol.New(protocol.TypeChallenge, &protocol.Challenge{
+			Nonce:        nonce,
+			ServerKey:    enrollments.PublicKey(),
+			Capabilities: []string{protocol.CapabilityUpload, protocol.CapabilityConfig},
+			Transparency: transparency,
+		})
+		c.Send(challenge)
+	}
+
+	if op != nil {
+		log.Printf("Operator %s connected from %s", op.Username, r.RemoteAddr)
+	} else {
+		log.Printf("Client connected from %s", r.RemoteAddr)
+	}
+
+	router := protocol.NewRouter()
+
+	router.Handle(protocol.TypePing, func(env *protocol.Envelope) error {
+		pong, _ := env.Reply(protocol.TypePong, nil)
+		c.Send(pong)
+		return nil
+	})
+
+	sendScreenshotRequest := func(env *protocol.Envelope, targetMachineID string, target *Client, opts protocol.CaptureOptions) {
+		req, _ := protocol.New(protocol.TypeScreenshotRequest, &protocol.ScreenshotRequest{CaptureOptions: opts, RequestedBy: c.operator.Username})
+		addPendingRequest(req.ID, &pendingRequest{
+			client:    c,
+			commandID: env.ID,
+			operator:  c.operator.Username,
+			target:    target,
+			machineID: targetMachineID,
+			sentAt:    time.Now(),
+		})
+
+		reply := notice("Screenshot command sent to machine ID %s", targetMachineID)
+		if !target.Send(req) {
+			takePendingRequest(req.ID)
+			log.Printf("Error sending screenshot command to machine ID %s", targetMachineID)
+			reply = env.ReplyError(protocol.ErrorCodeInternal, "Failed to send screenshot command to machine ID "+targetMachineID)
+		}
+		reply.CorrelationID = env.ID
+		c.Send(reply)
+	}
+
+	router.Handle(protocol.TypeScreenshot, func(env *protocol.Envelope) error {
+		if op == nil {
+			c.Send(env.ReplyError(protocol.ErrorCodeUnauthorized, "Unauthorized"))
+			return nil
+		}
+
+		var cmd protocol.Screenshot
+		if err := env.Decode(&cmd); err != nil {
+			c.Send(env.ReplyError(protocol.ErrorCodeBadRequest, "Invalid screenshot command"))
+			return nil
+		}
+		auth.Audit(op, r, fmt.Sprintf("screenshot %s %s", cmd.Target, cmd.MachineID))
+
+		switch cmd.Target {
+		case "all":
+			for targetMachineID, target := range agents.Clients() {
+				sendScreenshotRequest(env, targetMachineID, target, cmd.CaptureOptions)
+			}
+		case "machine_id":
+			target, exists := agents.Client(cmd.MachineID)
+			if !exists {
+				c.Send(env.ReplyError(protocol.ErrorCodeNotFound, "Machine ID not found"))
+				return nil
+			}
+			sendScreenshotRequest(env, cmd.MachineID, target, cmd.CaptureOptions)
+		default:
+			c.Send(env.ReplyError(protocol.ErrorCodeBadRequest, "Invalid screenshot command"))
+		}
+		return nil
+	})
+
+	router.Handle(protocol.TypeRegister, func(env *protocol.Envelope) error {
+		var reg protocol.Register
+		if err := env.Decode(&reg); err != nil || reg.MachineID == "" {
+			c.Send(env.ReplyError(protocol.ErrorCodeBadRequest, "Invalid register message"))
+			return nil
+		}
+
+		if err := enrollments.Verify(reg.MachineID, reg.Hostname, reg.Username, reg.PublicKey, nonce, reg.Signature); err != nil {
+			log.Printf("Rejected registration of machine ID %s from %s: %v", reg.MachineID, r.RemoteAddr, err)
+			c.Send(env.ReplyError(protocol.ErrorCodeRejected, err.Error()))
+			c.CloseWith(websocket.ClosePolicyViolation, err.Error())
+			return nil
+		}
+
+		registered, _ := env.Reply(protocol.TypeRegistered, &protocol.Registered{
+			Signature: enrollments.SignRegistration(reg.MachineID, reg.ClientNonce),
+		})
+		c.Send(registered)
+
+		if machineID != "" {
+			agents.Remove(c)
+		}
+		machineID = reg.MachineID
+		now := time.Now()
+		agent := &Agent{
+			AgentInfo: protocol.AgentInfo{
+				MachineID:        reg.MachineID,
+				Hostname:         reg.Hostname,
+				Username:         reg.Username,
+				Version:          reg.Version,
+				From:             reg.From,
+				RemoteIP:         remoteIP(r),
+				Capabilities:     reg.Capabilities,
+				FiveMIdentifiers: reg.FiveMIdentifiers,
+				ConnectedSince:   now,
+				LastHeartbeat:    now,
+			},
+			client: c,
+		}
+		agents.Add(agent)
+		if slices.Contains(reg.Capabilities, protocol.CapabilityUpload) {
+			conn.SetReadLimit(maxAgentMessageSize)
+		} else {
+			conn.SetReadLimit(maxInlineMessageSize)
+		}
+		log.Printf("Registered machine ID: %s (%s)", machineID, reg.From)
+		rollouts.ReportVersion(reg.MachineID, reg.From, reg.Version)
+		if err := links.Report(reg.MachineID, reg.Hostname, reg.Version, reg.FiveMIdentifiers); err != nil {
+			log.Printf("failed to record FiveM identifiers of machine ID %s: %v", machineID, err)
+		}
+		agentConfig.PushAgent(agent)
+		return nil
+	})
+
+	router.Handle(protocol.TypeConfigAck, func(env *protocol.Envelope) error {
+		var ack protocol.ConfigAck
+		if err := env.Decode(&ack); err != nil || machineID == "" {
+			return nil
+		}
+
+		agents.SetConfigVersion(c, ack.Version)
+		for key, reason := range ack.Rejected {
+			log.Printf("Machine ID %s rejected config %s: %s", machineID, key, reason)
+		}
+		return nil
+	})
+
+	router.Handle(protocol.TypeUninstallResult, func(env *protocol.Envelope) error {
+		var result protocol.UninstallResult
+		if err := env.Decode(&result); err != nil || machineID == "" || result.MachineID != machineID {
+			return nil
+		}
+		uninstalls.Complete(&result)
+		return nil
+	})
+
+	router.Handle(protocol.TypeUnregister, func(env *protocol.Envelope) error {
+		var unreg protocol.Unregister
+		if err := env.Decode(&unreg); err != nil || machineID == "" || unreg.MachineID != machineID {
+			return nil
+		}
+
+		agents.Remove(c)
+		log.Printf("Unregistered machine ID: %s", machineID)
+		machineID = ""
+		return nil
+	})
+
+	router.Handle(protocol.TypeUploadBegin, func(env *protocol.Envelope) error {
+		var begin protocol.UploadBegin
+		if err := env.Decode(&begin); err != nil || machineID == "" {
+			c.Send(env.ReplyError(protocol.ErrorCodeBadRequest, "Invalid upload.begin message"))
+			return nil
+		}
+
+		ack, err := uploads.Begin(machineID, &begin)
+		if err != nil {
+			c.Send(env.ReplyError(protocol.ErrorCodeRejected, err.Error()))
+			return nil
+		}
+		reply, err := env.Reply(protocol.TypeUploadAck, ack)
+		if err != nil {
+			return err
+		}
+		c.Send(reply)
+		return nil
+	})
+
+	router.Handle(protocol.TypeScreenshotResult, func(env *protocol.Envelope) error {
+		var result protocol.ScreenshotResult
+		if err := env.Decode(&result); err != nil || machineID == "" || result.MachineID != machineID {
+			return nil
+		}
+		log.Printf("Received screenshot data from %s, %s, %s", result.MachineID, result.Hostname, result.Username)
+
+		pending, ok := takePendingRequestFor(env.CorrelationID, c)
+		if !ok {
+			log.Printf("dropping screenshot result of %s that was not requested or timed out", machineID)
+			for _, item := range result.Items {
+				if item.UploadID != "" {
+					uploads.Discard(machineID, item.UploadID)
+				}
+			}
+			return nil
+		}
+		screenshots.SaveResult(&result, env.CorrelationID, pending.operator)
+
+		out, err := protocol.New(protocol.TypeScreenshotResult, &result)
+		if err != nil {
+			return err
+		}
+
+		if hub.Connected(pending.client) {
+			out.CorrelationID = pending.commandID
+			pending.client.Send(out)
+			return nil
+		}
+		hub.Broadcast(out)
+		return nil
+	})
+
+	for {
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("Error reading message: %v", err)
+			break
+		}
+
+		if messageType == websocket.BinaryMessage && protocol.MatchMessagePrefix(p) {
+			if machineID == "" {
+				continue
+			}
+			chunk, err := protocol.DecodeChunk(p)
+			if err != nil {
+				c.Send(protocol.NewError(protocol.ErrorCodeBadRequest, err.Error()))
+				continue
+			}
+			ack, err := uploads.Write(machineID, chunk)
+			if err != nil {
+				ack = &protocol.UploadAck{UploadID: chunk.UploadID, Error: err.Error()}
+			}
+			reply, _ := protocol.New(protocol.TypeUploadAck, ack)
+			c.Send(reply)
+			continue
+		}
+
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		env, err := protocol.Decode(p)
+		var versionErr *protocol.UnsupportedVersionError
+		if errors.As(err, &versionErr) {
+			log.Printf("Closing connection from %s: %v", r.RemoteAddr, err)
+			c.Send(protocol.UnsupportedVersion(env, versionErr))
+			c.CloseWith(websocket.CloseUnsupportedData, versionErr.Error())
+			continue
+		}
+		if err != nil {
+			c.Send(protocol.NewError(protocol.ErrorCodeBadRequest, err.Error()))
+			continue
+		}
+
+		if op == nil && machineID == "" && env.Type != protocol.TypeRegister && env.Type != protocol.TypePing {
+			c.Send(env.ReplyError(protocol.ErrorCodeUnauthorized, "register first"))
+			continue
+		}
+
+		if err := router.Dispatch(env); err != nil {
+			if errors.Is(err, protocol.ErrUnknownType) {
+				c.Send(env.ReplyError(protocol.ErrorCodeUnknownType, err.Error()))
+				continue
+			}
+			log.Printf("Error handling %s message from %s: %v", env.Type, r.RemoteAddr, err)
+		}
+	}
+
+	log.Printf("Client disconnected from %s", r.RemoteAddr)
+}
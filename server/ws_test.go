@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willywotz/fivem/protocol"
+)
+
+const testOperatorToken = "test-operator-token"
+
+// TestMain sets up the stores wsHandler works with in a temporary
+// directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "fivem-server-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := func() int {
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		operators := fmt.Sprintf(`{"operators": [{"username": "tester", "token_hashes": [%q]}]}`, hashToken(testOperatorToken))
+		if err := os.WriteFile(filepath.Join(dir, "operators.json"), []byte(operators), 0o600); err != nil {
+			log.Fatal(err)
+		}
+		if auth, err = LoadAuth(filepath.Join(dir, "operators.json"), filepath.Join(dir, "audit.jsonl")); err != nil {
+			log.Fatal(err)
+		}
+		defer func() { _ = auth.Close() }()
+		if enrollments, err = OpenEnrollmentStore(filepath.Join(dir, "enrollments.json"), filepath.Join(dir, "server.key")); err != nil {
+			log.Fatal(err)
+		}
+		if links, err = OpenLinkStore(filepath.Join(dir, "links.json")); err != nil {
+			log.Fatal(err)
+		}
+		if agentConfig, err = OpenAgentConfigStore(filepath.Join(dir, "agent-config.json")); err != nil {
+			log.Fatal(err)
+		}
+		if rollouts, err = OpenRolloutStore(filepath.Join(dir, "rollouts.json")); err != nil {
+			log.Fatal(err)
+		}
+		if screenshots, err = OpenScreenshotStore(filepath.Join(dir, "screenshots")); err != nil {
+			log.Fatal(err)
+		}
+		if uploads, err = OpenUploadStore(filepath.Join(dir, "uploads")); err != nil {
+			log.Fatal(err)
+		}
+		return m.Run()
+	}()
+	os.Exit(code)
+}
+
+func newWSServer(t *testing.T) string {
+	t.Helper()
+
+	// Agents of earlier tests may still be leaving.
+	waitFor(t, "the agents of earlier tests to disconnect", func() bool { return len(agents.List()) == 0 })
+
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+type wsPeer struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func dialWS(t *testing.T, url string, header http.Header) *wsPeer {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", url, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &wsPeer{t: t, conn: conn}
+}
+
+func (p *wsPeer) send(t string, payload any) *protocol.Envelope {
+	p.t.Helper()
+
+	env, err := protocol.New(t, payload)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.reply(env)
+	return env
+}
+
+func (p *wsPeer) reply(env *protocol.Envelope) {
+	p.t.Helper()
+
+	b, err := env.Marshal()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := p.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		p.t.Fatalf("failed to send %s: %v", env.Type, err)
+	}
+}
+
+// expect reads messages until one of type t, skipping the rest, like the
+// presence and config messages the server sends along.
+func (p *wsPeer) expect(t string, match func(*protocol.Envelope) bool) *protocol.Envelope {
+	p.t.Helper()
+
+	_ = p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, b, err := p.conn.ReadMessage()
+		if err != nil {
+			p.t.Fatalf("failed to read %s: %v", t, err)
+		}
+		env, err := protocol.Decode(b)
+		if err != nil {
+			p.t.Fatalf("failed to decode message: %v", err)
+		}
+		if env.Type == t && (match == nil || match(env)) {
+			return env
+		}
+	}
+}
+
+func connectOperator(t *testing.T, url string) *wsPeer {
+	t.Helper()
+
+	return dialWS(t, url+"?b=true", http.Header{"Authorization": {"Bearer " + testOperatorToken}})
+}
+
+// fakeAgent registers like the agent does and answers screenshot requests
+// with results without items.
+type fakeAgent struct {
+	*wsPeer
+	machineID string
+	from      string
+}
+
+func connectAgent(t *testing.T, url, machineID, from string, key ed25519.PrivateKey) *fakeAgent {
+	t.Helper()
+
+	a := &fakeAgent{wsPeer: dialWS(t, url, nil), machineID: machineID, from: from}
+	var challenge protocol.Challenge
+	if err := a.expect(protocol.TypeChallenge, nil).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	a.send(protocol.TypeRegister, &protocol.Register{
+		MachineID:    machineID,
+		Hostname:     "host-" + machineID,
+		Username:     "user",
+		From:         from,
+		Version:      "v1.0.0",
+		Capabilities: []string{protocol.CapabilityScreenshot, protocol.CapabilityConfig, protocol.CapabilityUninstall, protocol.CapabilityUninstallExit},
+		PublicKey:    base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		ClientNonce:  "nonce",
+		Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(key, protocol.AgentRegistrationMessage(machineID, challenge.Nonce))),
+	})
+	a.expect(protocol.TypeRegistered, nil)
+	return a
+}
+
+func (a *fakeAgent) answerScreenshot() {
+	a.t.Helper()
+
+	req := a.expect(protocol.TypeScreenshotRequest, nil)
+	reply, err := req.Reply(protocol.TypeScreenshotResult, &protocol.ScreenshotResult{MachineID: a.machineID, Hostname: "host-" + a.machineID, Username: "user"})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	a.reply(reply)
+}
+
+func newAgentKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func pendingRequestCount() int {
+	pendingRequestsMu.Lock()
+	defer pendingRequestsMu.Unlock()
+	return len(pendingRequests)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newMachineID returns a machine ID not enrolled yet, as machines stay
+// enrolled across tests.
+func newMachineID(name string) string {
+	return name + "-" + strings.ToLower(protocol.NewID()[:8])
+}
+
+func TestServiceAndClientStayConnected(t *testing.T) {
+	url := newWSServer(t)
+	key := newAgentKey(t)
+	machineID := newMachineID("both")
+
+	service := connectAgent(t, url, machineID, "service", key)
+	client := connectAgent(t, url, machineID, "client", key)
+
+	if all := agents.All(machineID); len(all) != 2 {
+		t.Fatalf("got %d connections of the machine, want 2", len(all))
+	}
+	for _, a := range []*fakeAgent{service, client} {
+		ping := a.send(protocol.TypePing, nil)
+		a.expect(protocol.TypePong, func(env *protocol.Envelope) bool { return env.CorrelationID == ping.ID })
+	}
+	if info, _, _ := agents.Get(machineID); info.From != "client" {
+		t.Fatalf("commands go to the %s, want the client", info.From)
+	}
+
+	// A reconnecting client replaces its previous connection only.
+	connectAgent(t, url, machineID, "client", key)
+	_ = client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := client.conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	ping := service.send(protocol.TypePing, nil)
+	service.expect(protocol.TypePong, func(env *protocol.Envelope) bool { return env.CorrelationID == ping.ID })
+
+	_ = service.conn.Close()
+	waitFor(t, "the service to be removed", func() bool { return len(agents.All(machineID)) == 1 })
+	if _, _, ok := agents.Get(machineID); !ok {
+		t.Fatal("the machine went offline with the client still connected")
+	}
+}
+
+func TestScreenshotRoutedToOperator(t *testing.T) {
+	url := newWSServer(t)
+	browser := connectOperator(t, url)
+
+	fleet := make([]*fakeAgent, 0)
+	for i := range 5 {
+		fleet = append(fleet, connectAgent(t, url, newMachineID(fmt.Sprintf("fleet-%d", i)), "client", newAgentKey(t)))
+	}
+
+	cmd := browser.send(protocol.TypeScreenshot, &protocol.Screenshot{Target: "machine_id", MachineID: fleet[0].machineID})
+	fleet[0].answerScreenshot()
+	var result protocol.ScreenshotResult
+	env := browser.expect(protocol.TypeScreenshotResult, func(env *protocol.Envelope) bool { return env.CorrelationID == cmd.ID })
+	if err := env.Decode(&result); err != nil || result.MachineID != fleet[0].machineID {
+		t.Fatalf("got result %+v, %v, want one of %s", result, err, fleet[0].machineID)
+	}
+
+	// Every agent answers at once.
+	cmd = browser.send(protocol.TypeScreenshot, &protocol.Screenshot{Target: "all"})
+	var wg sync.WaitGroup
+	for _, a := range fleet {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.answerScreenshot()
+		}()
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for len(seen) < len(fleet) {
+		env := browser.expect(protocol.TypeScreenshotResult, func(env *protocol.Envelope) bool { return env.CorrelationID == cmd.ID })
+		var result protocol.ScreenshotResult
+		if err := env.Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		seen[result.MachineID] = true
+	}
+	waitFor(t, "the pending requests to be answered", func() bool { return pendingRequestCount() == 0 })
+}
+
+func TestPendingRequestDroppedOnDisconnect(t *testing.T) {
+	url := newWSServer(t)
+	browser := connectOperator(t, url)
+	agent := connectAgent(t, url, newMachineID("gone"), "client", newAgentKey(t))
+
+	cmd := browser.send(protocol.TypeScreenshot, &protocol.Screenshot{Target: "machine_id", MachineID: agent.machineID})
+	agent.expect(protocol.TypeScreenshotRequest, nil)
+	if n := pendingRequestCount(); n != 1 {
+		t.Fatalf("got %d pending requests, want 1", n)
+	}
+	_ = agent.conn.Close()
+
+	var e protocol.Error
+	env := browser.expect(protocol.TypeError, func(env *protocol.Envelope) bool { return env.CorrelationID == cmd.ID })
+	if err := env.Decode(&e); err != nil || !strings.Contains(e.Message, "disconnected") {
+		t.Fatalf("got error %+v, %v, want a disconnect", e, err)
+	}
+	if n := pendingRequestCount(); n != 0 {
+		t.Fatalf("got %d pending requests after the agent left, want 0", n)
+	}
+}
+
+func TestPendingRequestTimeout(t *testing.T) {
+	now := time.Now()
+	addPendingRequest("old", &pendingRequest{sentAt: now.Add(-pendingRequestTimeout - time.Second)})
+	addPendingRequest("recent", &pendingRequest{sentAt: now.Add(-time.Minute)})
+	addPendingRequest("new", &pendingRequest{sentAt: now})
+
+	if _, ok := takePendingRequest("old"); ok {
+		t.Fatal("a timed out request is still pending")
+	}
+	for _, id := range []string{"recent", "new"} {
+		if _, ok := takePendingRequest(id); !ok {
+			t.Fatalf("request %s was forgotten", id)
+		}
+	}
+}
+
+func TestReadLimitBeforeRegistration(t *testing.T) {
+	url := newWSServer(t)
+	padding := map[string]string{"padding": strings.Repeat("x", 2*maxUnregisteredMessageSize)}
+
+	// Before registering, a large message closes the connection.
+	stranger := dialWS(t, url, nil)
+	stranger.expect(protocol.TypeChallenge, nil)
+	stranger.send(protocol.TypePing, padding)
+	_ = stranger.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, b, err := stranger.conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if env, err := protocol.Decode(b); err == nil && env.Type == protocol.TypePong {
+			t.Fatal("answered a large message before registration")
+		}
+	}
+
+	// Registered agents may send more.
+	agent := connectAgent(t, url, newMachineID("limit"), "client", newAgentKey(t))
+	ping := agent.send(protocol.TypePing, padding)
+	agent.expect(protocol.TypePong, func(env *protocol.Envelope) bool { return env.CorrelationID == ping.ID })
+}
+
+func TestUnrequestedScreenshotNotStored(t *testing.T) {
+	url := newWSServer(t)
+	agent := connectAgent(t, url, newMachineID("unrequested"), "client", newAgentKey(t))
+
+	agent.send(protocol.TypeScreenshotResult, &protocol.ScreenshotResult{
+		MachineID: agent.machineID,
+		Items:     []*protocol.ScreenshotItem{{Image: base64.StdEncoding.EncodeToString(pngImage(t, 16, 16))}},
+	})
+	// Messages are handled in order, so the result was when the pong comes.
+	ping := agent.send(protocol.TypePing, nil)
+	agent.expect(protocol.TypePong, func(env *protocol.Envelope) bool { return env.CorrelationID == ping.ID })
+
+	if items, total := screenshots.List(agent.machineID, 0, 0); total != 0 {
+		t.Fatalf("stored %+v nobody requested", items)
+	}
+
+	browser := connectOperator(t, url)
+	cmd := browser.send(protocol.TypeScreenshot, &protocol.Screenshot{Target: "machine_id", MachineID: agent.machineID})
+	req := agent.expect(protocol.TypeScreenshotRequest, nil)
+	reply, err := req.Reply(protocol.TypeScreenshotResult, &protocol.ScreenshotResult{
+		MachineID: agent.machineID,
+		Items:     []*protocol.ScreenshotItem{{Image: base64.StdEncoding.EncodeToString(pngImage(t, 16, 16))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.reply(reply)
+	browser.expect(protocol.TypeScreenshotResult, func(env *protocol.Envelope) bool { return env.CorrelationID == cmd.ID })
+	if items, total := screenshots.List(agent.machineID, 0, 0); total != 1 || items[0].RequestedBy != "tester" {
+		t.Fatalf("got %+v, want the requested screenshot stored", items)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
 	"golang.org/x/sys/windows/svc/eventlog"
@@ -19,6 +22,17 @@ var (
 
 var elog debug.Log
 
+var (
+	serviceStopping = make(chan struct{})
+	stopServiceOnce sync.Once
+)
+
+// stopService has the running service stop as if the service manager asked
+// it to.
+func stopService() {
+	stopServiceOnce.Do(func() { close(serviceStopping) })
+}
+
 type exampleService struct{}
 
 func (m *exampleService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
@@ -31,6 +45,8 @@ func (m *exampleService) Execute(args []string, r <-chan svc.ChangeRequest, chan
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 	_ = elog.Info(1, fmt.Sprintf("Service (Version: %s) started.", version))
 
+	checkPendingUpdate()
+
 	if err := handleUpdate(); err != nil {
 		_ = elog.Error(1, fmt.Sprintf("auto update failed: %v", err))
 	}
@@ -54,6 +70,8 @@ loop:
 			default:
 				_ = elog.Error(1, fmt.Sprintf("unexpected control request #%d", c))
 			}
+		case <-serviceStopping:
+			break loop
 		}
 	}
 	changes <- svc.Status{State: svc.StopPending}
@@ -226,6 +244,61 @@ func controlService(name string, c svc.Cmd, to svc.State) error {
 	return nil
 }
 
+type serviceStatus struct {
+	Installed bool   `json:"installed"`
+	State     string `json:"state,omitempty"`
+	StartType string `json:"start_type,omitempty"`
+	Path      string `json:"path,omitempty"`
+}
+
+var serviceStates = map[svc.State]string{
+	svc.Stopped:         "stopped",
+	svc.StartPending:    "start_pending",
+	svc.StopPending:     "stop_pending",
+	svc.Running:         "running",
+	svc.ContinuePending: "continue_pending",
+	svc.PausePending:    "pause_pending",
+	svc.Paused:          "paused",
+}
+
+var serviceStartTypes = map[uint32]string{
+	mgr.StartAutomatic: "automatic",
+	mgr.StartManual:    "manual",
+	mgr.StartDisabled:  "disabled",
+}
+
+func queryService(name string) (*serviceStatus, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer func() { _ = m.Disconnect() }()
+
+	s, err := m.OpenService(name)
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return &serviceStatus{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open service %s: %w", name, err)
+	}
+	defer func() { _ = s.Close() }()
+
+	status, err := s.Query()
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve service status: %w", err)
+	}
+	config, err := s.Config()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service config: %w", err)
+	}
+	return &serviceStatus{
+		Installed: true,
+		State:     serviceStates[status.State],
+		StartType: serviceStartTypes[config.StartType],
+		Path:      config.BinaryPathName,
+	}, nil
+}
+
 func verifyExecuteServicePath(name string) error {
 	if localDebug || noVerifyExecuteServicePath {
 		return nil
@@ -306,7 +379,7 @@ func verifyRecoveryService(name string) error {
 	}
 
 	if len(recoveryActions) > 0 {
-		fmt.Printf("Service %s already has recovery actions configured.\n", name)
+		infof("Service %s already has recovery actions configured.", name)
 		return nil
 	}
 
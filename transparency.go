@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	wtsapi32            = syscall.NewLazyDLL("wtsapi32.dll")
+	procWTSSendMessageW = wtsapi32.NewProc("WTSSendMessageW")
+)
+
+// Message box styles and responses used with WTSSendMessageW.
+const (
+	MB_OK              uint32 = 0x00000000
+	MB_YESNO           uint32 = 0x00000004
+	MB_ICONQUESTION    uint32 = 0x00000020
+	MB_ICONINFORMATION uint32 = 0x00000040
+	MB_SETFOREGROUND   uint32 = 0x00010000
+	MB_TOPMOST         uint32 = 0x00040000
+
+	IDYES     uint32 = 6
+	IDNO      uint32 = 7
+	IDTIMEOUT uint32 = 32000
+)
+
+const (
+	captureNoticeTimeout = 10 * time.Second
+	consentPromptTimeout = 5 * time.Minute
+
+	// Agents without consent wait this long before asking again.
+	consentRetryDelay = time.Hour
+)
+
+var errConsentDeclined = errors.New("the user declined remote screenshots")
+
+// sendSessionMessage shows a message box on the interactive desktop, which
+// also works from the service in session 0. With wait false it returns
+// immediately and the box closes itself after timeout.
+func sendSessionMessage(title, message string, style uint32, timeout time.Duration, wait bool) (uint32, error) {
+	sessionID := windows.WTSGetActiveConsoleSessionId()
+	if sessionID == 0xFFFFFFFF {
+		return 0, fmt.Errorf("no active session found")
+	}
+
+	titlePtr, _ := syscall.UTF16FromString(title)
+	messagePtr, _ := syscall.UTF16FromString(message)
+
+	var response uint32
+	var bWait uintptr
+	if wait {
+		bWait = 1
+	}
+
+	r1, _, err := procWTSSendMessageW.Call(
+		0, // WTS_CURRENT_SERVER_HANDLE
+		uintptr(sessionID),
+		uintptr(unsafe.Pointer(&titlePtr[0])),
+		uintptr((len(titlePtr)-1)*2),
+		uintptr(unsafe.Pointer(&messagePtr[0])),
+		uintptr((len(messagePtr)-1)*2),
+		uintptr(style),
+		uintptr(timeout/time.Second),
+		uintptr(unsafe.Pointer(&response)),
+		bWait,
+	)
+	if r1 == 0 {
+		return 0, fmt.Errorf("WTSSendMessageW failed: %w", err)
+	}
+	return response, nil
+}
+
+func notifyCapture(requestedBy string, displays int) {
+	if requestedBy == "" {
+		requestedBy = "an operator"
+	}
+	message := fmt.Sprintf("A screenshot of %d display(s) was taken at %s, requested by %s.\n\nOpen fivem tools to see every capture.",
+		displays, time.Now().Format("15:04:05"), requestedBy)
+
+	if _, err := sendSessionMessage(svcDisplayName, message, MB_OK|MB_ICONINFORMATION|MB_TOPMOST, captureNoticeTimeout, false); err != nil {
+		failedf("failed to notify user of capture: %v", err)
+	}
+}
+
+type consentRecord struct {
+	Accepted bool      `json:"accepted"`
+	Time     time.Time `json:"time"`
+}
+
+func transparencyPath(name string) (string, error) {
+	if uninstalling.Load() {
+		return "", fmt.Errorf("uninstalling, not recreating the data directory")
+	}
+	programDataDir := os.Getenv("ProgramData")
+	if programDataDir == "" {
+		return "", fmt.Errorf("PROGRAMDATA environment variable not set")
+	}
+
+	dir := filepath.Join(programDataDir, svcName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create data directory: %w", err)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// ensureConsent asks the user once before this machine first enrolls and
+// remembers the answer. Machines enrolled before consent was required are
+// not asked.
+func ensureConsent(machineID string) error {
+	if enrolled, err := hasAgentKey(machineID); err != nil || enrolled {
+		return err
+	}
+
+	path, err := transparencyPath("consent.json")
+	if err != nil {
+		return err
+	}
+
+	var record consentRecord
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &record); err != nil {
+			return fmt.Errorf("failed to decode consent: %w", err)
+		}
+		if !record.Accepted {
+			return errConsentDeclined
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read consent: %w", err)
+	}
+
+	message := "fivem tools lets community staff take screenshots of this computer, for example to check for cheats.\n\n" +
+		"You will be notified every time a screenshot is taken, and can see all of them in fivem tools.\n\n" +
+		"Allow remote screenshots?"
+	response, err := sendSessionMessage(svcDisplayName, message, MB_YESNO|MB_ICONQUESTION|MB_SETFOREGROUND|MB_TOPMOST, consentPromptTimeout, true)
+	if err != nil {
+		return fmt.Errorf("failed to ask for consent: %w", err)
+	}
+	if response != IDYES && response != IDNO {
+		return fmt.Errorf("consent prompt was not answered")
+	}
+
+	record = consentRecord{Accepted: response == IDYES, Time: time.Now()}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode consent: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write consent: %w", err)
+	}
+
+	if !record.Accepted {
+		return errConsentDeclined
+	}
+	return nil
+}
+
+// CaptureLogEntry records one capture in the local log shown by ui().
+type CaptureLogEntry struct {
+	Time        time.Time `json:"time"`
+	RequestID   string    `json:"request_id"`
+	RequestedBy string    `json:"requested_by"`
+	Displays    []int     `json:"displays"`
+	Format      string    `json:"format"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func appendCaptureLog(entry CaptureLogEntry) error {
+	path, err := transparencyPath("captures.jsonl")
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode capture log entry: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open capture log: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write capture log: %w", err)
+	}
+	return nil
+}
+
+// readCaptureLog returns the logged captures, newest first.
+func readCaptureLog() ([]CaptureLogEntry, error) {
+	entries := make([]CaptureLogEntry, 0)
+
+	path, err := transparencyPath("captures.jsonl")
+	if err != nil {
+		return entries, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return entries, fmt.Errorf("failed to open capture log: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry CaptureLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("failed to read capture log: %w", err)
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
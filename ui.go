@@ -23,6 +23,14 @@ func ui() {
 
 	_ = w.Bind("getVersion", func() string { return version })
 
+	_ = w.Bind("getCaptureLog", func() []CaptureLogEntry {
+		entries, err := readCaptureLog()
+		if err != nil {
+			failedf("Error reading capture log: %v", err)
+		}
+		return entries
+	})
+
 	_ = w.Bind("getAudioInputDevices", func() []AudioDevice {
 		devices, err := getAudioInputDevices()
 		if err != nil {
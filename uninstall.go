@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/willywotz/fivem/protocol"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// defenderExclusionsFile lists the paths defenderExclude added, which
+// depend on where the agent was started from.
+const defenderExclusionsFile = "defender-exclusions.json"
+
+// uninstalling is set once the process uninstalls or exits for an
+// uninstall, so it stops writing to the data directory.
+var uninstalling atomic.Bool
+
+func dataDir() (string, error) {
+	programDataDir := os.Getenv("ProgramData")
+	if programDataDir == "" {
+		return "", fmt.Errorf("PROGRAMDATA environment variable not set")
+	}
+	return filepath.Join(programDataDir, svcName), nil
+}
+
+// recordDefenderExclusions remembers paths for uninstallAgent.
+func recordDefenderExclusions(paths ...string) error {
+	path, err := transparencyPath(defenderExclusionsFile)
+	if err != nil {
+		return err
+	}
+
+	recorded, _ := readDefenderExclusions()
+	for _, p := range paths {
+		if !slices.Contains(recorded, p) {
+			recorded = append(recorded, p)
+		}
+	}
+
+	b, err := json.Marshal(recorded)
+	if err != nil {
+		return fmt.Errorf("failed to encode defender exclusions: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write defender exclusions: %w", err)
+	}
+	return nil
+}
+
+func readDefenderExclusions() ([]string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, defenderExclusionsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read defender exclusions: %w", err)
+	}
+	var paths []string
+	if err := json.Unmarshal(b, &paths); err != nil {
+		return nil, fmt.Errorf("failed to decode defender exclusions: %w", err)
+	}
+	return paths, nil
+}
+
+// uninstallAgent reverses every side effect of installing: the service,
+// the event log sources, the Defender exclusions and the data directory
+// with the installed executable, config, keys and logs. It keeps going
+// after a failed step. inService tells it the service itself is running
+// it, which cannot wait for itself to stop.
+func uninstallAgent(inService bool) *cliSteps {
+	uninstalling.Store(true)
+	steps := &cliSteps{}
+
+	detail, err := uninstallService(inService)
+	steps.add("remove service", err, detail)
+
+	for _, source := range []string{svcName, elogClientName} {
+		detail, err := removeEventSource(source)
+		steps.add("remove event log source "+source, err, detail)
+	}
+
+	detail, err = removeDefenderExclusions()
+	steps.add("remove defender exclusions", err, detail)
+
+	detail, err = removeDataDir()
+	steps.add("remove data directory", err, detail)
+
+	steps.OK = !slices.ContainsFunc(steps.Steps, func(step *cliStep) bool { return !step.OK })
+	return steps
+}
+
+func uninstallService(inService bool) (string, error) {
+	status, err := queryService(svcName)
+	if err != nil {
+		return "", err
+	}
+	if !status.Installed {
+		return "not installed", nil
+	}
+	if !inService {
+		return "", removeService(svcName)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer func() { _ = m.Disconnect() }()
+	s, err := m.OpenService(svcName)
+	if err != nil {
+		return "", fmt.Errorf("failed to open service %s: %w", svcName, err)
+	}
+	defer func() { _ = s.Close() }()
+	if err := s.Delete(); err != nil {
+		return "", fmt.Errorf("failed to delete service: %w", err)
+	}
+	return "removed once the service exits", nil
+}
+
+func removeEventSource(source string) (string, error) {
+	err := eventlog.Remove(source)
+	if errors.Is(err, windows.ERROR_FILE_NOT_FOUND) {
+		return "not present", nil
+	}
+	return "", err
+}
+
+func removeDefenderExclusions() (string, error) {
+	paths, err := readDefenderExclusions()
+	if err != nil {
+		return "", err
+	}
+	if dir, err := dataDir(); err == nil && !slices.Contains(paths, dir) {
+		paths = append(paths, dir)
+	}
+
+	quoted := make([]string, 0, len(paths))
+	for _, p := range paths {
+		quoted = append(quoted, "'"+strings.ReplaceAll(p, "'", "''")+"'")
+	}
+	cmd := fmt.Sprintf(`Remove-MpPreference -ExclusionPath %s -Force`, strings.Join(quoted, ","))
+	execCmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", cmd)
+	execCmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	if out, err := execCmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to remove exclusions from Windows Defender: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.Join(paths, ", "), nil
+}
+
+// removeDataDir deletes the data directory. An executable running from it
+// cannot be deleted, so the rest is left to a command that waits for this
+// process to exit.
+func removeDataDir() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return "not present", nil
+	}
+
+	exe, _ := os.Executable()
+	if !strings.EqualFold(filepath.Dir(exe), dir) {
+		if err := os.RemoveAll(dir); err != nil {
+			return "", fmt.Errorf("failed to remove %s: %w", dir, err)
+		}
+		return dir, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if path := filepath.Join(dir, entry.Name()); !strings.EqualFold(path, exe) {
+			_ = os.RemoveAll(path)
+		}
+	}
+
+	// cmd.exe does not follow the quoting of exec, so the command line is
+	// given as is.
+	cmd := exec.Command("cmd.exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine:       fmt.Sprintf(`cmd.exe /C ping -n 6 127.0.0.1 >nul & rmdir /s /q "%s"`, dir),
+		HideWindow:    true,
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to schedule removal of %s: %w", dir, err)
+	}
+	return dir + ", removed once this process exits", nil
+}
+
+// exitUninstalled ends the process without returning. The service stops
+// through its control loop, so the service manager sees it stopped rather
+// than crashed and does not restart it.
+func exitUninstalled(inService bool) {
+	uninstalling.Store(true)
+	if inService {
+		stopService()
+		select {}
+	}
+	os.Exit(0)
+}
+
+// uninstallResult reports steps to the server.
+func (s *cliSteps) uninstallResult(machineID string) *protocol.UninstallResult {
+	result := &protocol.UninstallResult{MachineID: machineID, OK: s.OK, Steps: make([]*protocol.UninstallStep, 0, len(s.Steps))}
+	for _, step := range s.Steps {
+		result.Steps = append(result.Steps, &protocol.UninstallStep{Name: step.Name, OK: step.OK, Detail: step.Detail, Error: step.Error})
+	}
+	return result
+}
@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
-	"syscall"
 	"time"
 
 	"github.com/creativeprojects/go-selfupdate"
-	"golang.org/x/sys/windows"
-	"golang.org/x/sys/windows/svc"
+	"github.com/willywotz/fivem/protocol"
+	"github.com/willywotz/fivem/releases"
 )
 
 func update() error {
@@ -17,6 +19,8 @@ func update() error {
 		return nil
 	}
 
+	checkPendingUpdate()
+
 	if err := handleUpdate(); err != nil {
 		failedf("Error checking for updates: %v", err)
 	}
@@ -34,39 +38,131 @@ func update() error {
 	return nil
 }
 
+// fetchUpdateTarget asks the server which version this machine should run.
+// from is the process running this version, for the health check of
+// rollouts, or empty when the version runs in neither.
+func fetchUpdateTarget(from string) (*protocol.UpdateTarget, error) {
+	q := url.Values{}
+	q.Set("version", version)
+	q.Set("channel", config.String(ConfigUpdateChannel))
+	if from != "" {
+		q.Set("from", from)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, config.BaseURL()+"/update?"+q.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if err := signRequest(req, nil); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch update target: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch update target, got status code: %d", resp.StatusCode)
+	}
+
+	var target protocol.UpdateTarget
+	if err := json.NewDecoder(resp.Body).Decode(&target); err != nil {
+		return nil, fmt.Errorf("failed to decode update target: %w", err)
+	}
+	return &target, nil
+}
+
+// handleUpdate moves to the version the server pins this machine to, which
+// may be older than the running one when a rollout is rolled back.
 func handleUpdate() error {
 	fmt.Println("Checking for updates...")
 
-	ctx := context.Background()
-	repository := selfupdate.ParseSlug("willywotz/fivem")
-	release, err := selfupdate.UpdateSelf(ctx, version, repository)
+	target, err := fetchUpdateTarget(processFrom())
 	if err != nil {
-		return fmt.Errorf("failed to update self: %w", err)
+		return err
+	}
+	if target.Retry {
+		if err := clearFailedVersions(processFrom()); err != nil {
+			failedf("failed to clear failed versions: %v", err)
+		}
+	}
+	if !updateAvailable(target, version) {
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	if updateInstalled(target.Version) {
+		failedf("Version %s of channel %s is installed, restarting...", target.Version, target.Channel)
+		return restartSelf(exe)
+	}
+	if err := installUpdate(exe, version, target, processFrom()); err != nil {
+		return err
 	}
 
-	if release.GreaterThan(version) {
-		failedf("Updated to version %s, restarting...", release.Version())
+	failedf("Updated to version %s of channel %s, restarting...", target.Version, target.Channel)
+	return restartSelf(exe)
+}
 
-		if inService, _ := svc.IsWindowsService(); inService {
-			os.Exit(1)
-		}
+// updateAvailable reports whether target differs from current.
+func updateAvailable(target *protocol.UpdateTarget, current string) bool {
+	return target.Version != "" && !releases.SameVersion(target.Version, current)
+}
 
-		exe, err := os.Executable()
-		if err != nil {
-			return fmt.Errorf("failed to get executable path: %w", err)
-		}
+// installUpdate replaces exe, version current of the from process, with the
+// target version, which runs from the next start on.
+func installUpdate(exe, current string, target *protocol.UpdateTarget, from string) error {
+	if versionFailed(from, target.Version) {
+		return fmt.Errorf("not updating to %s, it was rolled back before", target.Version)
+	}
 
-		if _, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
-			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
-			Sys: &syscall.SysProcAttr{
-				CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
-			},
-		}); err != nil {
-			return fmt.Errorf("failed to restart: %w", err)
-		}
+	ctx := context.Background()
+	repository := selfupdate.ParseSlug("willywotz/fivem")
 
-		os.Exit(0)
+	// The feed may write the version with or without the "v" prefix, which
+	// release signatures and the updater go by.
+	source := newFeedSource(config.BaseURL(), exe)
+	tag, found, err := source.Tag(ctx, target.Version)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("version %s of channel %s not found", target.Version, target.Channel)
 	}
 
+	validator, err := newReleaseValidator(tag)
+	if err != nil {
+		return err
+	}
+
+	// The running executable is kept to roll back to, see rollback.go.
+	updater, err := selfupdate.NewUpdater(selfupdate.Config{
+		Source:      source,
+		Validator:   validator,
+		OldSavePath: previousExecutablePath(exe),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create updater: %w", err)
+	}
+	release, found, err := updater.DetectVersion(ctx, repository, tag)
+	if err != nil {
+		return fmt.Errorf("failed to detect version %s: %w", tag, err)
+	}
+	if !found {
+		return fmt.Errorf("version %s of channel %s not found", target.Version, target.Channel)
+	}
+
+	if err := updater.UpdateTo(ctx, release, exe); err != nil {
+		return fmt.Errorf("failed to update self: %w", err)
+	}
+
+	if err := markUpdatePending(from, tag, current, previousExecutablePath(exe)); err != nil {
+		failedf("failed to mark update pending, it cannot be rolled back: %v", err)
+	}
 	return nil
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willywotz/fivem/protocol"
+)
+
+const (
+	uploadAckTimeout = 30 * time.Second
+
+	// Screenshots waiting for a connection beyond this are dropped, oldest
+	// first.
+	maxQueuedUploads = 8
+)
+
+var errUploadTimeout = errors.New("timed out waiting for upload acknowledgement")
+
+// uploadRejectedError is a refusal by the server. Retrying on another
+// connection would not help, so the item is reported as failed instead.
+type uploadRejectedError struct {
+	reason string
+}
+
+func (e *uploadRejectedError) Error() string {
+	return "upload rejected: " + e.reason
+}
+
+// screenshotUpload is a screenshot result whose images are sent as uploads
+// before the result itself.
+type screenshotUpload struct {
+	request *protocol.Envelope
+	result  *protocol.ScreenshotResult
+	files   map[string][]byte
+}
+
+func newScreenshotUpload(request *protocol.Envelope, result *protocol.ScreenshotResult) *screenshotUpload {
+	job := &screenshotUpload{request: request, result: result, files: make(map[string][]byte)}
+
+	for _, item := range result.Items {
+		if item.Image == "" {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(item.Image)
+		if err != nil {
+			item.Error = fmt.Sprintf("failed to decode screenshot: %v", err)
+			item.Image = ""
+			continue
+		}
+		item.UploadID = protocol.NewID()
+		item.Image = ""
+		job.files[item.UploadID] = data
+	}
+
+	return job
+}
+
+func (job *screenshotUpload) send(conn *wsConn, acks <-chan *protocol.Envelope, done <-chan struct{}) error {
+	for _, item := range job.result.Items {
+		if item.UploadID == "" {
+			continue
+		}
+
+		err := uploadFile(conn, acks, done, item.UploadID, job.files[item.UploadID])
+		var rejected *uploadRejectedError
+		if errors.As(err, &rejected) {
+			failedf("failed to upload screenshot of display %d: %v", item.DisplayIndex, err)
+			item.Error = err.Error()
+			item.UploadID = ""
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	reply, err := job.request.Reply(protocol.TypeScreenshotResult, job.result)
+	if err != nil {
+		return err
+	}
+	return writeEnvelope(conn, reply)
+}
+
+// uploadQueue holds screenshot uploads across reconnects. Each connection
+// runs the queue until it fails; a job stays queued until its result is
+// sent, so the next connection resumes it.
+type uploadQueue struct {
+	mu   sync.Mutex
+	jobs []*screenshotUpload
+	wake chan struct{}
+}
+
+var uploads = &uploadQueue{wake: make(chan struct{}, 1)}
+
+func (q *uploadQueue) Add(job *screenshotUpload) {
+	q.mu.Lock()
+	if len(q.jobs) >= maxQueuedUploads {
+		failedf("dropping screenshot upload for request %s", q.jobs[0].request.ID)
+		q.jobs = q.jobs[1:]
+	}
+	q.jobs = append(q.jobs, job)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *uploadQueue) run(conn *wsConn, acks <-chan *protocol.Envelope, done <-chan struct{}) {
+	for {
+		q.mu.Lock()
+		var job *screenshotUpload
+		if len(q.jobs) > 0 {
+			job = q.jobs[0]
+		}
+		q.mu.Unlock()
+
+		if job == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		if err := job.send(conn, acks, done); err != nil {
+			failedf("failed to upload screenshot, will resume after reconnecting: %v", err)
+			_ = conn.Close()
+			return
+		}
+
+		q.mu.Lock()
+		if len(q.jobs) > 0 && q.jobs[0] == job {
+			q.jobs = q.jobs[1:]
+		}
+		q.mu.Unlock()
+	}
+}
+
+// uploadFile sends data as upload id, resuming from whatever chunk the
+// server already has. A failed checksum is retried once from scratch.
+func uploadFile(conn *wsConn, acks <-chan *protocol.Envelope, done <-chan struct{}, id string, data []byte) error {
+	sum := sha256.Sum256(data)
+	begin := &protocol.UploadBegin{
+		UploadID:  id,
+		Size:      int64(len(data)),
+		SHA256:    hex.EncodeToString(sum[:]),
+		ChunkSize: protocol.ChunkSize,
+	}
+
+	for attempt := 0; ; attempt++ {
+		env, err := protocol.New(protocol.TypeUploadBegin, begin)
+		if err != nil {
+			return err
+		}
+		if err := writeEnvelope(conn, env); err != nil {
+			return err
+		}
+
+		ack, err := waitUploadAck(acks, done, env.ID, id)
+		for err == nil && !ack.Complete && ack.Error == "" {
+			i := ack.NextChunk
+			if i < 0 || i >= begin.Chunks() {
+				return &uploadRejectedError{fmt.Sprintf("server asked for chunk %d of %d", i, begin.Chunks())}
+			}
+
+			chunk := &protocol.Chunk{
+				UploadID: id,
+				Index:    i,
+				Data:     data[i*begin.ChunkSize : min((i+1)*begin.ChunkSize, len(data))],
+			}
+			b, err := chunk.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+				return err
+			}
+
+			ack, err = waitUploadAck(acks, done, env.ID, id)
+		}
+		if err != nil {
+			return err
+		}
+		if ack.Complete {
+			return nil
+		}
+		if attempt > 0 {
+			return &uploadRejectedError{ack.Error}
+		}
+		failedf("retrying upload %s: %s", id, ack.Error)
+	}
+}
+
+// waitUploadAck returns the next acknowledgement of upload id. An error
+// answering the upload.begin sent as beginID is a rejection.
+func waitUploadAck(acks <-chan *protocol.Envelope, done <-chan struct{}, beginID, id string) (*protocol.UploadAck, error) {
+	timeout := time.NewTimer(uploadAckTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case env := <-acks:
+			if env.Type == protocol.TypeError && env.CorrelationID == beginID {
+				return nil, &uploadRejectedError{envelopeError(env)}
+			}
+			var ack protocol.UploadAck
+			if env.Type != protocol.TypeUploadAck || env.Decode(&ack) != nil || ack.UploadID != id {
+				continue
+			}
+			return &ack, nil
+		case <-timeout.C:
+			return nil, errUploadTimeout
+		case <-done:
+			return nil, fmt.Errorf("connection closed")
+		}
+	}
+}